@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang-docker-deploy/docker"
+)
+
+// client is what the commands need from the deploy service, either the
+// docker package itself or the main server API.
+type client interface {
+	Apply(ctx context.Context, deployment docker.Deployment) (docker.ReconcileResult, error)
+	Deployments(ctx context.Context) ([]docker.Deployment, error)
+	Deployment(ctx context.Context, name string) (*docker.DeploymentStatus, error)
+	Delete(ctx context.Context, name string) ([]string, error)
+	// Logs calls output with every log line of the container until the log
+	// ends or, when following, ctx is cancelled.
+	Logs(ctx context.Context, id string, options docker.LogOptions, output func(line string) error) error
+}
+
+// directClient drives the local docker daemon through the docker package, sharing
+// the state file of the main server. It must not be used while the server runs.
+type directClient struct {
+	manager *docker.Manager
+}
+
+func newDirectClient(ctx context.Context, portRange string, stateFile string) (*directClient, error) {
+	rt, err := docker.NewDockerRuntime()
+	if err != nil {
+		return nil, err
+	}
+	ports, err := docker.ParsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+	manager := docker.NewManager(rt, ports)
+	if _, err := manager.Restore(ctx, stateFile, false); err != nil {
+		return nil, err
+	}
+	return &directClient{manager: manager}, nil
+}
+
+func (c *directClient) Apply(ctx context.Context, deployment docker.Deployment) (docker.ReconcileResult, error) {
+	return c.manager.Apply(ctx, deployment)
+}
+
+func (c *directClient) Deployments(ctx context.Context) ([]docker.Deployment, error) {
+	return c.manager.Deployments(ctx), nil
+}
+
+func (c *directClient) Deployment(ctx context.Context, name string) (*docker.DeploymentStatus, error) {
+	return c.manager.DeploymentStatus(ctx, name)
+}
+
+func (c *directClient) Delete(ctx context.Context, name string) ([]string, error) {
+	return c.manager.DeleteDeployment(ctx, name)
+}
+
+func (c *directClient) Logs(ctx context.Context, id string, options docker.LogOptions, output func(line string) error) error {
+	return c.manager.StreamLogs(ctx, id, options, func(stream string, line string) error {
+		return output(line)
+	})
+}
+
+// remoteClient talks to the main server over HTTP.
+type remoteClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+func newRemoteClient(server string, token string) *remoteClient {
+	return &remoteClient{
+		server: strings.TrimRight(server, "/"),
+		token:  token,
+		client: &http.Client{},
+	}
+}
+
+// do sends the request and decodes the JSON response into result, if not nil.
+func (c *remoteClient) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	resp, err := c.send(ctx, method, path, body, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("Invalid response from %s: %s", c.server, err.Error())
+	}
+	return nil
+}
+
+// send sends the request, asking for the accept content type if not empty, and
+// turns an error response into an error.
+func (c *remoteClient) send(ctx context.Context, method string, path string, body interface{}, accept string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		failure := struct {
+			Error string `json:"error"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return nil, fmt.Errorf("Server returned %s", resp.Status)
+		}
+		return nil, fmt.Errorf("%s", failure.Error)
+	}
+	return resp, nil
+}
+
+func (c *remoteClient) Apply(ctx context.Context, deployment docker.Deployment) (docker.ReconcileResult, error) {
+	// The owner is set by the server from the token.
+	deployment.Tenant = ""
+	result := docker.ReconcileResult{}
+	progress := docker.PullProgressFrom(ctx)
+	if progress == nil {
+		err := c.do(ctx, http.MethodPost, "/deployments", deployment, &result)
+		return result, err
+	}
+
+	// The pull progress comes first, one JSON object per line, the result last.
+	resp, err := c.send(ctx, http.MethodPost, "/deployments", deployment, "application/x-ndjson")
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		line := json.RawMessage{}
+		if err := decoder.Decode(&line); err != nil {
+			return result, fmt.Errorf("Invalid response from %s: %s", c.server, err.Error())
+		}
+		message := struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}{}
+		if err := json.Unmarshal(line, &message); err != nil {
+			return result, fmt.Errorf("Invalid response from %s: %s", c.server, err.Error())
+		}
+		switch {
+		case message.Error != "":
+			return result, fmt.Errorf("%s", message.Error)
+		case message.Status != "":
+			pull := docker.PullProgress{}
+			if err := json.Unmarshal(line, &pull); err == nil {
+				progress(pull)
+			}
+		default:
+			err := json.Unmarshal(line, &result)
+			return result, err
+		}
+	}
+}
+
+func (c *remoteClient) Deployments(ctx context.Context) ([]docker.Deployment, error) {
+	list := make([]docker.Deployment, 0)
+	err := c.do(ctx, http.MethodGet, "/deployments", nil, &list)
+	return list, err
+}
+
+func (c *remoteClient) Deployment(ctx context.Context, name string) (*docker.DeploymentStatus, error) {
+	status := &docker.DeploymentStatus{}
+	if err := c.do(ctx, http.MethodGet, "/deployments/"+url.PathEscape(name), nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *remoteClient) Delete(ctx context.Context, name string) ([]string, error) {
+	result := struct {
+		Removed []string `json:"removed"`
+	}{}
+	err := c.do(ctx, http.MethodDelete, "/deployments/"+url.PathEscape(name), nil, &result)
+	return result.Removed, err
+}
+
+func (c *remoteClient) Logs(ctx context.Context, id string, options docker.LogOptions, output func(line string) error) error {
+	query := url.Values{}
+	query.Set("follow", fmt.Sprint(options.Follow))
+	query.Set("timestamps", fmt.Sprint(options.Timestamps))
+	if options.Tail != "" {
+		query.Set("tail", options.Tail)
+	}
+	if options.Since != "" {
+		query.Set("since", options.Since)
+	}
+	resp, err := c.send(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/logs?"+query.Encode(), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := output(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
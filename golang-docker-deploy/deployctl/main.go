@@ -0,0 +1,265 @@
+// Command deployctl manages the deployments of the deploy service from the
+// command line. By default it talks to the main server over HTTP; with -direct
+// it drives the local docker daemon itself, sharing the state file of the server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang-docker-deploy/docker"
+)
+
+// defaultServer is the main server unless -server or DEPLOY_SERVER is set.
+const defaultServer = "http://localhost:8081"
+
+// defaultPortRange and defaultStateFile match the main server defaults.
+const (
+	defaultPortRange = "8082-8181"
+	defaultStateFile = "./state.json"
+)
+
+const usage = `Usage: deployctl [flags] <command> [arguments]
+
+Commands:
+  create -f <spec>            create or update a deployment from a YAML or JSON spec
+  list                        list the deployments
+  inspect <name>              show a deployment and its containers
+  scale <name> <replicas>     change the number of replicas
+  stop <name>                 scale a deployment down to zero, keeping its spec
+  rm <name>                   remove a deployment and its containers
+  logs [-f] [-tail n] <name>  print the logs of a deployment or a container
+
+Flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("deployctl", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	server := flags.String("server", envOr("DEPLOY_SERVER", defaultServer), "main server URL")
+	token := flags.String("token", os.Getenv("DEPLOY_TOKEN"), "API token of the main server")
+	direct := flags.Bool("direct", false, "use the local docker daemon instead of the main server")
+	stateFile := flags.String("state", envOr("STATE_FILE", defaultStateFile), "state file in direct mode")
+	portRange := flags.String("ports", envOr("PORT_RANGE", defaultPortRange), "host port range in direct mode")
+	format := flags.String("o", "table", "output format, table or json")
+	_ = flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *format != "table" && *format != "json" {
+		fail(fmt.Errorf("Unknown output format %q", *format))
+	}
+	out := &output{w: os.Stdout, json: *format == "json"}
+
+	// Cancelled on interrupt, which ends following the logs.
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	var c client
+	if *direct {
+		directClient, err := newDirectClient(ctx, *portRange, *stateFile)
+		if err != nil {
+			fail(err)
+		}
+		c = directClient
+	} else {
+		c = newRemoteClient(*server, *token)
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	var err error
+	switch command {
+	case "create", "apply":
+		err = create(ctx, c, out, args)
+	case "list", "ls":
+		err = list(ctx, c, out, args)
+	case "inspect":
+		err = inspect(ctx, c, out, args)
+	case "scale":
+		err = scale(ctx, c, out, args)
+	case "stop":
+		err = stop(ctx, c, out, args)
+	case "rm", "remove":
+		err = remove(ctx, c, out, args)
+	case "logs":
+		err = logs(ctx, c, out, args)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func envOr(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err.Error())
+	os.Exit(1)
+}
+
+// arguments checks the number of positional arguments of the command.
+func arguments(args []string, names ...string) error {
+	if len(args) != len(names) {
+		return fmt.Errorf("Expected arguments: %s", strings.Join(names, " "))
+	}
+	return nil
+}
+
+func create(ctx context.Context, c client, out *output, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	file := flags.String("f", "", "deployment spec file, - for the standard input")
+	_ = flags.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("Missing spec file, use -f")
+	}
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	deployment, err := docker.ParseDeployment(data)
+	if err != nil {
+		return err
+	}
+	result, err := c.Apply(docker.WithPullProgress(ctx, out.pullProgress), deployment)
+	if err != nil {
+		return err
+	}
+	return out.reconcileResult(deployment.Name, result)
+}
+
+func list(ctx context.Context, c client, out *output, args []string) error {
+	if err := arguments(args); err != nil {
+		return err
+	}
+	deployments, err := c.Deployments(ctx)
+	if err != nil {
+		return err
+	}
+	return out.deployments(deployments)
+}
+
+func inspect(ctx context.Context, c client, out *output, args []string) error {
+	if err := arguments(args, "<name>"); err != nil {
+		return err
+	}
+	status, err := c.Deployment(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return out.deploymentStatus(status)
+}
+
+func scale(ctx context.Context, c client, out *output, args []string) error {
+	if err := arguments(args, "<name>", "<replicas>"); err != nil {
+		return err
+	}
+	replicas, err := strconv.Atoi(args[1])
+	if err != nil || replicas < 0 {
+		return fmt.Errorf("Invalid replica count %q", args[1])
+	}
+	return setReplicas(ctx, c, out, args[0], replicas)
+}
+
+// stop scales the deployment to zero. Stopping the containers alone would not
+// last, the supervisor restarts stopped workers.
+func stop(ctx context.Context, c client, out *output, args []string) error {
+	if err := arguments(args, "<name>"); err != nil {
+		return err
+	}
+	return setReplicas(ctx, c, out, args[0], 0)
+}
+
+func setReplicas(ctx context.Context, c client, out *output, name string, replicas int) error {
+	status, err := c.Deployment(ctx, name)
+	if err != nil {
+		return err
+	}
+	deployment := status.Deployment
+	deployment.Replicas = replicas
+	result, err := c.Apply(docker.WithPullProgress(ctx, out.pullProgress), deployment)
+	if err != nil {
+		return err
+	}
+	return out.reconcileResult(name, result)
+}
+
+func remove(ctx context.Context, c client, out *output, args []string) error {
+	if err := arguments(args, "<name>"); err != nil {
+		return err
+	}
+	removed, err := c.Delete(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return out.removed(args[0], removed)
+}
+
+// logs prints the logs of a container, or of every container of a deployment
+// with the container name in front of each line.
+func logs(ctx context.Context, c client, out *output, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "follow the logs")
+	tail := flags.String("tail", "", "number of lines to show from the end of the logs")
+	timestamps := flags.Bool("t", false, "show timestamps")
+	_ = flags.Parse(args)
+	if err := arguments(flags.Args(), "<deployment or container>"); err != nil {
+		return err
+	}
+	options := docker.LogOptions{Follow: *follow, Tail: *tail, Timestamps: *timestamps}
+	name := flags.Arg(0)
+
+	status, err := c.Deployment(ctx, name)
+	if err != nil {
+		// Not a deployment, try a container.
+		return c.Logs(ctx, name, options, out.line)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(status.Containers))
+	for i, info := range status.Containers {
+		wg.Add(1)
+		go func(i int, info docker.ContainerInfo) {
+			defer wg.Done()
+			errs[i] = c.Logs(ctx, info.ID, options, func(line string) error {
+				return out.line(info.Name + " | " + line)
+			})
+		}(i, info)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+	return nil
+}
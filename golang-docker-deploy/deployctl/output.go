@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang-docker-deploy/docker"
+)
+
+// output prints the command results either as aligned tables or as JSON.
+type output struct {
+	w     io.Writer
+	json  bool
+	mutex sync.Mutex
+}
+
+func (o *output) writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(o.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// table prints the rows below the header with aligned columns.
+func (o *output) table(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// line prints a log line, it is safe for concurrent use.
+func (o *output) line(line string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	_, err := fmt.Fprintln(o.w, line)
+	return err
+}
+
+func (o *output) deployments(deployments []docker.Deployment) error {
+	if o.json {
+		return o.writeJSON(deployments)
+	}
+	rows := make([][]string, 0, len(deployments))
+	for _, d := range deployments {
+		rows = append(rows, []string{d.Name, fmt.Sprint(d.Replicas), d.Image, strings.Join(d.Ports, ","), d.Tenant})
+	}
+	return o.table([]string{"NAME", "REPLICAS", "IMAGE", "PORTS", "TENANT"}, rows)
+}
+
+func (o *output) deploymentStatus(status *docker.DeploymentStatus) error {
+	if o.json {
+		return o.writeJSON(status)
+	}
+	running := 0
+	for _, info := range status.Containers {
+		if info.State == "running" {
+			running++
+		}
+	}
+	fmt.Fprintf(o.w, "Name:      %s\n", status.Name)
+	fmt.Fprintf(o.w, "Image:     %s\n", status.Image)
+	fmt.Fprintf(o.w, "Replicas:  %d desired, %d running\n", status.Replicas, running)
+	if status.Tenant != "" {
+		fmt.Fprintf(o.w, "Tenant:    %s\n", status.Tenant)
+	}
+	fmt.Fprintln(o.w)
+
+	rows := make([][]string, 0, len(status.Containers))
+	for _, info := range status.Containers {
+		ports := make([]string, 0, len(info.Ports))
+		for _, port := range info.Ports {
+			ports = append(ports, fmt.Sprintf("%s->%s/%s", port.HostPort, port.ContainerPort, port.Protocol))
+		}
+		rows = append(rows, []string{
+			shortID(info.ID), info.Name, info.State, strings.Join(ports, ","), info.Image,
+			info.Created.Local().Format(time.RFC3339),
+		})
+	}
+	return o.table([]string{"CONTAINER", "NAME", "STATE", "PORTS", "IMAGE", "CREATED"}, rows)
+}
+
+func (o *output) reconcileResult(name string, result docker.ReconcileResult) error {
+	if o.json {
+		return o.writeJSON(result)
+	}
+	_, err := fmt.Fprintf(o.w, "Deployment %s: %d created, %d replaced, %d removed\n",
+		name, len(result.Created), len(result.Replaced), len(result.Removed))
+	return err
+}
+
+// pullProgress prints the progress of an image pull to the standard error, the
+// standard output is left to the result.
+func (o *output) pullProgress(progress docker.PullProgress) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	fmt.Fprintf(os.Stderr, "%s %s\n", progress.Image, progress.String())
+}
+
+func (o *output) removed(name string, removed []string) error {
+	if o.json {
+		return o.writeJSON(map[string][]string{"removed": removed})
+	}
+	_, err := fmt.Fprintf(o.w, "Deployment %s removed with %d containers\n", name, len(removed))
+	return err
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,118 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang-docker-deploy/utils"
+)
+
+// jsonMessage is a single entry of the docker build and pull output streams.
+type jsonMessage struct {
+	Stream         string `json:"stream"`
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	Progress       string `json:"progress"`
+	ProgressDetail *struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail,omitempty"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// BuildImage tars the build context found in contextDir, leaving out the paths
+// listed in its .dockerignore, builds an image from it and calls output with each
+// line of the build log as soon as it arrives.
+func (m *Manager) BuildImage(ctx context.Context, contextDir string, options BuildOptions, output func(line string)) error {
+	if options.Dockerfile == "" {
+		options.Dockerfile = "Dockerfile"
+	}
+	if _, err := os.Stat(filepath.Join(contextDir, options.Dockerfile)); err != nil {
+		err = fmt.Errorf("Invalid build context: %s", err.Error())
+		return err
+	}
+
+	excludes, err := utils.ReadIgnoreFile(filepath.Join(contextDir, ".dockerignore"))
+	if err != nil {
+		err = fmt.Errorf("Failed to read .dockerignore: %s", err.Error())
+		return err
+	}
+	// The Dockerfile and the .dockerignore are needed by the daemon, even if ignored.
+	// An exception makes the whole context walked, so it is only added when needed.
+	for _, name := range []string{options.Dockerfile, ".dockerignore"} {
+		ignored, err := utils.Excluded(excludes, name)
+		if err != nil {
+			return fmt.Errorf("Invalid .dockerignore: %s", err.Error())
+		}
+		if ignored {
+			excludes = append(excludes, "!"+name)
+		}
+	}
+
+	// The context is archived while it is sent, nothing is written to disk.
+	buildContext, writer := io.Pipe()
+	defer buildContext.Close()
+	go func() {
+		writer.CloseWithError(utils.WriteTar(writer, contextDir, utils.TarOptions{
+			Excludes:     excludes,
+			Reproducible: true,
+		}))
+	}()
+
+	stream, err := m.rt.Build(ctx, buildContext, options)
+	if err != nil {
+		err = fmt.Errorf("Failed to build image: %s", err.Error())
+		return err
+	}
+	defer stream.Close()
+	return readBuildOutput(stream, output)
+}
+
+// readBuildOutput decodes the docker JSON message stream and splits the
+// output into lines. A build error reported in the stream is returned.
+func readBuildOutput(stream io.Reader, output func(line string)) error {
+	decoder := json.NewDecoder(bufio.NewReader(stream))
+	pending := ""
+	for {
+		msg := jsonMessage{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read build output: %s", err.Error())
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+
+		text := msg.Stream
+		if text == "" && msg.Status != "" {
+			text = strings.TrimSpace(strings.Join([]string{msg.ID, msg.Status, msg.Progress}, " ")) + "\n"
+		}
+		pending += text
+		for {
+			i := strings.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			output(strings.TrimRight(pending[:i], "\r"))
+			pending = pending[i+1:]
+		}
+	}
+	if pending != "" {
+		output(pending)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildImage(t *testing.T) {
+	tests := []struct {
+		name         string
+		dockerignore string
+		dockerfile   string
+	}{
+		{"no .dockerignore", "", "Dockerfile"},
+		{"unrelated patterns", "node_modules\n*.md\n", "Dockerfile"},
+		{"ignored Dockerfile", "*\n", "Dockerfile"},
+		{"ignored Dockerfile in a directory", "build\n", "build/Dockerfile"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "build")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := os.MkdirAll(filepath.Join(dir, "build"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(test.dockerfile)), []byte("FROM scratch\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.dockerignore != "" {
+				if err := ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte(test.dockerignore), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m, rt := newTestManager(t, "47230-47239")
+			options := BuildOptions{Dockerfile: test.dockerfile, Tags: []string{"app:1"}}
+			if err := m.BuildImage(context.Background(), dir, options, func(string) {}); err != nil {
+				t.Fatal(err)
+			}
+			if exists, _ := rt.ImageExists(context.Background(), "app:1"); !exists {
+				t.Errorf("Image app:1 is not built")
+			}
+		})
+	}
+}
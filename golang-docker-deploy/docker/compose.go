@@ -0,0 +1,438 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ComposeFile is the supported subset of a docker-compose.yml.
+type ComposeFile struct {
+	Services map[string]ComposeService `json:"services"`
+	Networks map[string]ComposeNetwork `json:"networks,omitempty"`
+	// Volumes are the named volumes the services may mount.
+	Volumes []string `json:"volumes,omitempty"`
+}
+
+// ComposeService is a service of a compose file.
+type ComposeService struct {
+	Image       string            `json:"image"`
+	Command     []string          `json:"command,omitempty"`
+	Ports       []PortMapping     `json:"ports,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	// Networks maps the networks of the service to its extra DNS aliases on them.
+	Networks  map[string][]string `json:"networks,omitempty"`
+	DependsOn []string            `json:"dependsOn,omitempty"`
+	Restart   string              `json:"restart,omitempty"`
+}
+
+// ComposeNetwork is a network of a compose file.
+type ComposeNetwork struct {
+	Internal bool `json:"internal,omitempty"`
+}
+
+// The keys understood by ParseCompose, anything else is rejected.
+var (
+	composeKeys        = []string{"version", "services", "networks", "volumes"}
+	composeServiceKeys = []string{"image", "command", "ports", "environment", "volumes", "networks", "depends_on", "restart"}
+	composeNetworkKeys = []string{"driver", "internal"}
+)
+
+// ParseCompose parses a docker-compose.yml limited to the services with their image,
+// command, ports, environment, volumes, networks, depends_on and restart policy, and
+// the top level networks and volumes. Unsupported keys are reported as errors
+// rather than silently ignored.
+func ParseCompose(data []byte) (ComposeFile, error) {
+	file := ComposeFile{
+		Services: make(map[string]ComposeService),
+		Networks: make(map[string]ComposeNetwork),
+		Volumes:  make([]string, 0),
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return file, fmt.Errorf("%w: invalid compose file: %s", ErrInvalidSpec, err.Error())
+	}
+	top, err := composeMap("", raw, composeKeys)
+	if err != nil {
+		return file, err
+	}
+
+	networks, err := composeMap("networks", top["networks"], nil)
+	if err != nil {
+		return file, err
+	}
+	for name, value := range networks {
+		network, err := parseComposeNetwork("networks."+name, value)
+		if err != nil {
+			return file, err
+		}
+		file.Networks[name] = network
+	}
+
+	volumes, err := composeMap("volumes", top["volumes"], nil)
+	if err != nil {
+		return file, err
+	}
+	for name, value := range volumes {
+		if _, err := composeMap("volumes."+name, value, []string{}); err != nil {
+			return file, err
+		}
+		if !volumeNamePattern.MatchString(name) {
+			return file, fmt.Errorf("%w: invalid volume name %q", ErrInvalidSpec, name)
+		}
+		file.Volumes = append(file.Volumes, name)
+	}
+	sort.Strings(file.Volumes)
+
+	services, err := composeMap("services", top["services"], nil)
+	if err != nil {
+		return file, err
+	}
+	if len(services) == 0 {
+		return file, fmt.Errorf("%w: no services", ErrInvalidSpec)
+	}
+	for name, value := range services {
+		if !deploymentNamePattern.MatchString(name) {
+			return file, fmt.Errorf("%w: invalid service name %q", ErrInvalidSpec, name)
+		}
+		service, err := parseComposeService("services."+name, value, file)
+		if err != nil {
+			return file, err
+		}
+		file.Services[name] = service
+	}
+	if _, err := file.StartOrder(); err != nil {
+		return file, err
+	}
+	return file, nil
+}
+
+// StartOrder returns the service names ordered so that every service comes after
+// the services it depends on.
+func (f ComposeFile) StartOrder() ([]string, error) {
+	names := make([]string, 0, len(f.Services))
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	order := make([]string, 0, len(names))
+	// 1 while visiting the dependencies of the service, 2 once it is ordered.
+	visited := make(map[string]int, len(names))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch visited[name] {
+		case 1:
+			return fmt.Errorf("%w: dependency cycle %s", ErrInvalidSpec, strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		service, ok := f.Services[name]
+		if !ok {
+			return fmt.Errorf("%w: service %s depends on unknown service %s", ErrInvalidSpec, path[len(path)-1], name)
+		}
+		visited[name] = 1
+		for _, dependency := range service.DependsOn {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visited[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func parseComposeNetwork(path string, value interface{}) (ComposeNetwork, error) {
+	network := ComposeNetwork{}
+	fields, err := composeMap(path, value, composeNetworkKeys)
+	if err != nil {
+		return network, err
+	}
+	if driver, ok := fields["driver"]; ok && fmt.Sprint(driver) != "bridge" {
+		return network, fmt.Errorf("%w: unsupported network driver %v in %s", ErrInvalidSpec, driver, path)
+	}
+	if internal, ok := fields["internal"]; ok {
+		if network.Internal, ok = internal.(bool); !ok {
+			return network, fmt.Errorf("%w: %s.internal must be true or false", ErrInvalidSpec, path)
+		}
+	}
+	return network, nil
+}
+
+func parseComposeService(path string, value interface{}, file ComposeFile) (ComposeService, error) {
+	service := ComposeService{
+		Environment: make(map[string]string),
+		Networks:    make(map[string][]string),
+		Ports:       make([]PortMapping, 0),
+		Mounts:      make([]Mount, 0),
+	}
+	fields, err := composeMap(path, value, composeServiceKeys)
+	if err != nil {
+		return service, err
+	}
+
+	image, ok := fields["image"].(string)
+	if !ok || image == "" {
+		return service, fmt.Errorf("%w: %s.image is missing", ErrInvalidSpec, path)
+	}
+	service.Image = image
+	if restart, ok := fields["restart"]; ok {
+		service.Restart = fmt.Sprint(restart)
+	}
+	switch command := fields["command"].(type) {
+	case nil:
+	case string:
+		service.Command = strings.Fields(command)
+	default:
+		if service.Command, err = composeStrings(path+".command", command); err != nil {
+			return service, err
+		}
+	}
+
+	ports, err := composeStrings(path+".ports", fields["ports"])
+	if err != nil {
+		return service, err
+	}
+	for _, port := range ports {
+		mapping, err := parseComposePort(port)
+		if err != nil {
+			return service, fmt.Errorf("%w: %s: %s", ErrInvalidSpec, path, err.Error())
+		}
+		service.Ports = append(service.Ports, mapping)
+	}
+
+	switch environment := fields["environment"].(type) {
+	case nil:
+	case map[interface{}]interface{}:
+		for key, value := range environment {
+			if value == nil {
+				return service, fmt.Errorf("%w: %s.environment.%v has no value", ErrInvalidSpec, path, key)
+			}
+			service.Environment[fmt.Sprint(key)] = fmt.Sprint(value)
+		}
+	default:
+		list, err := composeStrings(path+".environment", environment)
+		if err != nil {
+			return service, err
+		}
+		for _, variable := range list {
+			i := strings.IndexByte(variable, '=')
+			if i < 0 {
+				return service, fmt.Errorf("%w: %s.environment %s has no value", ErrInvalidSpec, path, variable)
+			}
+			service.Environment[variable[:i]] = variable[i+1:]
+		}
+	}
+
+	volumes, err := composeStrings(path+".volumes", fields["volumes"])
+	if err != nil {
+		return service, err
+	}
+	for _, volume := range volumes {
+		mount, err := parseComposeVolume(volume, file.Volumes)
+		if err != nil {
+			return service, fmt.Errorf("%w: %s: %s", ErrInvalidSpec, path, err.Error())
+		}
+		service.Mounts = append(service.Mounts, mount)
+	}
+
+	switch networks := fields["networks"].(type) {
+	case nil:
+	case map[interface{}]interface{}:
+		for key, value := range networks {
+			name := fmt.Sprint(key)
+			settings, err := composeMap(path+".networks."+name, value, []string{"aliases"})
+			if err != nil {
+				return service, err
+			}
+			aliases, err := composeStrings(path+".networks."+name+".aliases", settings["aliases"])
+			if err != nil {
+				return service, err
+			}
+			service.Networks[name] = aliases
+		}
+	default:
+		list, err := composeStrings(path+".networks", networks)
+		if err != nil {
+			return service, err
+		}
+		for _, name := range list {
+			service.Networks[name] = nil
+		}
+	}
+	for name := range service.Networks {
+		if _, ok := file.Networks[name]; !ok && name != "default" {
+			return service, fmt.Errorf("%w: %s uses undefined network %s", ErrInvalidSpec, path, name)
+		}
+	}
+
+	switch dependsOn := fields["depends_on"].(type) {
+	case nil:
+	case map[interface{}]interface{}:
+		for key, value := range dependsOn {
+			name := fmt.Sprint(key)
+			settings, err := composeMap(path+".depends_on."+name, value, []string{"condition"})
+			if err != nil {
+				return service, err
+			}
+			if condition, ok := settings["condition"]; ok && condition != "service_started" {
+				return service, fmt.Errorf("%w: unsupported condition %v in %s.depends_on.%s", ErrInvalidSpec, condition, path, name)
+			}
+			service.DependsOn = append(service.DependsOn, name)
+		}
+		sort.Strings(service.DependsOn)
+	default:
+		if service.DependsOn, err = composeStrings(path+".depends_on", dependsOn); err != nil {
+			return service, err
+		}
+	}
+	return service, nil
+}
+
+// parseComposePort parses the short port syntax: [[host ip:][host port]:]container port[/protocol].
+func parseComposePort(port string) (PortMapping, error) {
+	mapping := PortMapping{}
+	spec := port
+	if i := strings.IndexByte(spec, '/'); i >= 0 {
+		mapping.Protocol = spec[i+1:]
+		spec = spec[:i]
+	}
+	if strings.Contains(spec, "-") {
+		return mapping, fmt.Errorf("port ranges like %q are not supported", port)
+	}
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		mapping.ContainerPort = parts[0]
+	case 2:
+		mapping.HostPort, mapping.ContainerPort = parts[0], parts[1]
+	case 3:
+		mapping.HostIP, mapping.HostPort, mapping.ContainerPort = parts[0], parts[1], parts[2]
+	default:
+		return mapping, fmt.Errorf("invalid port %q", port)
+	}
+	containerPort := mapping.ContainerPort
+	if mapping.Protocol != "" {
+		containerPort += "/" + mapping.Protocol
+	}
+	number, protocol, err := parseContainerPort(containerPort)
+	if err != nil {
+		return mapping, err
+	}
+	mapping.ContainerPort, mapping.Protocol = number, protocol
+	if mapping.HostPort != "" {
+		if value, err := strconv.Atoi(mapping.HostPort); err != nil || value < 1 || value > 65535 {
+			return mapping, fmt.Errorf("invalid host port in %q", port)
+		}
+	}
+	return mapping, nil
+}
+
+// parseComposeVolume parses the short volume syntax: source:target[:ro|rw]. Absolute
+// sources are bind mounts, the others must be volumes of the compose file.
+func parseComposeVolume(volume string, volumes []string) (Mount, error) {
+	mount := Mount{}
+	parts := strings.Split(volume, ":")
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			mount.ReadOnly = true
+		case "rw":
+		default:
+			return mount, fmt.Errorf("unsupported volume mode in %q", volume)
+		}
+		parts = parts[:2]
+	}
+	if len(parts) != 2 {
+		return mount, fmt.Errorf("volume %q needs a source and a target, anonymous volumes are not supported", volume)
+	}
+	mount.Source, mount.Target = parts[0], parts[1]
+	switch {
+	case strings.HasPrefix(mount.Source, "/"):
+		mount.Type = MountBind
+	case strings.HasPrefix(mount.Source, ".") || strings.HasPrefix(mount.Source, "~"):
+		return mount, fmt.Errorf("relative bind mount %q is not supported, the files are not on the server", volume)
+	default:
+		mount.Type = MountVolume
+		found := false
+		for _, name := range volumes {
+			found = found || name == mount.Source
+		}
+		if !found {
+			return mount, fmt.Errorf("volume %s is not defined in the top level volumes", mount.Source)
+		}
+	}
+	return mount, nil
+}
+
+// composeMap checks that value is a mapping with string keys among supported and
+// returns it. A nil supported list allows any key, a missing value is an empty mapping.
+func composeMap(path string, value interface{}, supported []string) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if value == nil {
+		return result, nil
+	}
+	raw, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s must be a mapping", ErrInvalidSpec, composePath(path))
+	}
+	for key, value := range raw {
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid key %v in %s", ErrInvalidSpec, key, composePath(path))
+		}
+		if supported != nil && !containsString(supported, name) {
+			return nil, fmt.Errorf("%w: unsupported key %s", ErrInvalidSpec, strings.TrimPrefix(path+"."+name, "."))
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// composeStrings converts a list of strings or numbers, a missing value is an empty list.
+func composeStrings(path string, value interface{}) ([]string, error) {
+	result := make([]string, 0)
+	if value == nil {
+		return result, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s must be a list", ErrInvalidSpec, path)
+	}
+	for _, item := range list {
+		switch item.(type) {
+		case string, int, float64:
+			result = append(result, fmt.Sprint(item))
+		default:
+			return nil, fmt.Errorf("%w: %s must be a list of strings, the long syntax is not supported", ErrInvalidSpec, path)
+		}
+	}
+	return result, nil
+}
+
+func composePath(path string) string {
+	if path == "" {
+		return "the compose file"
+	}
+	return path
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
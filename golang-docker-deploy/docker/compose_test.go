@@ -0,0 +1,109 @@
+package docker
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCompose(t *testing.T) {
+	data := `
+version: "3"
+services:
+  web:
+    image: web:1
+    command: serve --port 80
+    ports:
+      - "8080:80"
+      - "127.0.0.1:8443:443"
+      - "53/udp"
+    environment:
+      MODE: test
+    volumes:
+      - data:/data:ro
+      - /srv/static:/static
+    networks:
+      front:
+        aliases: [www]
+      back:
+    depends_on:
+      db:
+        condition: service_started
+    restart: always
+  db:
+    image: db:1
+    environment:
+      - USER=web
+    networks: [back]
+networks:
+  front:
+  back:
+    internal: true
+volumes:
+  data:
+`
+	file, err := ParseCompose([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := file.Services["web"]
+	if !reflect.DeepEqual(web.Command, []string{"serve", "--port", "80"}) {
+		t.Errorf("Command is %v", web.Command)
+	}
+	wantPorts := []PortMapping{
+		{HostPort: "8080", ContainerPort: "80", Protocol: "tcp"},
+		{HostIP: "127.0.0.1", HostPort: "8443", ContainerPort: "443", Protocol: "tcp"},
+		{ContainerPort: "53", Protocol: "udp"},
+	}
+	if !reflect.DeepEqual(web.Ports, wantPorts) {
+		t.Errorf("Ports are %v, want %v", web.Ports, wantPorts)
+	}
+	wantMounts := []Mount{
+		{Type: MountVolume, Source: "data", Target: "/data", ReadOnly: true},
+		{Type: MountBind, Source: "/srv/static", Target: "/static"},
+	}
+	if !reflect.DeepEqual(web.Mounts, wantMounts) {
+		t.Errorf("Mounts are %v, want %v", web.Mounts, wantMounts)
+	}
+	if !reflect.DeepEqual(web.Networks["front"], []string{"www"}) || web.Restart != "always" {
+		t.Errorf("Networks are %v, restart is %s", web.Networks, web.Restart)
+	}
+	if file.Services["db"].Environment["USER"] != "web" || !file.Networks["back"].Internal {
+		t.Errorf("Service db or network back is not parsed: %v, %v", file.Services["db"], file.Networks)
+	}
+	if order, _ := file.StartOrder(); !reflect.DeepEqual(order, []string{"db", "web"}) {
+		t.Errorf("Start order is %v, want db before web", order)
+	}
+}
+
+func TestParseComposeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"invalid yaml", "services: [", "invalid compose file"},
+		{"no services", "version: \"3\"\n", "no services"},
+		{"unsupported key", "services:\n  web:\n    image: web:1\n    privileged: true\n", "privileged"},
+		{"unsupported top level key", "services:\n  web:\n    image: web:1\nsecrets: {}\n", "secrets"},
+		{"missing image", "services:\n  web:\n    command: serve\n", "image is missing"},
+		{"invalid service name", "services:\n  \"web app\":\n    image: web:1\n", "invalid service name"},
+		{"port range", "services:\n  web:\n    image: web:1\n    ports: [\"8080-8081:80\"]\n", "port ranges"},
+		{"invalid host port", "services:\n  web:\n    image: web:1\n    ports: [\"70000:80\"]\n", "invalid host port"},
+		{"undefined volume", "services:\n  web:\n    image: web:1\n    volumes: [\"data:/data\"]\n", "data"},
+		{"undefined network", "services:\n  web:\n    image: web:1\n    networks: [back]\n", "undefined network back"},
+		{"environment without value", "services:\n  web:\n    image: web:1\n    environment: [MODE]\n", "has no value"},
+		{"unknown dependency", "services:\n  web:\n    image: web:1\n    depends_on: [db]\n", "unknown service db"},
+		{"dependency cycle", "services:\n  a:\n    image: a:1\n    depends_on: [b]\n  b:\n    image: b:1\n    depends_on: [a]\n", "dependency cycle"},
+		{"unsupported condition", "services:\n  web:\n    image: web:1\n    depends_on:\n      db:\n        condition: service_healthy\n  db:\n    image: db:1\n", "unsupported condition"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseCompose([]byte(test.data))
+			if !errors.Is(err, ErrInvalidSpec) || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("ParseCompose returned %v, want %v with %q", err, ErrInvalidSpec, test.err)
+			}
+		})
+	}
+}
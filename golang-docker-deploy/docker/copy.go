@@ -0,0 +1,262 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang-docker-deploy/utils"
+)
+
+// MaxCopySize limits the size of the tar archives copied into or out of a
+// container, 100MB by default.
+var MaxCopySize int64 = 100 << 20
+
+// ErrTooLarge is returned when a copy exceeds MaxCopySize.
+var ErrTooLarge = errors.New("Copy exceeds the size limit")
+
+// containerPath checks that p is an absolute container path without .. and cleans it.
+func containerPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("%w: container path %q is not absolute", ErrInvalidSpec, p)
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("%w: container path %q contains ..", ErrInvalidSpec, p)
+		}
+	}
+	return path.Clean(p), nil
+}
+
+// checkEntryName makes sure an archive entry stays inside the directory it is extracted to.
+func checkEntryName(name string) error {
+	clean := path.Clean(filepath.ToSlash(name))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("%w: archive entry %q leaves the target directory", ErrInvalidSpec, name)
+	}
+	return nil
+}
+
+// limitedReader fails with ErrTooLarge once more than limit bytes were read.
+type limitedReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, l.limit)
+	}
+	return n, err
+}
+
+// copyArchive copies the tar archive src to dst entry by entry, rejecting the
+// entries which would leave the target directory, special files and archives
+// larger than MaxCopySize.
+func copyArchive(dst io.Writer, src io.Reader) error {
+	invalid := func(err error) error {
+		if errors.Is(err, ErrTooLarge) {
+			return err
+		}
+		return fmt.Errorf("%w: invalid archive: %s", ErrInvalidSpec, err.Error())
+	}
+	reader := tar.NewReader(&limitedReader{r: src, limit: MaxCopySize})
+	writer := tar.NewWriter(dst)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return invalid(err)
+		}
+		if err := checkEntryName(header.Name); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink:
+		case tar.TypeLink:
+			if err := checkEntryName(header.Linkname); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: archive entry %q is not a file, a directory or a link", ErrInvalidSpec, header.Name)
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, reader); err != nil {
+			return invalid(err)
+		}
+	}
+	return writer.Close()
+}
+
+// CopyToContainer extracts the tar archive into the existing directory dstPath
+// of the managed container id. The whole archive is checked before anything is
+// extracted: its entries must stay inside dstPath and it must not exceed MaxCopySize.
+func (m *Manager) CopyToContainer(ctx context.Context, id string, dstPath string, archive io.Reader) error {
+	dstPath, err := containerPath(dstPath)
+	if err != nil {
+		return err
+	}
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	spool, err := ioutil.TempFile("", "copy-*.tar")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	if err := copyArchive(spool, archive); err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := m.rt.CopyTo(ctx, info.ID, dstPath, spool); err != nil {
+		return fmt.Errorf("Failed to copy into %s:%s: %w", info.ID, dstPath, err)
+	}
+	log.Printf("Archive is copied into %s:%s", info.ID, dstPath)
+	return nil
+}
+
+// CopyFileToContainer writes content to the file dstPath of the managed container
+// id, replacing it if it exists. The parent directory of dstPath must exist.
+func (m *Manager) CopyFileToContainer(ctx context.Context, id string, dstPath string, content io.Reader) error {
+	dstPath, err := containerPath(dstPath)
+	if err != nil {
+		return err
+	}
+	if dstPath == "/" {
+		return fmt.Errorf("%w: missing file name", ErrInvalidSpec)
+	}
+
+	// The content is spooled to learn its size, then archived like a local file.
+	spool, err := ioutil.TempFile("", "copy-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	if _, err := io.Copy(spool, &limitedReader{r: content, limit: MaxCopySize}); err != nil {
+		return err
+	}
+	if err := spool.Chmod(0644); err != nil {
+		return err
+	}
+	return m.copyLocal(ctx, id, spool.Name(), path.Base(dstPath), path.Dir(dstPath))
+}
+
+// CopyLocalToContainer copies the file or directory localPath of the server to
+// dstPath of the managed container id. A directory is copied with its content
+// into the existing directory dstPath, a file is written to the file dstPath.
+func (m *Manager) CopyLocalToContainer(ctx context.Context, id string, localPath string, dstPath string) error {
+	dstPath, err := containerPath(dstPath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSpec, err.Error())
+	}
+	if info.IsDir() {
+		return m.copyLocal(ctx, id, localPath, "", dstPath)
+	}
+	if dstPath == "/" {
+		return fmt.Errorf("%w: missing file name", ErrInvalidSpec)
+	}
+	return m.copyLocal(ctx, id, localPath, path.Base(dstPath), path.Dir(dstPath))
+}
+
+// copyLocal archives localPath while it is copied into the directory dstDir, a
+// file is archived under name.
+func (m *Manager) copyLocal(ctx context.Context, id string, localPath string, name string, dstDir string) error {
+	archive, writer := io.Pipe()
+	defer archive.Close()
+	go func() {
+		if name == "" {
+			writer.CloseWithError(utils.WriteTar(writer, localPath, utils.TarOptions{}))
+			return
+		}
+		writer.CloseWithError(utils.WriteTarFile(writer, localPath, name, utils.TarOptions{}))
+	}()
+	return m.CopyToContainer(ctx, id, dstDir, archive)
+}
+
+// CopyFromContainer returns srcPath of the managed container id as a tar archive,
+// the entries are named after the base name of srcPath. The archive is checked
+// while it is read, reading fails with ErrTooLarge past MaxCopySize.
+func (m *Manager) CopyFromContainer(ctx context.Context, id string, srcPath string) (io.ReadCloser, PathStat, error) {
+	srcPath, err := containerPath(srcPath)
+	if err != nil {
+		return nil, PathStat{}, err
+	}
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, PathStat{}, err
+	}
+	stream, stat, err := m.rt.CopyFrom(ctx, info.ID, srcPath)
+	if err != nil {
+		return nil, stat, fmt.Errorf("Failed to copy from %s:%s: %w", info.ID, srcPath, err)
+	}
+	if stat.Mode.IsRegular() && stat.Size > MaxCopySize {
+		stream.Close()
+		return nil, stat, fmt.Errorf("%w: %s is %d bytes", ErrTooLarge, srcPath, stat.Size)
+	}
+
+	archive, writer := io.Pipe()
+	go func() {
+		err := copyArchive(writer, stream)
+		stream.Close()
+		writer.CloseWithError(err)
+	}()
+	return archive, stat, nil
+}
+
+// fileReader is the content of the single file of an archive.
+type fileReader struct {
+	io.Reader
+	io.Closer
+}
+
+// CopyFileFromContainer returns the content of the file srcPath of the managed
+// container id. A symlink is followed once, directories must be copied as archive.
+func (m *Manager) CopyFileFromContainer(ctx context.Context, id string, srcPath string) (io.ReadCloser, PathStat, error) {
+	archive, stat, err := m.CopyFromContainer(ctx, id, srcPath)
+	if err == nil && stat.LinkTarget != "" && stat.Mode&os.ModeSymlink != 0 {
+		archive.Close()
+		archive, stat, err = m.CopyFromContainer(ctx, id, stat.LinkTarget)
+	}
+	if err != nil {
+		return nil, stat, err
+	}
+	if !stat.Mode.IsRegular() {
+		archive.Close()
+		return nil, stat, fmt.Errorf("%w: %s is not a regular file", ErrInvalidSpec, srcPath)
+	}
+	reader := tar.NewReader(archive)
+	if _, err := reader.Next(); err != nil {
+		archive.Close()
+		return nil, stat, fmt.Errorf("Failed to read %s: %s", srcPath, err.Error())
+	}
+	return fileReader{Reader: reader, Closer: archive}, stat, nil
+}
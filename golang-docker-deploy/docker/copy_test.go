@@ -0,0 +1,97 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCopyErrors(t *testing.T) {
+	defer func(size int64) { MaxCopySize = size }(MaxCopySize)
+	MaxCopySize = 16
+
+	ctx := context.Background()
+	m, _ := newTestManager(t, "47140-47149")
+	info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := func(name string, content string) *bytes.Buffer {
+		buffer := &bytes.Buffer{}
+		writer := tar.NewWriter(buffer)
+		writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		writer.Write([]byte(content))
+		writer.Close()
+		return buffer
+	}
+
+	tests := []struct {
+		name string
+		copy func() error
+		err  error
+	}{
+		{"relative path", func() error {
+			return m.CopyFileToContainer(ctx, info.ID, "tmp/file", strings.NewReader("data"))
+		}, ErrInvalidSpec},
+		{"path with ..", func() error {
+			return m.CopyFileToContainer(ctx, info.ID, "/tmp/../etc/passwd", strings.NewReader("data"))
+		}, ErrInvalidSpec},
+		{"no file name", func() error {
+			return m.CopyFileToContainer(ctx, info.ID, "/", strings.NewReader("data"))
+		}, ErrInvalidSpec},
+		{"too large", func() error {
+			return m.CopyFileToContainer(ctx, info.ID, "/tmp/file", strings.NewReader(strings.Repeat("x", 17)))
+		}, ErrTooLarge},
+		{"entry leaving the directory", func() error {
+			return m.CopyToContainer(ctx, info.ID, "/tmp", archive("../etc/passwd", "root"))
+		}, ErrInvalidSpec},
+		{"absolute entry", func() error {
+			return m.CopyToContainer(ctx, info.ID, "/tmp", archive("/etc/passwd", "root"))
+		}, ErrInvalidSpec},
+		{"not an archive", func() error {
+			return m.CopyToContainer(ctx, info.ID, "/tmp", bytes.NewBufferString("plain text"))
+		}, ErrInvalidSpec},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.copy(); !errors.Is(err, test.err) {
+				t.Fatalf("Copy returned %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, "47130-47139")
+	info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CopyFileToContainer(ctx, info.ID, "/tmp/config.json", strings.NewReader(`{"debug":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	content, stat, err := m.CopyFileFromContainer(ctx, info.ID, "/tmp/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"debug":true}` || stat.Size != int64(len(data)) {
+		t.Errorf("Copied back %q of %d bytes", data, stat.Size)
+	}
+
+	if _, _, err := m.CopyFileFromContainer(ctx, info.ID, "/tmp"); !errors.Is(err, ErrInvalidSpec) {
+		t.Errorf("Copy of a directory as file returned %v, want %v", err, ErrInvalidSpec)
+	}
+	if _, _, err := m.CopyFileFromContainer(WithTenant(ctx, "other"), info.ID, "/tmp/config.json"); !errors.Is(err, ErrNotManaged) {
+		t.Errorf("Copy by another tenant returned %v, want %v", err, ErrNotManaged)
+	}
+}
@@ -0,0 +1,329 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ErrDeploymentNotFound is returned when the requested deployment does not exist.
+var ErrDeploymentNotFound = errors.New("No such deployment")
+
+var deploymentNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Deployment is the desired state of a group of identical worker containers.
+type Deployment struct {
+	Name          string `json:"name" yaml:"name"`
+	Replicas      int    `json:"replicas" yaml:"replicas"`
+	ContainerSpec `yaml:",inline"`
+	Network       DeploymentNetwork `json:"network" yaml:"network,omitempty"`
+	// Tenant owns the deployment, it is set by Apply from the request context.
+	Tenant string `json:"tenant,omitempty" yaml:"-"`
+}
+
+// DeploymentStatus is a deployment together with its current containers.
+type DeploymentStatus struct {
+	Deployment
+	Containers []ContainerInfo `json:"containers"`
+}
+
+// ReconcileResult lists what a reconciliation changed.
+type ReconcileResult struct {
+	Created  []string `json:"created"`
+	Removed  []string `json:"removed"`
+	Replaced []string `json:"replaced"`
+}
+
+// ParseDeployment parses a YAML or JSON deployment spec and validates it.
+func ParseDeployment(data []byte) (Deployment, error) {
+	deployment := Deployment{}
+	// JSON is valid YAML, so a single decoder covers both formats.
+	if err := yaml.UnmarshalStrict(data, &deployment); err != nil {
+		return deployment, fmt.Errorf("Invalid deployment spec: %s", err.Error())
+	}
+	if err := deployment.Validate(); err != nil {
+		return deployment, err
+	}
+	return deployment, nil
+}
+
+// Validate checks the deployment spec.
+func (d Deployment) Validate() error {
+	if !deploymentNamePattern.MatchString(d.Name) {
+		return fmt.Errorf("Invalid deployment name %q", d.Name)
+	}
+	if d.Replicas < 0 {
+		return fmt.Errorf("Deployment %s has negative replica count", d.Name)
+	}
+	if err := d.ContainerSpec.Validate(); err != nil {
+		return fmt.Errorf("Deployment %s: %s", d.Name, err.Error())
+	}
+	if d.TTL != "" || d.IdleTimeout != "" {
+		// The reconciler would bring the expired replicas right back.
+		return fmt.Errorf("Deployment %s: replicas can not have a ttl or an idle timeout", d.Name)
+	}
+	if err := d.Network.validate(d.ContainerSpec); err != nil {
+		return fmt.Errorf("Deployment %s: %s", d.Name, err.Error())
+	}
+	return nil
+}
+
+// specHash identifies the replica configuration. Containers with a different
+// hash are out of date and get replaced.
+func (d Deployment) specHash() string {
+	data, _ := json.Marshal(d.containerConfig())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Apply stores the deployment spec and reconciles its containers.
+// Applying the same spec again changes nothing. The deployment belongs to the
+// tenant of ctx, the name can not be taken over by another tenant.
+func (m *Manager) Apply(ctx context.Context, deployment Deployment) (ReconcileResult, error) {
+	if err := deployment.Validate(); err != nil {
+		return ReconcileResult{}, err
+	}
+	if err := checkBindMounts(ctx, deployment.Mounts); err != nil {
+		return ReconcileResult{}, err
+	}
+	m.mutex.Lock()
+	if existing, ok := m.deployments[deployment.Name]; ok {
+		if !visible(ctx, existing.Tenant) {
+			m.mutex.Unlock()
+			return ReconcileResult{}, fmt.Errorf("%w: %s", ErrNameTaken, deployment.Name)
+		}
+		if TenantFrom(ctx) == "" {
+			// Keep the owner when the spec is updated without tenant.
+			deployment.Tenant = existing.Tenant
+		}
+	}
+	if tenant := TenantFrom(ctx); tenant != "" {
+		deployment.Tenant = tenant
+	}
+	m.deployments[deployment.Name] = deployment
+	m.mutex.Unlock()
+	m.persist()
+	return m.Reconcile(ctx, deployment.Name)
+}
+
+// Deployments returns the deployment specs of the tenant of ctx sorted by name.
+func (m *Manager) Deployments(ctx context.Context) []Deployment {
+	list := make([]Deployment, 0)
+	for _, deployment := range m.allDeployments() {
+		if visible(ctx, deployment.Tenant) {
+			list = append(list, deployment)
+		}
+	}
+	return list
+}
+
+// allDeployments returns every stored deployment spec sorted by name.
+func (m *Manager) allDeployments() []Deployment {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	list := make([]Deployment, 0, len(m.deployments))
+	for _, deployment := range m.deployments {
+		list = append(list, deployment)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Deployment returns the spec of the named deployment of the tenant of ctx.
+func (m *Manager) Deployment(ctx context.Context, name string) (Deployment, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	deployment, ok := m.deployments[name]
+	if !ok || !visible(ctx, deployment.Tenant) {
+		return deployment, fmt.Errorf("%w: %s", ErrDeploymentNotFound, name)
+	}
+	return deployment, nil
+}
+
+// DeploymentStatus returns the spec and the containers of the named deployment.
+func (m *Manager) DeploymentStatus(ctx context.Context, name string) (*DeploymentStatus, error) {
+	deployment, err := m.Deployment(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := m.deploymentContainers(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &DeploymentStatus{Deployment: deployment, Containers: containers}, nil
+}
+
+// deploymentContainers returns the containers of the named deployment, oldest first.
+func (m *Manager) deploymentContainers(ctx context.Context, name string) ([]ContainerInfo, error) {
+	list, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]ContainerInfo, 0)
+	for _, info := range list {
+		if info.Deployment == name {
+			containers = append(containers, info)
+		}
+	}
+	return containers, nil
+}
+
+// Reconcile brings the containers of the named deployment in line with its spec:
+// out of date containers are replaced, missing replicas are created and extra
+// ones are removed.
+func (m *Manager) Reconcile(ctx context.Context, name string) (ReconcileResult, error) {
+	m.reconcileMutex.Lock()
+	defer m.reconcileMutex.Unlock()
+	result := ReconcileResult{
+		Created:  make([]string, 0),
+		Removed:  make([]string, 0),
+		Replaced: make([]string, 0),
+	}
+
+	deployment, err := m.Deployment(ctx, name)
+	if err != nil {
+		return result, err
+	}
+	containers, err := m.deploymentContainers(ctx, name)
+	if err != nil {
+		return result, err
+	}
+
+	hash := deployment.specHash()
+	current := make([]ContainerInfo, 0, len(containers))
+	outdated := make([]ContainerInfo, 0)
+	for _, info := range containers {
+		if managed, _ := m.managed(info.ID); managed.specHash == hash {
+			current = append(current, info)
+		} else {
+			outdated = append(outdated, info)
+		}
+	}
+
+	// Extra replicas go first, newest first.
+	for len(current) > deployment.Replicas {
+		extra := current[len(current)-1]
+		current = current[:len(current)-1]
+		if _, err := m.Remove(ctx, extra.ID); err != nil {
+			return result, err
+		}
+		result.Removed = append(result.Removed, extra.ID)
+	}
+
+	if len(current) < deployment.Replicas {
+		if err := m.ensureImage(ctx, deployment.Image, deployment.PullPolicy); err != nil {
+			return result, err
+		}
+		if err := m.ensureNetwork(ctx, deployment); err != nil {
+			return result, err
+		}
+	}
+	config := deployment.containerConfig()
+	for len(current) < deployment.Replicas {
+		replacing := ""
+		if len(outdated) > 0 {
+			replacing = outdated[0].ID
+		}
+		info, err := m.startContainer(ctx, &managedContainer{
+			config:     config,
+			deployment: name,
+			specHash:   hash,
+			tenant:     deployment.Tenant,
+		}, replacing)
+		if err != nil {
+			return result, err
+		}
+		current = append(current, *info)
+		if len(outdated) > 0 {
+			old := outdated[0]
+			outdated = outdated[1:]
+			if _, err := m.Remove(ctx, old.ID); err != nil {
+				return result, err
+			}
+			result.Replaced = append(result.Replaced, old.ID)
+		}
+		result.Created = append(result.Created, info.ID)
+	}
+
+	for _, old := range outdated {
+		if _, err := m.Remove(ctx, old.ID); err != nil {
+			return result, err
+		}
+		result.Removed = append(result.Removed, old.ID)
+	}
+
+	if len(result.Replaced)+len(result.Removed) > 0 {
+		// The replaced containers may have left a network behind.
+		if err := m.removeNetworks(ctx, name, deployment.networkName()); err != nil {
+			log.Printf("Deployment %s: %s", name, err.Error())
+		}
+	}
+	if len(result.Created)+len(result.Removed)+len(result.Replaced) > 0 {
+		log.Printf("Deployment %s reconciled: %d created, %d replaced, %d removed",
+			name, len(result.Created), len(result.Replaced), len(result.Removed))
+	}
+	return result, nil
+}
+
+// ReconcileAll reconciles every stored deployment.
+func (m *Manager) ReconcileAll(ctx context.Context) {
+	for _, deployment := range m.Deployments(ctx) {
+		if _, err := m.Reconcile(ctx, deployment.Name); err != nil {
+			log.Printf("Failed to reconcile deployment %s: %s", deployment.Name, err.Error())
+		}
+	}
+}
+
+// RunReconciler reconciles the deployments every interval until ctx is cancelled,
+// so containers removed or lost behind the Manager's back are brought back.
+func (m *Manager) RunReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.ReconcileAll(ctx)
+		}
+	}
+}
+
+// DeleteDeployment removes the named deployment, all of its containers and its network.
+func (m *Manager) DeleteDeployment(ctx context.Context, name string) ([]string, error) {
+	m.reconcileMutex.Lock()
+	defer m.reconcileMutex.Unlock()
+	if _, err := m.Deployment(ctx, name); err != nil {
+		return nil, err
+	}
+	containers, err := m.deploymentContainers(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]string, 0, len(containers))
+	for _, info := range containers {
+		if _, err := m.Remove(ctx, info.ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, info.ID)
+	}
+	if err := m.removeNetworks(ctx, name, ""); err != nil {
+		return removed, err
+	}
+	m.mutex.Lock()
+	delete(m.deployments, name)
+	m.mutex.Unlock()
+	m.persist()
+	return removed, nil
+}
@@ -2,48 +2,209 @@ package docker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBindAttempts is how many host ports are tried when the allocated one
+// turns out to be used by something outside of the deploy service.
+const maxBindAttempts = 5
+
+// portQuarantine is how long a host port found in use outside of the deploy
+// service is not handed out again.
+var portQuarantine = 5 * time.Minute
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/docker/go-connections/nat"
+// Labels put on every container created by the Manager, they allow to
+// recognize and adopt the containers after a restart of the deploy service.
+const (
+	LabelManaged    = "golang-docker-deploy.managed"
+	LabelDeployment = "golang-docker-deploy.deployment"
+	LabelSpecHash   = "golang-docker-deploy.spec-hash"
+	LabelConfig     = "golang-docker-deploy.config"
+	LabelTenant     = "golang-docker-deploy.tenant"
+	LabelStack      = "golang-docker-deploy.stack"
+	LabelWorker     = "golang-docker-deploy.worker"
 )
 
-// CreateNewContainer creates and starts a docker container using an existing image
-// defined by imageName
-func CreateNewContainer(imageName string, address string, port string) (string, error) {
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		err = fmt.Errorf("Unable to create docker client: %s", err.Error())
-		return "", err
+// labeledConfig returns a copy of the container configuration extended with
+// the deployment metadata labels.
+func (managed *managedContainer) labeledConfig() ContainerConfig {
+	config := managed.config
+	config.Ports = append([]PortMapping(nil), managed.config.Ports...)
+	config.Labels = make(map[string]string, len(managed.config.Labels)+6)
+	for key, value := range managed.config.Labels {
+		config.Labels[key] = value
+	}
+	config.Labels[LabelManaged] = "true"
+	config.Labels[LabelDeployment] = managed.deployment
+	config.Labels[LabelSpecHash] = managed.specHash
+	config.Labels[LabelTenant] = managed.tenant
+	if managed.stack != "" {
+		config.Labels[LabelStack] = managed.stack
+	}
+	if data, err := json.Marshal(managed.config); err == nil {
+		config.Labels[LabelConfig] = string(data)
+	}
+	return config
+}
+
+// managedFromLabels rebuilds the bookkeeping of a container from its labels.
+func managedFromLabels(info ContainerInfo) *managedContainer {
+	managed := &managedContainer{
+		deployment: info.Labels[LabelDeployment],
+		stack:      info.Labels[LabelStack],
+		specHash:   info.Labels[LabelSpecHash],
+		tenant:     info.Labels[LabelTenant],
+	}
+	if err := json.Unmarshal([]byte(info.Labels[LabelConfig]), &managed.config); err == nil {
+		return managed
 	}
 
-	hostBinding := nat.PortBinding{
-		HostIP:   address,
-		HostPort: port,
+	// Best effort for containers without a readable configuration label.
+	managed.config = ContainerConfig{
+		Image:  info.Image,
+		Labels: make(map[string]string),
+		Ports:  make([]PortMapping, 0, len(info.Ports)),
+	}
+	for key, value := range info.Labels {
+		if !strings.HasPrefix(key, "golang-docker-deploy.") {
+			managed.config.Labels[key] = value
+		}
+	}
+	for _, port := range info.Ports {
+		port.HostPort = ""
+		managed.config.Ports = append(managed.config.Ports, port)
+	}
+	return managed
+}
+
+func isPortConflict(err error) bool {
+	return strings.Contains(err.Error(), "port is already allocated") ||
+		strings.Contains(err.Error(), "address already in use")
+}
+
+// CreateNewContainer validates spec, then creates and starts a docker container from it.
+// The container ports are published on host ports handed out by the port allocator.
+// The container is tracked by the Manager afterwards and it belongs to the tenant of ctx.
+func (m *Manager) CreateNewContainer(ctx context.Context, spec ContainerSpec) (*ContainerInfo, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSpec, err.Error())
+	}
+	if err := checkBindMounts(ctx, spec.Mounts); err != nil {
+		return nil, err
 	}
-	containerPort, err := nat.NewPort("tcp", port)
+	if err := m.ensureImage(ctx, spec.Image, spec.PullPolicy); err != nil {
+		return nil, err
+	}
+	config := spec.containerConfig()
+	config.Mounts = scopeVolumes(TenantFrom(ctx), config.Mounts)
+	return m.startContainer(ctx, &managedContainer{
+		config: config,
+		tenant: TenantFrom(ctx),
+		lease:  newLease(spec),
+	}, "")
+}
+
+// allocatePorts fills in the missing host ports of config.
+func (m *Manager) allocatePorts(config *ContainerConfig) ([]int, error) {
+	allocated := make([]int, 0, len(config.Ports))
+	for i := range config.Ports {
+		if config.Ports[i].HostPort != "" {
+			continue
+		}
+		hostPort, err := m.ports.Allocate()
+		if err != nil {
+			for _, port := range allocated {
+				m.ports.Release(port)
+			}
+			return nil, err
+		}
+		allocated = append(allocated, hostPort)
+		config.Ports[i].HostPort = strconv.Itoa(hostPort)
+	}
+	return allocated, nil
+}
+
+// startContainer creates and starts a container from managed.config, publishing the
+// ports without a host port on allocated host ports. The tenant quota and the owner
+// of the image are checked first, replacing is the container to be replaced by the
+// new one, if any.
+func (m *Manager) startContainer(ctx context.Context, managed *managedContainer, replacing string) (*ContainerInfo, error) {
+	m.createMutex.Lock()
+	defer m.createMutex.Unlock()
+	if err := m.checkQuota(managed.tenant, managed.config, replacing); err != nil {
+		return nil, err
+	}
+	if err := m.checkImageTenant(ctx, managed.tenant, managed.config.Image); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < maxBindAttempts; attempt++ {
+		config := managed.labeledConfig()
+		allocated, err := m.allocatePorts(&config)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := m.rt.Create(ctx, config)
+		if err != nil {
+			for _, port := range allocated {
+				m.ports.Release(port)
+			}
+			err = fmt.Errorf("Failed to create docker container: %s", err.Error())
+			return nil, err
+		}
+		for _, port := range allocated {
+			m.ports.Assign(port, id)
+		}
+		m.track(id, managed)
+
+		err = m.rt.Start(ctx, id)
+		if err != nil && isPortConflict(err) && len(allocated) > 0 {
+			// Somebody else holds one of the ports, set them aside for a while and try the next ones.
+			log.Printf("Host ports %v are in use outside of the deploy service", allocated)
+			if err := m.rt.Remove(ctx, id); err != nil {
+				log.Printf("Failed to remove container %s: %s", id, err.Error())
+			}
+			m.untrack(id)
+			for _, port := range allocated {
+				m.ports.Quarantine(port, portQuarantine)
+			}
+			continue
+		}
+		if err != nil {
+			// A created container would hold on to its ports and count against the quota.
+			if removeErr := m.rt.Remove(ctx, id); removeErr != nil {
+				log.Printf("Failed to remove container %s: %s", id, removeErr.Error())
+			}
+			m.untrack(id)
+			err = fmt.Errorf("Failed to start docker container: %s", err.Error())
+			return nil, err
+		}
+		log.Printf("Container %s is started on host ports %v", id, allocated)
+		return m.Inspect(ctx, id)
+	}
+	return nil, fmt.Errorf("Failed to start docker container: no usable host port after %d attempts", maxBindAttempts)
+}
+
+// Replace creates a new container from the configuration of the managed container id
+// and removes the old one. The replacement belongs to the same deployment.
+func (m *Manager) Replace(ctx context.Context, id string) (*ContainerInfo, error) {
+	info, err := m.resolve(ctx, id)
 	if err != nil {
-		err = fmt.Errorf("Failed to get port: %s", err.Error())
-		return "", err
-	}
-
-	portBinding := nat.PortMap{containerPort: []nat.PortBinding{hostBinding}}
-	cont, err := cli.ContainerCreate(
-		context.Background(),
-		&container.Config{
-			Image: imageName,
-		},
-		&container.HostConfig{
-			PortBindings: portBinding,
-		}, nil, "")
+		return nil, err
+	}
+	managed, _ := m.managed(info.ID)
+	replacement, err := m.startContainer(ctx, &managed, info.ID)
 	if err != nil {
-		err = fmt.Errorf("Failed to create docker container: %s", err.Error())
-		return "", err
+		return nil, err
 	}
-
-	cli.ContainerStart(context.Background(), cont.ID, types.ContainerStartOptions{})
-	fmt.Printf("Container %s is started", cont.ID)
-	return cont.ID, nil
+	if _, err := m.Remove(ctx, info.ID); err != nil {
+		log.Printf("Failed to remove replaced container %s: %s", info.ID, err.Error())
+	}
+	return replacement, nil
 }
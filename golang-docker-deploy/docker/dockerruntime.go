@@ -0,0 +1,590 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+type dockerRuntime struct {
+	cli *client.Client
+}
+
+// NewDockerRuntime creates a Runtime using the docker environment settings
+// (DOCKER_HOST, DOCKER_API_VERSION, ...).
+func NewDockerRuntime() (Runtime, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		err = fmt.Errorf("Unable to create docker client: %s", err.Error())
+		return nil, err
+	}
+	return &dockerRuntime{cli: cli}, nil
+}
+
+func wrapNotFound(err error, id string) error {
+	if client.IsErrContainerNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return err
+}
+
+func (d *dockerRuntime) Create(ctx context.Context, config ContainerConfig) (string, error) {
+	portBinding := nat.PortMap{}
+	exposedPorts := nat.PortSet{}
+	for _, mapping := range config.Ports {
+		protocol := mapping.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		containerPort, err := nat.NewPort(protocol, mapping.ContainerPort)
+		if err != nil {
+			err = fmt.Errorf("Failed to get port: %s", err.Error())
+			return "", err
+		}
+		exposedPorts[containerPort] = struct{}{}
+		portBinding[containerPort] = append(portBinding[containerPort], nat.PortBinding{
+			HostIP:   mapping.HostIP,
+			HostPort: mapping.HostPort,
+		})
+	}
+
+	mounts := make([]mount.Mount, 0, len(config.Mounts))
+	for _, m := range config.Mounts {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.Type(m.Type),
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+
+	var networking *network.NetworkingConfig
+	if config.Network != "" {
+		networking = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				config.Network: {Aliases: config.NetworkAliases},
+			},
+		}
+	}
+
+	cont, err := d.cli.ContainerCreate(
+		ctx,
+		&container.Config{
+			Image:        config.Image,
+			Cmd:          config.Cmd,
+			Env:          config.Env,
+			Labels:       config.Labels,
+			ExposedPorts: exposedPorts,
+		},
+		&container.HostConfig{
+			PortBindings: portBinding,
+			Mounts:       mounts,
+			NetworkMode:  container.NetworkMode(config.Network),
+			RestartPolicy: container.RestartPolicy{
+				Name:              config.RestartPolicy,
+				MaximumRetryCount: config.RestartRetries,
+			},
+			Resources: container.Resources{
+				NanoCPUs: config.NanoCPUs,
+				Memory:   config.Memory,
+			},
+		}, networking, config.Name)
+	if err != nil {
+		return "", err
+	}
+	// Only a single network can be given on create, the others are connected before the start.
+	for name, aliases := range config.ExtraNetworks {
+		if err := d.cli.NetworkConnect(ctx, name, cont.ID, &network.EndpointSettings{Aliases: aliases}); err != nil {
+			_ = d.cli.ContainerRemove(ctx, cont.ID, types.ContainerRemoveOptions{Force: true})
+			return "", fmt.Errorf("Failed to connect to network %s: %s", name, err.Error())
+		}
+	}
+	return cont.ID, nil
+}
+
+func (d *dockerRuntime) Start(ctx context.Context, id string) error {
+	err := d.cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+	return wrapNotFound(err, id)
+}
+
+func (d *dockerRuntime) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	err := d.cli.ContainerStop(ctx, id, &timeout)
+	return wrapNotFound(err, id)
+}
+
+func (d *dockerRuntime) Remove(ctx context.Context, id string) error {
+	err := d.cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+	return wrapNotFound(err, id)
+}
+
+func (d *dockerRuntime) Inspect(ctx context.Context, id string) (ContainerInfo, error) {
+	cont, err := d.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return ContainerInfo{}, wrapNotFound(err, id)
+	}
+	return newContainerInfo(cont), nil
+}
+
+func (d *dockerRuntime) List(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	args := filters.NewArgs()
+	for key, value := range labels {
+		args.Add("label", key+"="+value)
+	}
+	containers, err := d.cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ContainerInfo, 0, len(containers))
+	for _, cont := range containers {
+		info, err := d.Inspect(ctx, cont.ID)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+func (d *dockerRuntime) Logs(ctx context.Context, id string, options LogOptions) (io.ReadCloser, error) {
+	logs, err := d.cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     options.Follow,
+		Since:      options.Since,
+		Tail:       options.Tail,
+		Timestamps: options.Timestamps,
+	})
+	if err != nil {
+		return nil, wrapNotFound(err, id)
+	}
+	return logs, nil
+}
+
+func (d *dockerRuntime) Build(ctx context.Context, buildContext io.Reader, options BuildOptions) (io.ReadCloser, error) {
+	buildArgs := make(map[string]*string, len(options.BuildArgs))
+	for key := range options.BuildArgs {
+		value := options.BuildArgs[key]
+		buildArgs[key] = &value
+	}
+	resp, err := d.cli.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:       options.Tags,
+		BuildArgs:  buildArgs,
+		Dockerfile: options.Dockerfile,
+		NoCache:    options.NoCache,
+		Remove:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (d *dockerRuntime) Events(ctx context.Context, since time.Time, labels map[string]string) (<-chan RuntimeEvent, <-chan error) {
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	for key, value := range labels {
+		args.Add("label", key+"="+value)
+	}
+	options := types.EventsOptions{Filters: args}
+	if !since.IsZero() {
+		options.Since = fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())
+	}
+	messages, errs := d.cli.Events(ctx, options)
+
+	// The docker client never closes the message channel, the end of the
+	// stream is only signalled on the error channel.
+	out := make(chan RuntimeEvent)
+	outErrs := make(chan error, 1)
+	go func() {
+		defer close(outErrs)
+		for {
+			select {
+			case err := <-errs:
+				outErrs <- err
+				return
+			case msg := <-messages:
+				event := RuntimeEvent{
+					Action:      msg.Action,
+					ContainerID: msg.Actor.ID,
+					Attributes:  msg.Actor.Attributes,
+					Time:        time.Unix(0, msg.TimeNano).UTC(),
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					outErrs <- ctx.Err()
+					return
+				}
+			}
+		}
+	}()
+	return out, outErrs
+}
+
+func (d *dockerRuntime) ImageExists(ctx context.Context, image string) (bool, error) {
+	_, _, err := d.cli.ImageInspectWithRaw(ctx, image)
+	if client.IsErrImageNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *dockerRuntime) Pull(ctx context.Context, image string, credentials *RegistryCredentials) (io.ReadCloser, error) {
+	options := types.ImagePullOptions{}
+	if credentials != nil {
+		auth, err := json.Marshal(types.AuthConfig{
+			Username:      credentials.Username,
+			Password:      credentials.Password,
+			IdentityToken: credentials.IdentityToken,
+			ServerAddress: credentials.ServerAddress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		options.RegistryAuth = base64.URLEncoding.EncodeToString(auth)
+	}
+	return d.cli.ImagePull(ctx, image, options)
+}
+
+// dockerExecConn is the hijacked connection of a docker exec process.
+type dockerExecConn struct {
+	resp types.HijackedResponse
+}
+
+func (c *dockerExecConn) Read(p []byte) (int, error) {
+	return c.resp.Reader.Read(p)
+}
+
+func (c *dockerExecConn) Write(p []byte) (int, error) {
+	return c.resp.Conn.Write(p)
+}
+
+func (c *dockerExecConn) CloseWrite() error {
+	return c.resp.CloseWrite()
+}
+
+func (c *dockerExecConn) Close() error {
+	c.resp.Close()
+	return nil
+}
+
+func (d *dockerRuntime) ExecStart(ctx context.Context, id string, config ExecConfig) (string, ExecConn, error) {
+	cmd := config.Cmd
+	if config.WorkingDir != "" {
+		// The exec API of this client version has no working directory,
+		// so the command is started through the shell of the container.
+		cmd = append([]string{"sh", "-c", `cd "$0" && exec "$@"`, config.WorkingDir}, cmd...)
+	}
+	execConfig := types.ExecConfig{
+		Cmd:          cmd,
+		Env:          config.Env,
+		Tty:          config.Tty,
+		AttachStdin:  config.Stdin,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	created, err := d.cli.ContainerExecCreate(ctx, id, execConfig)
+	if err != nil {
+		return "", nil, wrapNotFound(err, id)
+	}
+	resp, err := d.cli.ContainerExecAttach(ctx, created.ID, execConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	return created.ID, &dockerExecConn{resp: resp}, nil
+}
+
+func (d *dockerRuntime) ExecInspect(ctx context.Context, execID string) (bool, int, error) {
+	inspect, err := d.cli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return false, 0, err
+	}
+	return inspect.Running, inspect.ExitCode, nil
+}
+
+func (d *dockerRuntime) CreateNetwork(ctx context.Context, config NetworkConfig) (string, error) {
+	created, err := d.cli.NetworkCreate(ctx, config.Name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		Internal:       config.Internal,
+		Labels:         config.Labels,
+	})
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (d *dockerRuntime) ListNetworks(ctx context.Context, labels map[string]string) ([]NetworkInfo, error) {
+	args := filters.NewArgs()
+	for key, value := range labels {
+		args.Add("label", key+"="+value)
+	}
+	networks, err := d.cli.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]NetworkInfo, 0, len(networks))
+	for _, n := range networks {
+		list = append(list, NetworkInfo{ID: n.ID, Name: n.Name, Internal: n.Internal, Labels: n.Labels})
+	}
+	return list, nil
+}
+
+func (d *dockerRuntime) RemoveNetwork(ctx context.Context, id string) error {
+	err := d.cli.NetworkRemove(ctx, id)
+	if client.IsErrNetworkNotFound(err) || client.IsErrNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrNetworkNotFound, id)
+	}
+	return err
+}
+
+func (d *dockerRuntime) RemoveVolume(ctx context.Context, name string) error {
+	err := d.cli.VolumeRemove(ctx, name, false)
+	if client.IsErrVolumeNotFound(err) || client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// dockerStats is the part of the docker stats response used by Stats. online_cpus
+// is missing from the types of the client version in use.
+type dockerStats struct {
+	Read        time.Time                     `json:"read"`
+	CPUStats    dockerCPUStats                `json:"cpu_stats"`
+	PreCPUStats dockerCPUStats                `json:"precpu_stats"`
+	MemoryStats types.MemoryStats             `json:"memory_stats"`
+	BlkioStats  types.BlkioStats              `json:"blkio_stats"`
+	Networks    map[string]types.NetworkStats `json:"networks"`
+}
+
+type dockerCPUStats struct {
+	types.CPUStats
+	OnlineCPUs uint32 `json:"online_cpus"`
+}
+
+func (d *dockerRuntime) Stats(ctx context.Context, id string) (ContainerStats, error) {
+	// Without streaming docker waits for a second sample, so the CPU usage can be computed.
+	resp, err := d.cli.ContainerStats(ctx, id, false)
+	if err != nil {
+		return ContainerStats{}, wrapNotFound(err, id)
+	}
+	defer resp.Body.Close()
+	raw := dockerStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return ContainerStats{}, err
+	}
+	return newContainerStats(raw), nil
+}
+
+// newContainerStats computes the usage from the raw counters the way docker stats does.
+func newContainerStats(raw dockerStats) ContainerStats {
+	stats := ContainerStats{Read: raw.Read}
+
+	cpus := float64(raw.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(raw.CPUStats.CPUUsage.PercpuUsage))
+	}
+	cpuDelta := float64(raw.CPUStats.CPUUsage.TotalUsage) - float64(raw.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(raw.CPUStats.SystemUsage) - float64(raw.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	// The page cache is reclaimable, it is not counted as used, cgroup v1 and v2 name it differently.
+	stats.MemoryUsage = raw.MemoryStats.Usage
+	cache, ok := raw.MemoryStats.Stats["total_inactive_file"]
+	if !ok {
+		cache = raw.MemoryStats.Stats["inactive_file"]
+	}
+	if cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	}
+	stats.MemoryLimit = raw.MemoryStats.Limit
+	if stats.MemoryLimit > 0 {
+		stats.MemoryPercent = float64(stats.MemoryUsage) / float64(stats.MemoryLimit) * 100
+	}
+
+	for _, network := range raw.Networks {
+		stats.NetworkRx += network.RxBytes
+		stats.NetworkTx += network.TxBytes
+	}
+	for _, entry := range raw.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			stats.BlockRead += entry.Value
+		case "write":
+			stats.BlockWrite += entry.Value
+		}
+	}
+	return stats
+}
+
+func newContainerInfo(cont types.ContainerJSON) ContainerInfo {
+	info := ContainerInfo{
+		ID:    cont.ID,
+		Name:  strings.TrimPrefix(cont.Name, "/"),
+		Ports: make([]PortMapping, 0),
+	}
+	if cont.Config != nil {
+		info.Image = cont.Config.Image
+		info.Labels = cont.Config.Labels
+	}
+	if cont.State != nil {
+		info.State = cont.State.Status
+	}
+	if created, err := time.Parse(time.RFC3339Nano, cont.Created); err == nil {
+		info.Created = created
+	}
+	if cont.NetworkSettings != nil {
+		for port, bindings := range cont.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				info.Ports = append(info.Ports, PortMapping{
+					ContainerPort: port.Port(),
+					Protocol:      port.Proto(),
+					HostIP:        binding.HostIP,
+					HostPort:      binding.HostPort,
+				})
+			}
+		}
+		sort.Slice(info.Ports, func(i, j int) bool {
+			return info.Ports[i].ContainerPort < info.Ports[j].ContainerPort
+		})
+		for name := range cont.NetworkSettings.Networks {
+			info.Networks = append(info.Networks, name)
+		}
+		sort.Strings(info.Networks)
+	}
+	return info
+}
+
+// wrapPathNotFound maps the daemon answer for a missing path. This client version
+// reports it as a plain error, unlike a missing container.
+func wrapPathNotFound(err error, id string, p string) error {
+	if err != nil && strings.Contains(err.Error(), "No such container:path") {
+		return fmt.Errorf("%w: %s", ErrPathNotFound, p)
+	}
+	return wrapNotFound(err, id)
+}
+
+func (d *dockerRuntime) CopyTo(ctx context.Context, id string, dstPath string, content io.Reader) error {
+	err := d.cli.CopyToContainer(ctx, id, dstPath, content, types.CopyToContainerOptions{})
+	return wrapPathNotFound(err, id, dstPath)
+}
+
+func (d *dockerRuntime) CopyFrom(ctx context.Context, id string, srcPath string) (io.ReadCloser, PathStat, error) {
+	archive, stat, err := d.cli.CopyFromContainer(ctx, id, srcPath)
+	if err != nil {
+		return nil, PathStat{}, wrapPathNotFound(err, id, srcPath)
+	}
+	return archive, PathStat{
+		Name:       stat.Name,
+		Size:       stat.Size,
+		Mode:       stat.Mode,
+		Mtime:      stat.Mtime,
+		LinkTarget: stat.LinkTarget,
+	}, nil
+}
+
+func (d *dockerRuntime) Commit(ctx context.Context, id string, config CommitConfig) (string, error) {
+	resp, err := d.cli.ContainerCommit(ctx, id, types.ContainerCommitOptions{
+		Reference: config.Reference,
+		Author:    config.Author,
+		Comment:   config.Comment,
+		Changes:   config.Changes,
+		Pause:     true,
+	})
+	if err != nil {
+		return "", wrapNotFound(err, id)
+	}
+	return resp.ID, nil
+}
+
+func (d *dockerRuntime) Export(ctx context.Context, id string) (io.ReadCloser, error) {
+	archive, err := d.cli.ContainerExport(ctx, id)
+	return archive, wrapNotFound(err, id)
+}
+
+func (d *dockerRuntime) ListImages(ctx context.Context, labels map[string]string) ([]ImageInfo, error) {
+	args := filters.NewArgs()
+	for key, value := range labels {
+		if value == "" {
+			args.Add("label", key)
+		} else {
+			args.Add("label", key+"="+value)
+		}
+	}
+	images, err := d.cli.ImageList(ctx, types.ImageListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ImageInfo, 0, len(images))
+	for _, image := range images {
+		// The author and the comment are only part of the full image description.
+		inspect, _, err := d.cli.ImageInspectWithRaw(ctx, image.ID)
+		if client.IsErrImageNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tags := make([]string, 0, len(image.RepoTags))
+		for _, tag := range image.RepoTags {
+			if tag != "<none>:<none>" {
+				tags = append(tags, tag)
+			}
+		}
+		list = append(list, ImageInfo{
+			ID:      image.ID,
+			Tags:    tags,
+			Labels:  image.Labels,
+			Author:  inspect.Author,
+			Comment: inspect.Comment,
+			Created: time.Unix(image.Created, 0).UTC(),
+			Size:    image.Size,
+		})
+	}
+	return list, nil
+}
+
+func (d *dockerRuntime) RemoveImage(ctx context.Context, id string) error {
+	inspect, _, err := d.cli.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		return err
+	}
+	// An image with several tags can not be removed by ID without force, it is
+	// untagged one tag after the other, removing the last one removes the image.
+	refs := inspect.RepoTags
+	if len(refs) == 0 {
+		refs = []string{inspect.ID}
+	}
+	for _, ref := range refs {
+		_, err := d.cli.ImageRemove(ctx, ref, types.ImageRemoveOptions{PruneChildren: true})
+		if err != nil && strings.Contains(err.Error(), "conflict") {
+			return fmt.Errorf("%w: %s", ErrImageInUse, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
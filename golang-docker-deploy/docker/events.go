@@ -0,0 +1,355 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Normalized event types.
+const (
+	EventStart        = "start"
+	EventDie          = "die"
+	EventOOM          = "oom"
+	EventRestart      = "restart"
+	EventHealthStatus = "health_status"
+)
+
+const (
+	// eventBuffer is the number of events buffered per subscriber, events
+	// of subscribers not keeping up are dropped.
+	eventBuffer = 64
+	// webhookAttempts is how many times a webhook delivery is tried.
+	webhookAttempts = 3
+	// maxReconnectDelay caps the wait between two reconnect attempts.
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Event is a normalized event of a managed container.
+type Event struct {
+	Type        string `json:"type"`
+	ContainerID string `json:"containerId"`
+	Name        string `json:"name,omitempty"`
+	Image       string `json:"image,omitempty"`
+	Deployment  string `json:"deployment,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	ExitCode    string `json:"exitCode,omitempty"`
+	Health      string `json:"health,omitempty"`
+	// Expires is the end of the lease of the expiring and expired events.
+	Expires *time.Time `json:"expires,omitempty"`
+	Time    time.Time  `json:"time"`
+}
+
+// Webhook is an URL notified about the container events.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Types limits the notifications to the given event types, all events are sent if empty.
+	Types []string `json:"types,omitempty"`
+	// Tenant limits the notifications to the containers of the tenant, set by AddWebhook from the context.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// EventWatcher subscribes to the runtime events of the managed containers and
+// fans the normalized events out to webhooks and to Go channel subscribers.
+// The subscription is reopened from the last seen event if the stream drops.
+type EventWatcher struct {
+	rt          Runtime
+	client      *http.Client
+	mutex       sync.RWMutex
+	webhooks    map[string]Webhook
+	subscribers map[chan Event]bool
+	lastSeen    time.Time
+	// seen holds the events received at lastSeen, to skip them when the
+	// stream is reopened from that time.
+	seen map[string]bool
+}
+
+// webhookAddressAllowed tells whether the webhooks may be delivered to ip. The loopback
+// and link-local addresses would reach the services of the deploy host and the cloud
+// metadata endpoint.
+func webhookAddressAllowed(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
+
+// webhookDialControl checks the address a webhook delivery connects to, after the
+// host name is resolved, so a name pointing to the deploy host is rejected as well.
+func webhookDialControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+		return fmt.Errorf("Webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+// NewEventWatcher creates an EventWatcher on the runtime of manager.
+func NewEventWatcher(manager *Manager) *EventWatcher {
+	// No proxy, the webhooks are delivered straight to the checked addresses.
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: webhookDialControl}
+	return &EventWatcher{
+		rt: manager.rt,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+		webhooks:    make(map[string]Webhook),
+		subscribers: make(map[chan Event]bool),
+		seen:        make(map[string]bool),
+	}
+}
+
+// normalizeEvent turns a runtime event into an Event. Events not listed in the
+// normalized types are dropped.
+func normalizeEvent(raw RuntimeEvent) (Event, bool) {
+	event := Event{
+		ContainerID: raw.ContainerID,
+		Name:        raw.Attributes["name"],
+		Image:       raw.Attributes["image"],
+		Deployment:  raw.Attributes[LabelDeployment],
+		Tenant:      raw.Attributes[LabelTenant],
+		Time:        raw.Time,
+	}
+	switch {
+	case raw.Action == EventStart, raw.Action == EventOOM, raw.Action == EventRestart:
+		event.Type = raw.Action
+	case raw.Action == EventDie:
+		event.Type = raw.Action
+		event.ExitCode = raw.Attributes["exitCode"]
+	case strings.HasPrefix(raw.Action, EventHealthStatus):
+		event.Type = EventHealthStatus
+		event.Health = strings.TrimSpace(strings.TrimPrefix(raw.Action, EventHealthStatus+":"))
+	default:
+		return event, false
+	}
+	return event, true
+}
+
+// Run watches the events until ctx is cancelled.
+func (w *EventWatcher) Run(ctx context.Context) {
+	delay := time.Second
+	for {
+		w.mutex.RLock()
+		since := w.lastSeen
+		w.mutex.RUnlock()
+		if since.IsZero() {
+			since = time.Now().UTC()
+		}
+
+		received, err := w.watch(ctx, since)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			delay = time.Second
+		}
+		log.Printf("Event stream dropped: %v, reconnecting in %s", err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// watch reads one event stream until it fails. It tells whether any event was received.
+func (w *EventWatcher) watch(ctx context.Context, since time.Time) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, errs := w.rt.Events(ctx, since, map[string]string{LabelManaged: "true"})
+	received := false
+	for {
+		select {
+		case err := <-errs:
+			return received, err
+		case raw := <-events:
+			received = true
+			w.handle(raw)
+		}
+	}
+}
+
+func eventKey(raw RuntimeEvent) string {
+	return fmt.Sprintf("%d/%s/%s", raw.Time.UnixNano(), raw.ContainerID, raw.Action)
+}
+
+func (w *EventWatcher) handle(raw RuntimeEvent) {
+	w.mutex.Lock()
+	key := eventKey(raw)
+	if raw.Time.Before(w.lastSeen) || w.seen[key] {
+		// Replayed after a reconnect.
+		w.mutex.Unlock()
+		return
+	}
+	if raw.Time.After(w.lastSeen) {
+		w.lastSeen = raw.Time
+		w.seen = make(map[string]bool)
+	}
+	w.seen[key] = true
+	w.mutex.Unlock()
+
+	event, ok := normalizeEvent(raw)
+	if !ok {
+		return
+	}
+	w.publish(event)
+}
+
+func (w *EventWatcher) publish(event Event) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for subscriber := range w.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			log.Printf("Event subscriber is too slow, %s event of %s is dropped", event.Type, event.ContainerID)
+		}
+	}
+	for _, webhook := range w.webhooks {
+		if webhook.wants(event) {
+			go w.deliver(webhook, event)
+		}
+	}
+}
+
+func (h Webhook) wants(event Event) bool {
+	if h.Tenant != "" && h.Tenant != event.Tenant {
+		return false
+	}
+	if len(h.Types) == 0 {
+		return true
+	}
+	for _, t := range h.Types {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *EventWatcher) deliver(webhook Webhook, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	delay := time.Second
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		resp, err := w.client.Post(webhook.URL, "application/json; charset=utf-8", bytes.NewReader(payload)) // nolint:noctx
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusBadRequest {
+				return
+			}
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		log.Printf("Webhook %s delivery failed (attempt %d): %s", webhook.URL, attempt, err.Error())
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Subscribe returns a channel receiving the events and the function cancelling the subscription.
+// Use Visible to pick the events of a tenant.
+func (w *EventWatcher) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	w.mutex.Lock()
+	w.subscribers[ch] = true
+	w.mutex.Unlock()
+
+	once := sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			w.mutex.Lock()
+			delete(w.subscribers, ch)
+			w.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Visible tells whether event concerns a container of the tenant of ctx.
+func (e Event) Visible(ctx context.Context) bool {
+	return visible(ctx, e.Tenant)
+}
+
+// AddWebhook registers a webhook URL notified about the events of the given types,
+// or about all events if types is empty. Webhooks added on behalf of a tenant
+// only get the events of that tenant. The URL must be http or https and must not
+// point to a loopback or link-local address.
+func (w *EventWatcher) AddWebhook(ctx context.Context, rawURL string, types []string) (Webhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return Webhook{}, fmt.Errorf("Invalid webhook URL %q", rawURL)
+	}
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if ip := net.ParseIP(host); (ip != nil && !webhookAddressAllowed(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return Webhook{}, fmt.Errorf("Webhook URL %q points to the deploy host", rawURL)
+	}
+	for _, t := range types {
+		switch t {
+		case EventStart, EventDie, EventOOM, EventRestart, EventHealthStatus, EventExpiring, EventExpired:
+		default:
+			return Webhook{}, fmt.Errorf("Invalid event type %q", t)
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Webhook{}, err
+	}
+	webhook := Webhook{
+		ID:     hex.EncodeToString(id),
+		URL:    rawURL,
+		Types:  types,
+		Tenant: TenantFrom(ctx),
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.webhooks[webhook.ID] = webhook
+	return webhook, nil
+}
+
+// RemoveWebhook unregisters a webhook of the tenant of ctx.
+func (w *EventWatcher) RemoveWebhook(ctx context.Context, id string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if webhook, ok := w.webhooks[id]; !ok || !visible(ctx, webhook.Tenant) {
+		return false
+	}
+	delete(w.webhooks, id)
+	return true
+}
+
+// Webhooks returns the webhooks registered by the tenant of ctx.
+func (w *EventWatcher) Webhooks(ctx context.Context) []Webhook {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	list := make([]Webhook, 0, len(w.webhooks))
+	for _, webhook := range w.webhooks {
+		if visible(ctx, webhook.Tenant) {
+			list = append(list, webhook)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, rt := newTestManager(t, "47210-47219")
+	watcher := NewEventWatcher(m)
+	events, unsubscribe := watcher.Subscribe()
+	defer unsubscribe()
+	go watcher.Run(ctx)
+	// The stream starts at the time Run subscribes, give it the time to do so.
+	time.Sleep(50 * time.Millisecond)
+
+	team := WithTenant(ctx, "team")
+	info, err := m.CreateNewContainer(team, ContainerSpec{Image: "worker:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Exit(info.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{EventStart, EventDie}
+	for len(want) > 0 {
+		select {
+		case event := <-events:
+			if event.ContainerID != info.ID {
+				continue
+			}
+			if event.Type != want[0] {
+				t.Fatalf("Event is %s, want %s", event.Type, want[0])
+			}
+			if event.Tenant != "team" || !event.Visible(team) || event.Visible(WithTenant(ctx, "other")) {
+				t.Errorf("Event of tenant %q is visible to the wrong tenants", event.Tenant)
+			}
+			want = want[1:]
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Events %v are not received", want)
+		}
+	}
+}
+
+func TestAddWebhook(t *testing.T) {
+	m, _ := newTestManager(t, "47220-47229")
+	watcher := NewEventWatcher(m)
+	team := WithTenant(context.Background(), "team")
+	tests := []struct {
+		name  string
+		url   string
+		types []string
+		ok    bool
+	}{
+		{"all events", "https://hooks.example.com/deploy", nil, true},
+		{"some events", "http://hooks.example.com/deploy", []string{EventDie, EventOOM}, true},
+		{"unknown event", "https://hooks.example.com/deploy", []string{"create"}, false},
+		{"not http", "ftp://hooks.example.com/deploy", nil, false},
+		{"no host", "https:///deploy", nil, false},
+		{"loopback", "http://127.0.0.1:8080/deploy", nil, false},
+		{"ipv6 loopback", "http://[::1]/deploy", nil, false},
+		{"mapped loopback", "http://[::ffff:127.0.0.1]/deploy", nil, false},
+		{"localhost", "http://localhost:8080/deploy", nil, false},
+		{"localhost with dot", "http://LocalHost./deploy", nil, false},
+		{"cloud metadata", "http://169.254.169.254/latest/meta-data", nil, false},
+		{"unspecified", "http://0.0.0.0/deploy", nil, false},
+		{"public address", "https://203.0.113.10/deploy", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webhook, err := watcher.AddWebhook(team, test.url, test.types)
+			if (err == nil) != test.ok {
+				t.Fatalf("AddWebhook returned %v", err)
+			}
+			if err == nil && webhook.Tenant != "team" {
+				t.Errorf("Webhook belongs to %q, want team", webhook.Tenant)
+			}
+		})
+	}
+
+	webhooks := watcher.Webhooks(team)
+	if len(webhooks) != 3 || len(watcher.Webhooks(WithTenant(context.Background(), "other"))) != 0 {
+		t.Fatalf("Webhooks are %v", webhooks)
+	}
+	if watcher.RemoveWebhook(WithTenant(context.Background(), "other"), webhooks[0].ID) {
+		t.Errorf("Another tenant removed a webhook")
+	}
+	if !watcher.RemoveWebhook(team, webhooks[0].ID) || len(watcher.Webhooks(team)) != 2 {
+		t.Errorf("Webhook is not removed")
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	delivered := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := Event{}
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		delivered <- event
+	}))
+	defer server.Close()
+
+	m, _ := newTestManager(t, "47250-47259")
+	watcher := NewEventWatcher(m)
+	// A host name resolved to the deploy host is only caught when connecting.
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	for _, target := range []string{"http://localhost:" + port + "/", server.URL} {
+		_, err := watcher.client.Post(target, "application/json", strings.NewReader("{}"))
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("Delivery to %s returned %v", target, err)
+		}
+	}
+	select {
+	case event := <-delivered:
+		t.Errorf("Event %v is delivered to a loopback address", event)
+	default:
+	}
+}
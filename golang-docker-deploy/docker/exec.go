@@ -0,0 +1,271 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ErrNotRunning is returned when a command is run in a container which is not running.
+var ErrNotRunning = errors.New("Container is not running")
+
+// maxExecOutput limits the captured stdout and stderr of Exec, each.
+const maxExecOutput = 1 << 20
+
+// execPollInterval is how often the exit code of a finished command is polled.
+const execPollInterval = 50 * time.Millisecond
+
+// ExecOptions describes a command run inside a managed container.
+type ExecOptions struct {
+	Cmd        []string          `json:"cmd"`
+	Env        map[string]string `json:"env,omitempty"`
+	WorkingDir string            `json:"workingDir,omitempty"`
+	// Stdin is fed to the standard input of the command by Exec.
+	Stdin string `json:"stdin,omitempty"`
+	// Tty allocates a terminal for interactive sessions.
+	Tty bool `json:"tty,omitempty"`
+	// Timeout limits how long Exec waits for the command, zero means no limit.
+	Timeout time.Duration `json:"-"`
+}
+
+// ExecResult is the outcome of a command run by Exec.
+type ExecResult struct {
+	ExitCode int    `json:"exitCode"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// TimedOut is set if the timeout expired, the exit code is -1 then.
+	TimedOut bool `json:"timedOut,omitempty"`
+	// Truncated is set if the output exceeded the capture limit.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExecSession is a command running inside a container with its standard
+// streams attached, see Manager.ExecInteractive.
+type ExecSession struct {
+	ID          string
+	ContainerID string
+	rt          Runtime
+	conn        ExecConn
+	tty         bool
+}
+
+// validate checks the command options.
+func (o ExecOptions) validate() error {
+	if len(o.Cmd) == 0 || o.Cmd[0] == "" {
+		return fmt.Errorf("%w: missing command", ErrInvalidSpec)
+	}
+	for key := range o.Env {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("%w: invalid environment variable %q", ErrInvalidSpec, key)
+		}
+	}
+	if o.WorkingDir != "" && !strings.HasPrefix(o.WorkingDir, "/") {
+		return fmt.Errorf("%w: working directory %q is not absolute", ErrInvalidSpec, o.WorkingDir)
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("%w: negative timeout", ErrInvalidSpec)
+	}
+	return nil
+}
+
+// startExec starts the command in the managed container id.
+func (m *Manager) startExec(ctx context.Context, id string, options ExecOptions, stdin bool) (*ExecSession, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if info.State != "running" {
+		return nil, fmt.Errorf("%w: %s", ErrNotRunning, info.ID)
+	}
+	env := make([]string, 0, len(options.Env))
+	for key, value := range options.Env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	execID, conn, err := m.rt.ExecStart(ctx, info.ID, ExecConfig{
+		Cmd:        options.Cmd,
+		Env:        env,
+		WorkingDir: options.WorkingDir,
+		Tty:        options.Tty,
+		Stdin:      stdin,
+	})
+	if err != nil {
+		err = fmt.Errorf("Failed to run command in %s: %s", info.ID, err.Error())
+		return nil, err
+	}
+	return &ExecSession{
+		ID:          execID,
+		ContainerID: info.ID,
+		rt:          m.rt,
+		conn:        conn,
+		tty:         options.Tty,
+	}, nil
+}
+
+// ExecInteractive starts the command in the managed container id with its standard
+// input attached. The caller feeds the input with Write, reads the output with
+// Stream and must Close the session.
+func (m *Manager) ExecInteractive(ctx context.Context, id string, options ExecOptions) (*ExecSession, error) {
+	return m.startExec(ctx, id, options, true)
+}
+
+// Exec runs the command in the managed container id, feeds it options.Stdin and
+// waits for it to finish. If the timeout expires the output so far is returned;
+// docker can not kill an exec process, so the command itself keeps running.
+func (m *Manager) Exec(ctx context.Context, id string, options ExecOptions) (*ExecResult, error) {
+	session, err := m.startExec(ctx, id, options, options.Stdin != "")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	runCtx := ctx
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	if options.Stdin != "" {
+		go func() {
+			_, _ = io.WriteString(session, options.Stdin)
+			_ = session.CloseStdin()
+		}()
+	}
+
+	stdout := &cappedBuffer{limit: maxExecOutput}
+	stderr := &cappedBuffer{limit: maxExecOutput}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Stream(func(stream string, data []byte) error {
+			if stream == StreamStderr {
+				_, err := stderr.Write(data)
+				return err
+			}
+			_, err := stdout.Write(data)
+			return err
+		})
+	}()
+
+	result := &ExecResult{ExitCode: -1}
+	select {
+	case err = <-done:
+	case <-runCtx.Done():
+		session.Close()
+		<-done
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		result.TimedOut = true
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("Failed to read command output: %s", err.Error())
+		return nil, err
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	if result.TimedOut {
+		return result, nil
+	}
+	if result.ExitCode, err = session.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Write feeds data to the standard input of the command.
+func (s *ExecSession) Write(p []byte) (int, error) {
+	return s.conn.Write(p)
+}
+
+// CloseStdin closes the standard input of the command.
+func (s *ExecSession) CloseStdin() error {
+	return s.conn.CloseWrite()
+}
+
+// Stream reads the output of the command until it ends and hands every chunk
+// over to output, together with its stream name. With a terminal everything
+// is reported on stdout. An error returned by output stops the streaming.
+func (s *ExecSession) Stream(output func(stream string, data []byte) error) error {
+	stdout := outputFunc(func(p []byte) error {
+		return output(StreamStdout, p)
+	})
+	if s.tty {
+		_, err := io.Copy(stdout, s.conn)
+		return ignoreClosed(err)
+	}
+	stderr := outputFunc(func(p []byte) error {
+		return output(StreamStderr, p)
+	})
+	_, err := stdcopy.StdCopy(stdout, stderr, s.conn)
+	return ignoreClosed(err)
+}
+
+// Wait waits for the command to finish after its output ended and returns its exit code.
+func (s *ExecSession) Wait(ctx context.Context) (int, error) {
+	for {
+		running, exitCode, err := s.rt.ExecInspect(ctx, s.ID)
+		if err != nil {
+			err = fmt.Errorf("Failed to inspect command: %s", err.Error())
+			return -1, err
+		}
+		if !running {
+			return exitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-time.After(execPollInterval):
+		}
+	}
+}
+
+// Close detaches from the command.
+func (s *ExecSession) Close() error {
+	return s.conn.Close()
+}
+
+// ignoreClosed drops the error of reading a connection closed by Close.
+func ignoreClosed(err error) error {
+	if errors.Is(err, io.ErrClosedPipe) || (err != nil && strings.Contains(err.Error(), "use of closed network connection")) {
+		return nil
+	}
+	return err
+}
+
+// outputFunc is a writer passing a copy of the written data to a function.
+type outputFunc func(p []byte) error
+
+func (f outputFunc) Write(p []byte) (int, error) {
+	if err := f(append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// cappedBuffer keeps the first limit bytes written to it and drops the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.truncated = true
+		b.Buffer.Write(p[:room])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
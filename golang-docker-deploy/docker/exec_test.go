@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExec(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, "47120-47129")
+	info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		options  ExecOptions
+		exitCode int
+		stdout   string
+		timedOut bool
+		err      error
+	}{
+		{"output", ExecOptions{Cmd: []string{"echo", "hello"}}, 0, "hello\n", false, nil},
+		{"stdin", ExecOptions{Cmd: []string{"cat"}, Stdin: "input"}, 0, "input", false, nil},
+		{"working directory", ExecOptions{Cmd: []string{"pwd"}, WorkingDir: "/app"}, 0, "/app\n", false, nil},
+		{"exit code", ExecOptions{Cmd: []string{"false"}}, 1, "", false, nil},
+		{"unknown command", ExecOptions{Cmd: []string{"missing"}}, 127, "", false, nil},
+		{"timeout", ExecOptions{Cmd: []string{"sleep"}, Timeout: 50 * time.Millisecond}, -1, "", true, nil},
+		{"no command", ExecOptions{}, 0, "", false, ErrInvalidSpec},
+		{"invalid env", ExecOptions{Cmd: []string{"env"}, Env: map[string]string{"A=B": "c"}}, 0, "", false, ErrInvalidSpec},
+		{"relative working directory", ExecOptions{Cmd: []string{"pwd"}, WorkingDir: "app"}, 0, "", false, ErrInvalidSpec},
+		{"negative timeout", ExecOptions{Cmd: []string{"true"}, Timeout: -time.Second}, 0, "", false, ErrInvalidSpec},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := m.Exec(ctx, info.ID, test.options)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Exec returned %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if result.ExitCode != test.exitCode || result.Stdout != test.stdout || result.TimedOut != test.timedOut {
+				t.Errorf("Exec returned %+v, want exit code %d, output %q", result, test.exitCode, test.stdout)
+			}
+			if test.exitCode == 127 && !strings.Contains(result.Stderr, "not found") {
+				t.Errorf("Stderr is %q", result.Stderr)
+			}
+		})
+	}
+
+	if _, err := m.Stop(ctx, info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Exec(ctx, info.ID, ExecOptions{Cmd: []string{"true"}}); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Exec in a stopped container returned %v, want %v", err, ErrNotRunning)
+	}
+	if _, err := m.Exec(WithTenant(ctx, "other"), info.ID, ExecOptions{Cmd: []string{"true"}}); !errors.Is(err, ErrNotManaged) {
+		t.Errorf("Exec by another tenant returned %v, want %v", err, ErrNotManaged)
+	}
+}
@@ -0,0 +1,1050 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// firstEphemeralPort is where the fake runtime starts handing out host ports
+// for bindings that do not request a specific one, same as docker does.
+const firstEphemeralPort = 32768
+
+var _ Runtime = (*FakeRuntime)(nil)
+
+type fakeContainer struct {
+	info   ContainerInfo
+	config ContainerConfig
+	logs   bytes.Buffer
+	stats  ContainerStats
+	// files is the file tree of the container by absolute path.
+	files map[string]*fakeFile
+}
+
+// fakeFile is a file, a directory or a symlink of a fake container.
+type fakeFile struct {
+	mode    os.FileMode
+	content []byte
+	link    string
+	modTime time.Time
+}
+
+// newFakeFiles returns the file tree of a new container.
+func newFakeFiles() map[string]*fakeFile {
+	now := time.Now().UTC()
+	return map[string]*fakeFile{
+		"/":    {mode: os.ModeDir | 0755, modTime: now},
+		"/tmp": {mode: os.ModeDir | os.ModeSticky | 0777, modTime: now},
+	}
+}
+
+// fakeEventBuffer is the number of events a fake event stream buffers before
+// it is dropped, like a docker event stream of a too slow consumer.
+const fakeEventBuffer = 256
+
+type fakeWatcher struct {
+	events chan RuntimeEvent
+	errs   chan error
+	labels map[string]string
+	done   bool
+}
+
+// FakeRuntime is an in-memory Runtime. It simulates the container state
+// transitions (created, running, exited, removed) and the host port bindings
+// without a docker daemon, so the deployment logic can be tested anywhere.
+type FakeRuntime struct {
+	mutex      sync.Mutex
+	containers map[string]*fakeContainer
+	images     map[string]bool
+	nextPort   int
+	events     []RuntimeEvent
+	watchers   []*fakeWatcher
+	execs      map[string]*fakeExec
+	networks   map[string]*NetworkInfo
+	volumes    map[string]bool
+	// committed holds the images created by Commit by ID, the only ones listed by ListImages.
+	committed map[string]*ImageInfo
+}
+
+// NewFakeRuntime creates an empty FakeRuntime.
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		containers: make(map[string]*fakeContainer),
+		images:     make(map[string]bool),
+		nextPort:   firstEphemeralPort,
+		execs:      make(map[string]*fakeExec),
+		networks:   make(map[string]*NetworkInfo),
+		volumes:    make(map[string]bool),
+		committed:  make(map[string]*ImageInfo),
+	}
+}
+
+func newFakeID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// find resolves a container by ID, ID prefix or name. Must be called with the mutex held.
+func (f *FakeRuntime) find(id string) (*fakeContainer, error) {
+	if id == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if cont, ok := f.containers[id]; ok {
+		return cont, nil
+	}
+	var found *fakeContainer
+	for fullID, cont := range f.containers {
+		if strings.HasPrefix(fullID, id) || cont.info.Name == strings.TrimPrefix(id, "/") {
+			if found != nil {
+				return nil, fmt.Errorf("Multiple containers match %s", id)
+			}
+			found = cont
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return found, nil
+}
+
+// hostPortInUse tells whether a running container other than except binds hostPort.
+// Must be called with the mutex held.
+func (f *FakeRuntime) hostPortInUse(hostPort string, except string) bool {
+	for id, cont := range f.containers {
+		if id == except || cont.info.State != "running" {
+			continue
+		}
+		for _, port := range cont.info.Ports {
+			if port.HostPort == hostPort {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Create implements Runtime.
+func (f *FakeRuntime) Create(ctx context.Context, config ContainerConfig) (string, error) {
+	if config.Image == "" {
+		return "", fmt.Errorf("No image specified")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.images[normalizeImage(config.Image)] {
+		return "", fmt.Errorf("No such image: %s", config.Image)
+	}
+	id := newFakeID()
+	name := config.Name
+	if name == "" {
+		name = "fake_" + id[:12]
+	}
+	for _, cont := range f.containers {
+		if cont.info.Name == name {
+			return "", fmt.Errorf("Conflict. The container name %s is already in use", name)
+		}
+	}
+	networks := []string{"bridge"}
+	if config.Network != "" {
+		n := f.findNetwork(config.Network)
+		if n == nil {
+			return "", fmt.Errorf("network %s not found", config.Network)
+		}
+		networks = []string{n.Name}
+	}
+	for extra := range config.ExtraNetworks {
+		n := f.findNetwork(extra)
+		if n == nil {
+			return "", fmt.Errorf("network %s not found", extra)
+		}
+		networks = append(networks, n.Name)
+	}
+	// Named volumes are created on first use, as docker does.
+	for _, m := range config.Mounts {
+		if m.Type == MountVolume {
+			f.volumes[m.Source] = true
+		}
+	}
+	labels := make(map[string]string, len(config.Labels))
+	for key, value := range config.Labels {
+		labels[key] = value
+	}
+	f.containers[id] = &fakeContainer{
+		info: ContainerInfo{
+			ID:       id,
+			Name:     name,
+			Image:    config.Image,
+			Labels:   labels,
+			Networks: networks,
+			State:    "created",
+			Ports:    make([]PortMapping, 0),
+			Created:  time.Now().UTC(),
+		},
+		config: config,
+		files:  newFakeFiles(),
+	}
+	return id, nil
+}
+
+// Start implements Runtime. Host ports are bound on start, as in docker.
+func (f *FakeRuntime) Start(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	if cont.info.State == "running" {
+		return nil
+	}
+
+	ports := make([]PortMapping, 0, len(cont.config.Ports))
+	for _, mapping := range cont.config.Ports {
+		if mapping.Protocol == "" {
+			mapping.Protocol = "tcp"
+		}
+		if mapping.HostPort == "" || mapping.HostPort == "0" {
+			for f.hostPortInUse(strconv.Itoa(f.nextPort), cont.info.ID) {
+				f.nextPort++
+			}
+			mapping.HostPort = strconv.Itoa(f.nextPort)
+			f.nextPort++
+		} else if f.hostPortInUse(mapping.HostPort, cont.info.ID) {
+			return fmt.Errorf("Bind for %s:%s failed: port is already allocated", mapping.HostIP, mapping.HostPort)
+		}
+		ports = append(ports, mapping)
+	}
+	cont.info.Ports = ports
+	cont.info.State = "running"
+	f.publish("start", cont, nil)
+	return nil
+}
+
+// Stop implements Runtime.
+func (f *FakeRuntime) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	if cont.info.State == "running" {
+		cont.info.State = "exited"
+		f.publish("die", cont, map[string]string{"exitCode": "0"})
+		f.publish("stop", cont, nil)
+	}
+	return nil
+}
+
+// Remove implements Runtime.
+func (f *FakeRuntime) Remove(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	if cont.info.State == "running" {
+		cont.info.State = "exited"
+		f.publish("die", cont, map[string]string{"exitCode": "137"})
+	}
+	delete(f.containers, cont.info.ID)
+	f.publish("destroy", cont, nil)
+	return nil
+}
+
+// Inspect implements Runtime.
+func (f *FakeRuntime) Inspect(ctx context.Context, id string) (ContainerInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+	info := cont.info
+	info.Ports = append([]PortMapping(nil), cont.info.Ports...)
+	return info, nil
+}
+
+// List implements Runtime.
+func (f *FakeRuntime) List(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	list := make([]ContainerInfo, 0, len(f.containers))
+	for _, cont := range f.containers {
+		matches := true
+		for key, value := range labels {
+			if cont.info.Labels[key] != value {
+				matches = false
+			}
+		}
+		if matches {
+			info := cont.info
+			info.Ports = append([]PortMapping(nil), cont.info.Ports...)
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
+
+// Logs implements Runtime. Follow is not simulated, the log collected so far is returned.
+func (f *FakeRuntime) Logs(ctx context.Context, id string, options LogOptions) (io.ReadCloser, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(cont.logs.Bytes())), nil
+}
+
+// Build implements Runtime. The build context must be a tar archive containing
+// the Dockerfile, the resulting image is registered under all requested tags.
+func (f *FakeRuntime) Build(ctx context.Context, buildContext io.Reader, options BuildOptions) (io.ReadCloser, error) {
+	dockerfile := options.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	found := false
+	reader := tar.NewReader(buildContext)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error processing tar file: %s", err.Error())
+		}
+		if path.Clean(header.Name) == path.Clean(dockerfile) {
+			found = true
+		}
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	if !found {
+		_ = encoder.Encode(jsonMessage{Error: fmt.Sprintf("Cannot locate specified Dockerfile: %s", dockerfile)})
+		return ioutil.NopCloser(&out), nil
+	}
+
+	imageID := newFakeID()[:12]
+	_ = encoder.Encode(jsonMessage{Stream: fmt.Sprintf("Successfully built %s\n", imageID)})
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.images[imageID] = true
+	for _, tag := range options.Tags {
+		f.images[normalizeImage(tag)] = true
+		_ = encoder.Encode(jsonMessage{Stream: fmt.Sprintf("Successfully tagged %s\n", tag)})
+	}
+	return ioutil.NopCloser(&out), nil
+}
+
+// ImageExists implements Runtime.
+func (f *FakeRuntime) ImageExists(ctx context.Context, image string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.images[normalizeImage(image)], nil
+}
+
+// Pull implements Runtime. Every image can be pulled, the progress of two layers is reported.
+func (f *FakeRuntime) Pull(ctx context.Context, image string, credentials *RegistryCredentials) (io.ReadCloser, error) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	_ = encoder.Encode(map[string]string{"status": "Pulling from " + image})
+	for _, layer := range []string{"a1b2c3d4e5f6", "0f9e8d7c6b5a"} {
+		_ = encoder.Encode(map[string]interface{}{
+			"id": layer, "status": "Downloading",
+			"progressDetail": map[string]int64{"current": 512, "total": 1024},
+		})
+		_ = encoder.Encode(map[string]string{"id": layer, "status": "Pull complete"})
+	}
+	_ = encoder.Encode(map[string]string{"status": "Status: Downloaded newer image for " + image})
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.images[normalizeImage(image)] = true
+	return ioutil.NopCloser(&out), nil
+}
+
+type fakeExec struct {
+	running  bool
+	exitCode int
+}
+
+// fakeExecConn connects the caller to the standard streams of a fake exec process.
+type fakeExecConn struct {
+	output *io.PipeReader
+	input  *io.PipeWriter
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *fakeExecConn) Read(p []byte) (int, error) {
+	return c.output.Read(p)
+}
+
+func (c *fakeExecConn) Write(p []byte) (int, error) {
+	return c.input.Write(p)
+}
+
+func (c *fakeExecConn) CloseWrite() error {
+	return c.input.Close()
+}
+
+func (c *fakeExecConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	c.input.Close()
+	return c.output.Close()
+}
+
+// ExecStart implements Runtime. The fake knows a few commands: echo, cat, pwd,
+// env, true, false and sleep, which runs until the connection is closed.
+// Anything else fails with exit code 127.
+func (f *FakeRuntime) ExecStart(ctx context.Context, id string, config ExecConfig) (string, ExecConn, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if cont.info.State != "running" {
+		return "", nil, fmt.Errorf("Container %s is not running", cont.info.ID)
+	}
+	if len(config.Cmd) == 0 {
+		return "", nil, fmt.Errorf("No exec command specified")
+	}
+
+	execID := newFakeID()
+	exec := &fakeExec{running: true}
+	f.execs[execID] = exec
+	stdinReader, stdinWriter := io.Pipe()
+	outputReader, outputWriter := io.Pipe()
+	conn := &fakeExecConn{output: outputReader, input: stdinWriter, closed: make(chan struct{})}
+	if !config.Stdin {
+		stdinReader.Close()
+	}
+
+	var stdout, stderr io.Writer = outputWriter, outputWriter
+	if !config.Tty {
+		stdout = stdcopy.NewStdWriter(outputWriter, stdcopy.Stdout)
+		stderr = stdcopy.NewStdWriter(outputWriter, stdcopy.Stderr)
+	}
+	go func() {
+		exitCode := 0
+		switch config.Cmd[0] {
+		case "echo":
+			fmt.Fprintln(stdout, strings.Join(config.Cmd[1:], " "))
+		case "cat":
+			if config.Stdin {
+				_, _ = io.Copy(stdout, stdinReader)
+			}
+		case "pwd":
+			workingDir := config.WorkingDir
+			if workingDir == "" {
+				workingDir = "/"
+			}
+			fmt.Fprintln(stdout, workingDir)
+		case "env":
+			for _, variable := range config.Env {
+				fmt.Fprintln(stdout, variable)
+			}
+		case "true":
+		case "false":
+			exitCode = 1
+		case "sleep":
+			<-conn.closed
+			exitCode = 137
+		default:
+			fmt.Fprintf(stderr, "exec: %q: executable file not found in $PATH\n", config.Cmd[0])
+			exitCode = 127
+		}
+		f.mutex.Lock()
+		exec.running = false
+		exec.exitCode = exitCode
+		f.mutex.Unlock()
+		outputWriter.Close()
+	}()
+	return execID, conn, nil
+}
+
+// ExecInspect implements Runtime.
+func (f *FakeRuntime) ExecInspect(ctx context.Context, execID string) (bool, int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	exec, ok := f.execs[execID]
+	if !ok {
+		return false, 0, fmt.Errorf("No such exec instance: %s", execID)
+	}
+	return exec.running, exec.exitCode, nil
+}
+
+// findNetwork resolves a network by ID or name. Must be called with the mutex held.
+func (f *FakeRuntime) findNetwork(id string) *NetworkInfo {
+	for _, n := range f.networks {
+		if n.ID == id || n.Name == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// CreateNetwork implements Runtime.
+func (f *FakeRuntime) CreateNetwork(ctx context.Context, config NetworkConfig) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.findNetwork(config.Name) != nil {
+		return "", fmt.Errorf("network with name %s already exists", config.Name)
+	}
+	labels := make(map[string]string, len(config.Labels))
+	for key, value := range config.Labels {
+		labels[key] = value
+	}
+	id := newFakeID()
+	f.networks[id] = &NetworkInfo{ID: id, Name: config.Name, Internal: config.Internal, Labels: labels}
+	return id, nil
+}
+
+// ListNetworks implements Runtime.
+func (f *FakeRuntime) ListNetworks(ctx context.Context, labels map[string]string) ([]NetworkInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	list := make([]NetworkInfo, 0, len(f.networks))
+	for _, n := range f.networks {
+		matches := true
+		for key, value := range labels {
+			if n.Labels[key] != value {
+				matches = false
+			}
+		}
+		if matches {
+			list = append(list, *n)
+		}
+	}
+	return list, nil
+}
+
+// RemoveNetwork implements Runtime.
+func (f *FakeRuntime) RemoveNetwork(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n := f.findNetwork(id)
+	if n == nil {
+		return fmt.Errorf("%w: %s", ErrNetworkNotFound, id)
+	}
+	for _, cont := range f.containers {
+		if cont.info.State != "running" {
+			continue
+		}
+		for _, name := range cont.info.Networks {
+			if name == n.Name {
+				return fmt.Errorf("error while removing network: network %s has active endpoints", n.Name)
+			}
+		}
+	}
+	delete(f.networks, n.ID)
+	return nil
+}
+
+// RemoveVolume implements Runtime.
+func (f *FakeRuntime) RemoveVolume(ctx context.Context, name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, cont := range f.containers {
+		for _, m := range cont.config.Mounts {
+			if m.Type == MountVolume && m.Source == name {
+				return fmt.Errorf("remove %s: volume is in use - [%s]", name, cont.info.ID)
+			}
+		}
+	}
+	delete(f.volumes, name)
+	return nil
+}
+
+// Volumes returns the names of the named volumes in use or not removed yet.
+func (f *FakeRuntime) Volumes() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	names := make([]string, 0, len(f.volumes))
+	for name := range f.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stats implements Runtime, the sample set by SetStats is returned.
+func (f *FakeRuntime) Stats(ctx context.Context, id string) (ContainerStats, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	stats := cont.stats
+	stats.Read = time.Now().UTC()
+	return stats, nil
+}
+
+// SetStats sets the resource usage reported for the container.
+func (f *FakeRuntime) SetStats(id string, stats ContainerStats) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	cont.stats = stats
+	return nil
+}
+
+// CopyTo implements Runtime. The archive is extracted into the in-memory file
+// tree of the container, the missing parent directories are created.
+func (f *FakeRuntime) CopyTo(ctx context.Context, id string, dstPath string, content io.Reader) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	dstPath = path.Clean(dstPath)
+	dst, ok := cont.files[dstPath]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPathNotFound, dstPath)
+	}
+	if !dst.mode.IsDir() {
+		return fmt.Errorf("extraction point is not a directory")
+	}
+
+	reader := tar.NewReader(content)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error processing tar file: %s", err.Error())
+		}
+		name := path.Join(dstPath, header.Name)
+		if name != dstPath && !strings.HasPrefix(name, strings.TrimSuffix(dstPath, "/")+"/") {
+			return fmt.Errorf("Invalid archive entry %q", header.Name)
+		}
+		file := &fakeFile{mode: header.FileInfo().Mode(), modTime: header.ModTime}
+		switch header.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeReg, tar.TypeRegA:
+			if file.content, err = ioutil.ReadAll(reader); err != nil {
+				return fmt.Errorf("Error processing tar file: %s", err.Error())
+			}
+		case tar.TypeSymlink:
+			file.link = header.Linkname
+		case tar.TypeLink:
+			target, ok := cont.files[path.Join(dstPath, header.Linkname)]
+			if !ok || !target.mode.IsRegular() {
+				return fmt.Errorf("Invalid hard link %q", header.Linkname)
+			}
+			file.mode = target.mode
+			file.content = target.content
+		default:
+			continue
+		}
+		if existing, ok := cont.files[name]; ok && existing.mode.IsDir() != file.mode.IsDir() {
+			return fmt.Errorf("cannot overwrite %s with a %s", name, file.mode.String())
+		}
+		for parent := path.Dir(name); cont.files[parent] == nil; parent = path.Dir(parent) {
+			cont.files[parent] = &fakeFile{mode: os.ModeDir | 0755, modTime: file.modTime}
+		}
+		cont.files[name] = file
+	}
+}
+
+// CopyFrom implements Runtime.
+func (f *FakeRuntime) CopyFrom(ctx context.Context, id string, srcPath string) (io.ReadCloser, PathStat, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return nil, PathStat{}, err
+	}
+	srcPath = path.Clean(srcPath)
+	src, ok := cont.files[srcPath]
+	if !ok {
+		return nil, PathStat{}, fmt.Errorf("%w: %s", ErrPathNotFound, srcPath)
+	}
+	stat := PathStat{
+		Name:  path.Base(srcPath),
+		Size:  int64(len(src.content)),
+		Mode:  src.mode,
+		Mtime: src.modTime,
+	}
+	if src.link != "" {
+		stat.LinkTarget = src.link
+		if !path.IsAbs(src.link) {
+			stat.LinkTarget = path.Join(path.Dir(srcPath), src.link)
+		}
+	}
+
+	names := []string{srcPath}
+	if src.mode.IsDir() {
+		names = append(names, cont.children(srcPath)...)
+	}
+	base := stat.Name
+	if base == "/" {
+		base = "."
+	}
+	archive, err := cont.archive(names, srcPath, base)
+	if err != nil {
+		return nil, stat, err
+	}
+	return ioutil.NopCloser(archive), stat, nil
+}
+
+// children returns the paths below the directory dir.
+func (cont *fakeContainer) children(dir string) []string {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	names := make([]string, 0)
+	for name := range cont.files {
+		if name != dir && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// archive returns the named files as a tar archive sorted by name, the srcPath
+// prefix of the names is replaced by base.
+func (cont *fakeContainer) archive(names []string, srcPath string, base string) (*bytes.Buffer, error) {
+	sort.Strings(names)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range names {
+		file := cont.files[name]
+		header := &tar.Header{
+			Name:     path.Join(base, strings.TrimPrefix(name, srcPath)),
+			Mode:     int64(file.mode.Perm()),
+			ModTime:  file.modTime,
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(file.content)),
+		}
+		switch {
+		case file.mode.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Size = 0
+		case file.link != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = file.link
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(file.content); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+// Commit implements Runtime. Of the changes, only the LABEL instructions are
+// applied, their values must not contain spaces.
+func (f *FakeRuntime) Commit(ctx context.Context, id string, config CommitConfig) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return "", err
+	}
+	labels := make(map[string]string, len(cont.info.Labels))
+	for key, value := range cont.info.Labels {
+		labels[key] = value
+	}
+	for _, change := range config.Changes {
+		fields := strings.Fields(change)
+		if len(fields) == 0 || strings.ToUpper(fields[0]) != "LABEL" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return "", fmt.Errorf("LABEL requires key=value, got %q", field)
+			}
+			if value, err := strconv.Unquote(parts[1]); err == nil {
+				parts[1] = value
+			}
+			labels[parts[0]] = parts[1]
+		}
+	}
+
+	var size int64
+	for _, file := range cont.files {
+		size += int64(len(file.content))
+	}
+	image := &ImageInfo{
+		ID:      "sha256:" + newFakeID(),
+		Tags:    make([]string, 0, 1),
+		Labels:  labels,
+		Author:  config.Author,
+		Comment: config.Comment,
+		Created: time.Now().UTC(),
+		Size:    size,
+	}
+	if config.Reference != "" {
+		tag := normalizeImage(config.Reference)
+		// The tag moves to the new image, as docker does.
+		for _, other := range f.committed {
+			for i, otherTag := range other.Tags {
+				if otherTag == tag {
+					other.Tags = append(other.Tags[:i], other.Tags[i+1:]...)
+					break
+				}
+			}
+		}
+		image.Tags = append(image.Tags, tag)
+		f.images[tag] = true
+	}
+	f.images[image.ID] = true
+	f.committed[image.ID] = image
+	return image.ID, nil
+}
+
+// Export implements Runtime.
+func (f *FakeRuntime) Export(ctx context.Context, id string) (io.ReadCloser, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := cont.archive(cont.children("/"), "/", "")
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(archive), nil
+}
+
+// ListImages implements Runtime, only the images created by Commit are listed.
+func (f *FakeRuntime) ListImages(ctx context.Context, labels map[string]string) ([]ImageInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	list := make([]ImageInfo, 0, len(f.committed))
+	for _, image := range f.committed {
+		matches := true
+		for key, value := range labels {
+			if actual, ok := image.Labels[key]; !ok || (value != "" && actual != value) {
+				matches = false
+			}
+		}
+		if matches {
+			info := *image
+			info.Tags = append([]string(nil), image.Tags...)
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
+
+// RemoveImage implements Runtime for the images created by Commit. It fails
+// while a container, running or not, uses the image.
+func (f *FakeRuntime) RemoveImage(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	image, ok := f.committed[id]
+	if !ok {
+		return fmt.Errorf("No such image: %s", id)
+	}
+	for _, cont := range f.containers {
+		used := cont.config.Image == image.ID
+		for _, tag := range image.Tags {
+			used = used || normalizeImage(cont.config.Image) == tag
+		}
+		if used {
+			return fmt.Errorf("%w: conflict: unable to delete %s, container %s is using it", ErrImageInUse, id, cont.info.ID[:12])
+		}
+	}
+	for _, tag := range image.Tags {
+		delete(f.images, tag)
+	}
+	delete(f.images, image.ID)
+	delete(f.committed, image.ID)
+	return nil
+}
+
+// AddImage makes image present locally without pulling it.
+func (f *FakeRuntime) AddImage(image string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.images[normalizeImage(image)] = true
+}
+
+// WriteLog appends text to the stdout or stderr log of the container.
+func (f *FakeRuntime) WriteLog(id string, stderr bool, text string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	stream := stdcopy.Stdout
+	if stderr {
+		stream = stdcopy.Stderr
+	}
+	_, err = stdcopy.NewStdWriter(&cont.logs, stream).Write([]byte(text))
+	return err
+}
+
+// Exit simulates the container process terminating on its own.
+func (f *FakeRuntime) Exit(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	cont.info.State = "exited"
+	f.publish("die", cont, map[string]string{"exitCode": "1"})
+	return nil
+}
+
+// OOM simulates the container being killed by the out of memory killer.
+func (f *FakeRuntime) OOM(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	f.publish("oom", cont, nil)
+	cont.info.State = "exited"
+	f.publish("die", cont, map[string]string{"exitCode": "137"})
+	return nil
+}
+
+// SetHealth simulates a docker health check result, status is healthy or unhealthy.
+func (f *FakeRuntime) SetHealth(id string, status string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cont, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	f.publish("health_status: "+status, cont, nil)
+	return nil
+}
+
+// DropEventStreams ends every open event stream with an error, as if the
+// connection to the daemon was lost.
+func (f *FakeRuntime) DropEventStreams() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for len(f.watchers) > 0 {
+		f.closeWatcher(f.watchers[0], fmt.Errorf("unexpected EOF"))
+	}
+}
+
+// Events implements Runtime. The events since the given time are replayed first.
+func (f *FakeRuntime) Events(ctx context.Context, since time.Time, labels map[string]string) (<-chan RuntimeEvent, <-chan error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	watcher := &fakeWatcher{
+		events: make(chan RuntimeEvent, fakeEventBuffer),
+		errs:   make(chan error, 1),
+		labels: labels,
+	}
+	for _, event := range f.events {
+		if !event.Time.Before(since) && watcher.matches(event) && len(watcher.events) < fakeEventBuffer {
+			watcher.events <- event
+		}
+	}
+	f.watchers = append(f.watchers, watcher)
+
+	go func() {
+		<-ctx.Done()
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		f.closeWatcher(watcher, ctx.Err())
+	}()
+	return watcher.events, watcher.errs
+}
+
+func (w *fakeWatcher) matches(event RuntimeEvent) bool {
+	for key, value := range w.labels {
+		if event.Attributes[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// closeWatcher ends an event stream. Must be called with the mutex held.
+func (f *FakeRuntime) closeWatcher(watcher *fakeWatcher, err error) {
+	if watcher.done {
+		return
+	}
+	watcher.done = true
+	watcher.errs <- err
+	close(watcher.errs)
+	for i, w := range f.watchers {
+		if w == watcher {
+			f.watchers = append(f.watchers[:i], f.watchers[i+1:]...)
+			break
+		}
+	}
+}
+
+// publish records an event of cont and sends it to the matching event streams.
+// Must be called with the mutex held.
+func (f *FakeRuntime) publish(action string, cont *fakeContainer, extra map[string]string) {
+	attributes := map[string]string{
+		"image": cont.info.Image,
+		"name":  cont.info.Name,
+	}
+	for key, value := range cont.info.Labels {
+		attributes[key] = value
+	}
+	for key, value := range extra {
+		attributes[key] = value
+	}
+	event := RuntimeEvent{
+		Action:      action,
+		ContainerID: cont.info.ID,
+		Attributes:  attributes,
+		Time:        time.Now().UTC(),
+	}
+	f.events = append(f.events, event)
+
+	for _, watcher := range append([]*fakeWatcher(nil), f.watchers...) {
+		if !watcher.matches(event) {
+			continue
+		}
+		select {
+		case watcher.events <- event:
+		default:
+			f.closeWatcher(watcher, fmt.Errorf("Event stream of a slow consumer is dropped"))
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types of the leases, sent by the Reaper.
+const (
+	EventExpiring = "expiring"
+	EventExpired  = "expired"
+)
+
+// lease limits the lifetime of a container, by a time to live, by an idle
+// timeout or both. The zero lease lets the container live forever.
+type lease struct {
+	// Deadline is the end of the time to live, zero if there is none.
+	Deadline    time.Time     `json:"deadline"`
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
+	LastActive  time.Time     `json:"lastActive"`
+}
+
+func newLease(spec ContainerSpec) lease {
+	now := time.Now().UTC()
+	l := lease{LastActive: now}
+	if ttl := spec.TTLDuration(); ttl > 0 {
+		l.Deadline = now.Add(ttl)
+	}
+	l.IdleTimeout = spec.IdleTimeoutDuration()
+	return l
+}
+
+// expires returns when the lease runs out, zero if it never does.
+func (l lease) expires() time.Time {
+	expires := l.Deadline
+	if l.IdleTimeout > 0 {
+		idle := l.LastActive.Add(l.IdleTimeout)
+		if expires.IsZero() || idle.Before(expires) {
+			expires = idle
+		}
+	}
+	return expires
+}
+
+// Touch records activity on the managed container id, which postpones the end
+// of its idle timeout. Unknown containers are ignored. It is called on every
+// proxied request, so the state file is only updated by the next change.
+func (m *Manager) Touch(id string) {
+	m.mutex.Lock()
+	managed, ok := m.containers[id]
+	if ok {
+		managed.lease.LastActive = time.Now().UTC()
+	}
+	m.mutex.Unlock()
+}
+
+// ExtendLease moves the end of the time to live of the managed container to ttl
+// from now, giving it one if it had none. It also counts as activity.
+func (m *Manager) ExtendLease(ctx context.Context, id string, ttl time.Duration) (*ContainerInfo, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("%w: the time to live must be positive", ErrInvalidSpec)
+	}
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if info.Deployment != "" || info.Stack != "" {
+		return nil, fmt.Errorf("%w: %s belongs to a deployment or a stack and has no lease", ErrInvalidSpec, info.ID)
+	}
+	now := time.Now().UTC()
+	m.mutex.Lock()
+	if managed, ok := m.containers[info.ID]; ok {
+		managed.lease.Deadline = now.Add(ttl)
+		managed.lease.LastActive = now
+	}
+	m.mutex.Unlock()
+	m.persist()
+	log.Printf("Lease of container %s is extended by %s", info.ID, ttl)
+	return m.Inspect(ctx, info.ID)
+}
+
+// expiries returns the end of the lease of every container having one.
+func (m *Manager) expiries() map[string]time.Time {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	expiries := make(map[string]time.Time)
+	for id, managed := range m.containers {
+		if expires := managed.lease.expires(); !expires.IsZero() {
+			expiries[id] = expires
+		}
+	}
+	return expiries
+}
+
+// ReaperConfig controls the Reaper. Zero values select the defaults.
+type ReaperConfig struct {
+	// Interval between two sweeps, 10s by default.
+	Interval time.Duration
+	// Warning is how long before the expiry the expiring event is sent, 1m by default.
+	Warning time.Duration
+}
+
+// Reaper stops and removes the containers whose lease ran out. Shortly before,
+// it logs a warning and publishes an expiring event, so webhooks can extend the lease.
+type Reaper struct {
+	manager *Manager
+	events  *EventWatcher
+	config  ReaperConfig
+	mutex   sync.Mutex
+	// warned holds the expiry each container was warned about.
+	warned map[string]time.Time
+}
+
+// NewReaper creates a Reaper for the containers of manager. The lease events are
+// published through events, if not nil.
+func NewReaper(manager *Manager, events *EventWatcher, config ReaperConfig) *Reaper {
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	if config.Warning <= 0 {
+		config.Warning = time.Minute
+	}
+	return &Reaper{
+		manager: manager,
+		events:  events,
+		config:  config,
+		warned:  make(map[string]time.Time),
+	}
+}
+
+// Run sweeps every interval until ctx is cancelled.
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		r.Sweep(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep warns about the leases about to run out and removes the expired containers.
+func (r *Reaper) Sweep(ctx context.Context) {
+	now := time.Now().UTC()
+	expiries := r.manager.expiries()
+
+	r.mutex.Lock()
+	for id := range r.warned {
+		if _, ok := expiries[id]; !ok {
+			delete(r.warned, id)
+		}
+	}
+	r.mutex.Unlock()
+
+	for id, expires := range expiries {
+		if !now.Before(expires) {
+			r.expire(ctx, id, expires)
+			continue
+		}
+		r.mutex.Lock()
+		warn := expires.Sub(now) <= r.config.Warning && !r.warned[id].Equal(expires)
+		if warn {
+			r.warned[id] = expires
+		}
+		r.mutex.Unlock()
+		if warn {
+			log.Printf("Lease of container %s runs out at %s", id, expires.Format(time.RFC3339))
+			r.publish(ctx, EventExpiring, id, expires)
+		}
+	}
+}
+
+// expire stops and removes the container, giving it the usual grace period.
+func (r *Reaper) expire(ctx context.Context, id string, expires time.Time) {
+	info, err := r.manager.Inspect(ctx, id)
+	if err != nil {
+		log.Printf("Failed to expire container %s: %s", id, err.Error())
+		return
+	}
+	if info.State == "running" {
+		if err := r.manager.rt.Stop(ctx, id, StopTimeout); err != nil {
+			log.Printf("Failed to stop expired container %s: %s", id, err.Error())
+		}
+	}
+	if _, err := r.manager.Remove(ctx, id); err != nil {
+		log.Printf("Failed to remove expired container %s: %s", id, err.Error())
+		return
+	}
+	log.Printf("Container %s is removed, its lease ran out", id)
+	r.mutex.Lock()
+	delete(r.warned, id)
+	r.mutex.Unlock()
+	if r.events != nil {
+		r.events.publish(leaseEvent(EventExpired, *info, expires))
+	}
+}
+
+func (r *Reaper) publish(ctx context.Context, eventType string, id string, expires time.Time) {
+	if r.events == nil {
+		return
+	}
+	info, err := r.manager.Inspect(ctx, id)
+	if err != nil {
+		return
+	}
+	r.events.publish(leaseEvent(eventType, *info, expires))
+}
+
+func leaseEvent(eventType string, info ContainerInfo, expires time.Time) Event {
+	return Event{
+		Type:        eventType,
+		ContainerID: info.ID,
+		Name:        info.Name,
+		Image:       info.Image,
+		Tenant:      info.Tenant,
+		Expires:     &expires,
+		Time:        time.Now().UTC(),
+	}
+}
@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Log stream names passed to the StreamLogs callback.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// lineWriter splits the written data into lines and hands them over to output.
+type lineWriter struct {
+	stream  string
+	pending []byte
+	output  func(stream string, line string) error
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.pending = append(l.pending, p...)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(bytes.TrimRight(l.pending[:i], "\r"))
+		l.pending = l.pending[i+1:]
+		if err := l.output(l.stream, line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (l *lineWriter) flush() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	line := string(l.pending)
+	l.pending = nil
+	return l.output(l.stream, line)
+}
+
+// StreamLogs reads the log of a managed container, demultiplexes the docker stdout
+// and stderr streams and calls output with every line. With options.Follow it
+// keeps streaming until ctx is cancelled or the container stops. An error returned
+// by output stops the streaming.
+func (m *Manager) StreamLogs(ctx context.Context, id string, options LogOptions, output func(stream string, line string) error) error {
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return err
+	}
+	logs, err := m.rt.Logs(ctx, info.ID, options)
+	if err != nil {
+		err = fmt.Errorf("Failed to read logs of %s: %s", info.ID, err.Error())
+		return err
+	}
+	defer logs.Close()
+
+	stdout := &lineWriter{stream: StreamStdout, output: output}
+	stderr := &lineWriter{stream: StreamStderr, output: output}
+	if _, err := stdcopy.StdCopy(stdout, stderr, logs); err != nil {
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			// The caller went away.
+			return nil
+		}
+		return err
+	}
+	if err := stdout.flush(); err != nil {
+		return err
+	}
+	return stderr.flush()
+}
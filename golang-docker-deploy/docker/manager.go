@@ -0,0 +1,251 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StopTimeout is the grace period given to a container before it is killed
+// on stop and restart.
+var StopTimeout = 5 * time.Second
+
+// ErrNotManaged is returned when the requested container exists but was not
+// started through the Manager.
+var ErrNotManaged = errors.New("Container is not managed by this service")
+
+// PortMapping describes a single published container port.
+type PortMapping struct {
+	ContainerPort string `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIp"`
+	HostPort      string `json:"hostPort"`
+}
+
+// ContainerInfo is the structured description of a managed container.
+type ContainerInfo struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Image      string            `json:"image"`
+	State      string            `json:"state"`
+	Ports      []PortMapping     `json:"ports"`
+	Created    time.Time         `json:"created"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Networks   []string          `json:"networks,omitempty"`
+	Deployment string            `json:"deployment,omitempty"`
+	Stack      string            `json:"stack,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	// Expires is when the lease of the container runs out, if it has one.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// managedContainer is the bookkeeping of a container started by the Manager.
+type managedContainer struct {
+	// config is the configuration the container was created from, without
+	// the allocated host ports, so an identical replacement can be created.
+	config     ContainerConfig
+	deployment string
+	// stack is the compose stack the container is a service of.
+	stack    string
+	specHash string
+	tenant   string
+	// retired is set on the old containers stopped by a rolling update until they
+	// are removed, they do not count against the tenant quota.
+	retired bool
+	lease   lease
+}
+
+// Manager keeps track of the containers started by the deploy service and
+// provides the lifecycle operations on them.
+type Manager struct {
+	rt          Runtime
+	ports       *PortAllocator
+	mutex       sync.RWMutex
+	containers  map[string]*managedContainer
+	deployments map[string]Deployment
+	stacks      map[string]Stack
+	orphans     []ContainerInfo
+	credentials map[string]RegistryCredentials
+	quotas      map[string]Quota
+	// createMutex makes the quota check and the creation of a container atomic.
+	createMutex sync.Mutex
+	// reconcileMutex serializes the deployment reconciliations.
+	reconcileMutex sync.Mutex
+	// stateFile is where the state is saved on every change, if set.
+	stateFile  string
+	stateMutex sync.Mutex
+}
+
+// NewManager creates a Manager on top of the container runtime rt.
+// Host ports of the new containers are handed out by ports.
+func NewManager(rt Runtime, ports *PortAllocator) *Manager {
+	return &Manager{
+		rt:          rt,
+		ports:       ports,
+		containers:  make(map[string]*managedContainer),
+		deployments: make(map[string]Deployment),
+		stacks:      make(map[string]Stack),
+	}
+}
+
+// track starts the bookkeeping of the container id. A newly tracked container
+// is never retired, it is only marked so by a rolling update later on.
+func (m *Manager) track(id string, managed *managedContainer) {
+	managed.retired = false
+	m.mutex.Lock()
+	m.containers[id] = managed
+	m.mutex.Unlock()
+	m.persist()
+}
+
+func (m *Manager) managed(id string) (managedContainer, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	managed, ok := m.containers[id]
+	if !ok {
+		return managedContainer{}, false
+	}
+	return *managed, true
+}
+
+// decorate adds the Manager bookkeeping to info.
+func (m *Manager) decorate(info *ContainerInfo) {
+	if managed, ok := m.managed(info.ID); ok {
+		info.Deployment = managed.deployment
+		info.Stack = managed.stack
+		if expires := managed.lease.expires(); !expires.IsZero() {
+			info.Expires = &expires
+		}
+		info.Tenant = managed.tenant
+	}
+}
+
+func (m *Manager) untrack(id string) {
+	m.mutex.Lock()
+	delete(m.containers, id)
+	m.mutex.Unlock()
+	m.ports.ReleaseContainer(id)
+	m.persist()
+}
+
+func (m *Manager) isTracked(id string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.containers[id]
+	return ok
+}
+
+func (m *Manager) trackedIDs() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ids := make([]string, 0, len(m.containers))
+	for id := range m.containers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// resolve looks up the container by ID, ID prefix or name and makes sure
+// it belongs to the Manager and to the tenant of ctx.
+func (m *Manager) resolve(ctx context.Context, id string) (ContainerInfo, error) {
+	info, err := m.rt.Inspect(ctx, id)
+	if err != nil {
+		return info, err
+	}
+	managed, ok := m.managed(info.ID)
+	if !ok || !visible(ctx, managed.tenant) {
+		return info, ErrNotManaged
+	}
+	m.decorate(&info)
+	return info, nil
+}
+
+// Ports returns the host port allocator of the Manager.
+func (m *Manager) Ports() *PortAllocator {
+	return m.ports
+}
+
+// List returns the managed containers of the tenant of ctx sorted by creation time.
+func (m *Manager) List(ctx context.Context) ([]ContainerInfo, error) {
+	list := make([]ContainerInfo, 0)
+	for _, id := range m.trackedIDs() {
+		if managed, ok := m.managed(id); !ok || !visible(ctx, managed.tenant) {
+			continue
+		}
+		info, err := m.rt.Inspect(ctx, id)
+		if IsNotFound(err) {
+			// Removed behind our back.
+			m.untrack(id)
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("Failed to inspect container %s: %s", id, err.Error())
+			return nil, err
+		}
+		m.decorate(&info)
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// Inspect returns the current state of a managed container.
+func (m *Manager) Inspect(ctx context.Context, id string) (*ContainerInfo, error) {
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Stop stops a managed container.
+func (m *Manager) Stop(ctx context.Context, id string) (*ContainerInfo, error) {
+	cont, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rt.Stop(ctx, cont.ID, StopTimeout); err != nil {
+		err = fmt.Errorf("Failed to stop container %s: %s", cont.ID, err.Error())
+		return nil, err
+	}
+	return m.Inspect(ctx, cont.ID)
+}
+
+// Restart restarts a managed container.
+func (m *Manager) Restart(ctx context.Context, id string) (*ContainerInfo, error) {
+	cont, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if cont.State == "running" {
+		if err := m.rt.Stop(ctx, cont.ID, StopTimeout); err != nil {
+			err = fmt.Errorf("Failed to restart container %s: %s", cont.ID, err.Error())
+			return nil, err
+		}
+	}
+	if err := m.rt.Start(ctx, cont.ID); err != nil {
+		err = fmt.Errorf("Failed to restart container %s: %s", cont.ID, err.Error())
+		return nil, err
+	}
+	return m.Inspect(ctx, cont.ID)
+}
+
+// Remove force removes a managed container and returns its last known state.
+func (m *Manager) Remove(ctx context.Context, id string) (*ContainerInfo, error) {
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rt.Remove(ctx, info.ID); err != nil {
+		err = fmt.Errorf("Failed to remove container %s: %s", info.ID, err.Error())
+		return nil, err
+	}
+	m.untrack(info.ID)
+	info.State = "removed"
+	return &info, nil
+}
@@ -0,0 +1,177 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func newTestManager(t *testing.T, portRange string) (*Manager, *FakeRuntime) {
+	t.Helper()
+	rt := NewFakeRuntime()
+	rt.AddImage("worker:1")
+	ports, err := ParsePortRange(portRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewManager(rt, ports), rt
+}
+
+func TestContainerLifecycle(t *testing.T) {
+	ctx := context.Background()
+	m, rt := newTestManager(t, "47000-47009")
+	info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1", Ports: []string{"8082"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State != "running" {
+		t.Fatalf("Created container is %s, want running", info.State)
+	}
+	id := info.ID
+
+	steps := []struct {
+		name   string
+		action func() (*ContainerInfo, error)
+		state  string
+		ports  int
+	}{
+		{"stop", func() (*ContainerInfo, error) { return m.Stop(ctx, id) }, "exited", 1},
+		{"stop again", func() (*ContainerInfo, error) { return m.Stop(ctx, id) }, "exited", 1},
+		{"restart", func() (*ContainerInfo, error) { return m.Restart(ctx, id) }, "running", 1},
+		{"restart running", func() (*ContainerInfo, error) { return m.Restart(ctx, id) }, "running", 1},
+		{"remove", func() (*ContainerInfo, error) { return m.Remove(ctx, id) }, "removed", 0},
+	}
+	for _, step := range steps {
+		info, err := step.action()
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err.Error())
+		}
+		if info.State != step.state {
+			t.Errorf("%s: container is %s, want %s", step.name, info.State, step.state)
+		}
+		if ports := m.Ports().PortsOf(id); len(ports) != step.ports {
+			t.Errorf("%s: container owns ports %v, want %d", step.name, ports, step.ports)
+		}
+	}
+
+	if _, err := m.Inspect(ctx, id); !errors.Is(err, ErrNotManaged) && !IsNotFound(err) {
+		t.Errorf("Inspect of the removed container returned %v", err)
+	}
+	if _, err := rt.Inspect(ctx, id); !IsNotFound(err) {
+		t.Errorf("Removed container is still known to the runtime: %v", err)
+	}
+	if _, err := m.Stop(ctx, id); err == nil {
+		t.Errorf("Stop of the removed container succeeded")
+	}
+}
+
+func TestPortAllocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		portRange string
+		ports     [][]string
+		err       error
+	}{
+		{"single port", "47010-47019", [][]string{{"8082"}}, nil},
+		{"several ports", "47010-47019", [][]string{{"8082", "9000/udp", "9001"}}, nil},
+		{"several containers", "47010-47019", [][]string{{"8082"}, {"8082"}, {"8082", "9000"}}, nil},
+		{"no ports", "47010-47019", [][]string{{}}, nil},
+		{"range exhausted", "47010-47011", [][]string{{"8082", "9000"}, {"8082"}}, ErrNoFreePort},
+		{"range too small", "47010-47011", [][]string{{"8082", "9000", "9001"}}, ErrNoFreePort},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			m, _ := newTestManager(t, test.portRange)
+			seen := make(map[string]bool)
+			ids := make([]string, 0, len(test.ports))
+			var err error
+			for _, ports := range test.ports {
+				var info *ContainerInfo
+				info, err = m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1", Ports: ports})
+				if err != nil {
+					break
+				}
+				ids = append(ids, info.ID)
+				owned := m.Ports().PortsOf(info.ID)
+				if len(info.Ports) != len(ports) || len(owned) != len(ports) {
+					t.Fatalf("Container publishes %v and owns %v, want %d ports", info.Ports, owned, len(ports))
+				}
+				for _, port := range info.Ports {
+					if seen[port.HostPort] {
+						t.Fatalf("Host port %s is handed out twice", port.HostPort)
+					}
+					seen[port.HostPort] = true
+					number, _ := strconv.Atoi(port.HostPort)
+					if owner, _ := m.Ports().Owner(number); owner != info.ID {
+						t.Errorf("Host port %s is owned by %q, want %s", port.HostPort, owner, info.ID)
+					}
+				}
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Create returned %v, want %v", err, test.err)
+			}
+			if len(m.Ports().Allocations()) != len(seen) {
+				t.Errorf("Allocations are %v, want only the published ports %v", m.Ports().Allocations(), seen)
+			}
+
+			for _, id := range ids {
+				if _, err := m.Remove(ctx, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if allocations := m.Ports().Allocations(); len(allocations) != 0 {
+				t.Errorf("Ports %v are not released", allocations)
+			}
+		})
+	}
+}
+
+func TestReconcileScale(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, "47020-47029")
+	steps := []struct {
+		replicas int
+		created  int
+		removed  int
+	}{
+		{replicas: 2, created: 2},
+		{replicas: 2},
+		{replicas: 5, created: 3},
+		{replicas: 1, removed: 4},
+		{replicas: 3, created: 2},
+		{replicas: 0, removed: 3},
+	}
+	for _, step := range steps {
+		deployment := Deployment{
+			Name:          "workers",
+			Replicas:      step.replicas,
+			ContainerSpec: ContainerSpec{Image: "worker:1", Ports: []string{"8082"}},
+		}
+		result, err := m.Apply(ctx, deployment)
+		if err != nil {
+			t.Fatalf("Scale to %d: %s", step.replicas, err.Error())
+		}
+		if len(result.Created) != step.created || len(result.Removed) != step.removed || len(result.Replaced) != 0 {
+			t.Errorf("Scale to %d: created %d, removed %d, replaced %d, want created %d, removed %d",
+				step.replicas, len(result.Created), len(result.Removed), len(result.Replaced), step.created, step.removed)
+		}
+
+		status, err := m.DeploymentStatus(ctx, "workers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(status.Containers) != step.replicas {
+			t.Errorf("Scale to %d: deployment has %d containers", step.replicas, len(status.Containers))
+		}
+		for _, info := range status.Containers {
+			if info.State != "running" {
+				t.Errorf("Scale to %d: replica %s is %s", step.replicas, info.ID, info.State)
+			}
+		}
+		if allocations := m.Ports().Allocations(); len(allocations) != step.replicas {
+			t.Errorf("Scale to %d: %d host ports are allocated", step.replicas, len(allocations))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// networkPrefix starts the names of the deployment networks.
+const networkPrefix = "golang-docker-deploy_"
+
+// DeploymentNetwork configures the network of a deployment. Every deployment gets
+// its own bridge network, so the workers of different deployments can not reach
+// each other. The replicas reach one another by the deployment name.
+type DeploymentNetwork struct {
+	// Internal cuts the network off the outside. The ports can not be published
+	// then, the workers are only reachable by the other replicas.
+	Internal bool `json:"internal,omitempty" yaml:"internal,omitempty"`
+	// Aliases are DNS names of the replicas in addition to the deployment name.
+	Aliases []string `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+}
+
+// validate checks the network settings of the deployment.
+func (n DeploymentNetwork) validate(spec ContainerSpec) error {
+	for _, alias := range n.Aliases {
+		if !deploymentNamePattern.MatchString(alias) {
+			return fmt.Errorf("Invalid network alias %q", alias)
+		}
+	}
+	if n.Internal && len(spec.Ports) > 0 {
+		return fmt.Errorf("Ports can not be published on an internal network")
+	}
+	return nil
+}
+
+// networkName returns the name of the deployment network. Internal networks are
+// named differently, so switching the setting moves the replicas to a new network.
+func (d Deployment) networkName() string {
+	if d.Network.Internal {
+		return networkPrefix + d.Name + "_internal"
+	}
+	return networkPrefix + d.Name
+}
+
+// containerConfig returns the replica configuration, attached to the deployment network
+// and with the volumes of the tenant.
+func (d Deployment) containerConfig() ContainerConfig {
+	config := d.ContainerSpec.containerConfig()
+	config.Mounts = scopeVolumes(d.Tenant, config.Mounts)
+	config.Network = d.networkName()
+	config.NetworkAliases = append([]string{d.Name}, d.Network.Aliases...)
+	return config
+}
+
+// networkLabels are the labels of the networks of the deployment.
+func (d Deployment) networkLabels() map[string]string {
+	return map[string]string{
+		LabelManaged:    "true",
+		LabelDeployment: d.Name,
+	}
+}
+
+// ensureNetwork creates the network of the deployment if it does not exist yet.
+func (m *Manager) ensureNetwork(ctx context.Context, deployment Deployment) error {
+	networks, err := m.rt.ListNetworks(ctx, deployment.networkLabels())
+	if err != nil {
+		return fmt.Errorf("Failed to list networks: %s", err.Error())
+	}
+	name := deployment.networkName()
+	for _, n := range networks {
+		if n.Name == name {
+			return nil
+		}
+	}
+	labels := deployment.networkLabels()
+	labels[LabelTenant] = deployment.Tenant
+	if _, err := m.rt.CreateNetwork(ctx, NetworkConfig{Name: name, Internal: deployment.Network.Internal, Labels: labels}); err != nil {
+		return fmt.Errorf("Failed to create network %s: %s", name, err.Error())
+	}
+	log.Printf("Network %s of deployment %s is created", name, deployment.Name)
+	return nil
+}
+
+// removeNetworks removes the networks of the named deployment except keep.
+func (m *Manager) removeNetworks(ctx context.Context, name string, keep string) error {
+	networks, err := m.rt.ListNetworks(ctx, Deployment{Name: name}.networkLabels())
+	if err != nil {
+		return fmt.Errorf("Failed to list networks: %s", err.Error())
+	}
+	for _, n := range networks {
+		if n.Name == keep {
+			continue
+		}
+		if err := m.rt.RemoveNetwork(ctx, n.ID); err != nil && !errors.Is(err, ErrNetworkNotFound) {
+			return fmt.Errorf("Failed to remove network %s: %s", n.Name, err.Error())
+		}
+		log.Printf("Network %s of deployment %s is removed", n.Name, name)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDeploymentNetwork(t *testing.T) {
+	ctx := context.Background()
+	m, rt := newTestManager(t, "47190-47199")
+	networks := func() []string {
+		list, err := rt.ListNetworks(ctx, map[string]string{LabelDeployment: "workers"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(list))
+		for _, network := range list {
+			names = append(names, network.Name)
+		}
+		return names
+	}
+	deployment := Deployment{Name: "workers", Replicas: 2, ContainerSpec: ContainerSpec{Image: "worker:1"}}
+	if _, err := m.Apply(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if names := networks(); len(names) != 1 || names[0] != networkPrefix+"workers" {
+		t.Fatalf("Deployment networks are %v", names)
+	}
+	status, err := m.DeploymentStatus(ctx, "workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range status.Containers {
+		managed, _ := m.managed(info.ID)
+		if managed.config.Network != networkPrefix+"workers" || managed.config.NetworkAliases[0] != "workers" {
+			t.Errorf("Replica %s is on %s as %v", info.ID, managed.config.Network, managed.config.NetworkAliases)
+		}
+	}
+
+	// Switching to an internal network moves the replicas and drops the old network.
+	deployment.Network = DeploymentNetwork{Internal: true, Aliases: []string{"jobs"}}
+	result, err := m.Apply(ctx, deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Replaced) != 2 {
+		t.Errorf("Network change replaced %d replicas, want 2", len(result.Replaced))
+	}
+	if names := networks(); len(names) != 1 || names[0] != networkPrefix+"workers_internal" {
+		t.Errorf("Deployment networks are %v after the switch", names)
+	}
+
+	if _, err := m.DeleteDeployment(ctx, "workers"); err != nil {
+		t.Fatal(err)
+	}
+	if names := networks(); len(names) != 0 {
+		t.Errorf("Networks %v are left after the deletion", names)
+	}
+}
+
+func TestDeploymentNetworkErrors(t *testing.T) {
+	m, rt := newTestManager(t, "47200-47209")
+	tests := []struct {
+		name    string
+		network DeploymentNetwork
+		ports   []string
+		err     string
+	}{
+		{"invalid alias", DeploymentNetwork{Aliases: []string{"no spaces"}}, nil, "Invalid network alias"},
+		{"published ports on an internal network", DeploymentNetwork{Internal: true}, []string{"8082"}, "can not be published"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployment := Deployment{Name: "workers", Replicas: 1, Network: test.network, ContainerSpec: ContainerSpec{Image: "worker:1", Ports: test.ports}}
+			if _, err := m.Apply(context.Background(), deployment); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Apply returned %v, want %q", err, test.err)
+			}
+			if list, _ := rt.ListNetworks(context.Background(), nil); len(list) != 0 {
+				t.Errorf("Invalid deployment created networks %v", list)
+			}
+		})
+	}
+}
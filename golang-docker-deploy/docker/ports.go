@@ -0,0 +1,173 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoFreePort is returned when every port of the allocator range is taken.
+var ErrNoFreePort = errors.New("No free host port left")
+
+// PortAllocator hands out host ports from a fixed range and remembers which
+// container owns which port.
+type PortAllocator struct {
+	mutex  sync.Mutex
+	first  int
+	last   int
+	next   int
+	owners map[int]string
+	// quarantined are the ports used outside of the deploy service, they are
+	// not handed out before the time they map to.
+	quarantined map[int]time.Time
+}
+
+// NewPortAllocator creates an allocator for the inclusive port range first-last.
+func NewPortAllocator(first int, last int) (*PortAllocator, error) {
+	if first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("Invalid port range %d-%d", first, last)
+	}
+	return &PortAllocator{
+		first:       first,
+		last:        last,
+		next:        first,
+		owners:      make(map[int]string),
+		quarantined: make(map[int]time.Time),
+	}, nil
+}
+
+// ParsePortRange parses a port range in the form "8082-8181".
+func ParsePortRange(portRange string) (*PortAllocator, error) {
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("Invalid port range %s", portRange)
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port range %s: %s", portRange, err.Error())
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port range %s: %s", portRange, err.Error())
+	}
+	return NewPortAllocator(first, last)
+}
+
+// Allocate reserves the next free port. The port has no owner until Assign is called,
+// but it is not handed out again until it is released.
+func (p *PortAllocator) Allocate() (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	size := p.last - p.first + 1
+	now := time.Now()
+	for i := 0; i < size; i++ {
+		port := p.next
+		p.next++
+		if p.next > p.last {
+			p.next = p.first
+		}
+		if until, ok := p.quarantined[port]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(p.quarantined, port)
+		}
+		if _, taken := p.owners[port]; !taken {
+			p.owners[port] = ""
+			return port, nil
+		}
+	}
+	return 0, ErrNoFreePort
+}
+
+// Assign records containerID as the owner of an allocated port.
+func (p *PortAllocator) Assign(port int, containerID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.owners[port] = containerID
+}
+
+// Reserve takes port away from Allocate, whether it is in the range or not, until it
+// is released. It returns false if the port is owned or quarantined.
+func (p *PortAllocator) Reserve(port int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, taken := p.owners[port]; taken {
+		return false
+	}
+	if until, ok := p.quarantined[port]; ok && time.Now().Before(until) {
+		return false
+	}
+	p.owners[port] = ""
+	return true
+}
+
+// Contains tells whether port is in the range of the allocator.
+func (p *PortAllocator) Contains(port int) bool {
+	return port >= p.first && port <= p.last
+}
+
+// Release frees a single port.
+func (p *PortAllocator) Release(port int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.owners, port)
+}
+
+// Quarantine frees port but keeps it from being handed out for d, it is used by
+// something outside of the deploy service which may let it go later.
+func (p *PortAllocator) Quarantine(port int, d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.owners, port)
+	p.quarantined[port] = time.Now().Add(d)
+}
+
+// ReleaseContainer frees every port owned by containerID.
+func (p *PortAllocator) ReleaseContainer(containerID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for port, owner := range p.owners {
+		if owner == containerID {
+			delete(p.owners, port)
+		}
+	}
+}
+
+// Owner returns the container owning port, if any.
+func (p *PortAllocator) Owner(port int) (string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	owner, ok := p.owners[port]
+	return owner, ok
+}
+
+// PortsOf returns the ports owned by containerID in ascending order.
+func (p *PortAllocator) PortsOf(containerID string) []int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ports := make([]int, 0)
+	for port, owner := range p.owners {
+		if owner == containerID {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// Allocations returns a copy of the port to owner container mapping.
+// Reserved ports without an owner have an empty container ID.
+func (p *PortAllocator) Allocations() map[int]string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	allocations := make(map[int]string, len(p.owners))
+	for port, owner := range p.owners {
+		allocations[port] = owner
+	}
+	return allocations
+}
@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPortQuarantine(t *testing.T) {
+	ports, err := NewPortAllocator(47030, 47031)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports.Quarantine(47030, 50*time.Millisecond)
+
+	port, err := ports.Allocate()
+	if err != nil || port != 47031 {
+		t.Fatalf("Allocate returned %d, %v, want the port outside of the quarantine", port, err)
+	}
+	if _, err := ports.Allocate(); !errors.Is(err, ErrNoFreePort) {
+		t.Fatalf("Allocate handed out a quarantined port: %v", err)
+	}
+	if _, ok := ports.Owner(47030); ok {
+		t.Errorf("Quarantined port has an owner")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if port, err := ports.Allocate(); err != nil || port != 47030 {
+		t.Fatalf("Allocate returned %d, %v after the quarantine, want 47030", port, err)
+	}
+}
+
+func TestPortConflict(t *testing.T) {
+	defer func(quarantine time.Duration) { portQuarantine = quarantine }(portQuarantine)
+	portQuarantine = 50 * time.Millisecond
+
+	ctx := context.Background()
+	m, rt := newTestManager(t, "47040-47042")
+	// Something outside of the deploy service binds the first port of the range.
+	outsider, err := rt.Create(ctx, ContainerConfig{Image: "worker:1", Ports: []PortMapping{{ContainerPort: "80", HostPort: "47040"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Start(ctx, outsider); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1", Ports: []string{"8082"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Ports[0].HostPort != "47041" {
+		t.Errorf("Container is published on %s, want the next port 47041", info.Ports[0].HostPort)
+	}
+	if allocations := m.Ports().Allocations(); len(allocations) != 1 || allocations[47041] != info.ID {
+		t.Errorf("Allocations are %v, want only 47041 owned by the container", allocations)
+	}
+
+	// The outsider goes away, the port comes back once the quarantine is over.
+	if err := rt.Remove(ctx, outsider); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Remove(ctx, info.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	published := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1", Ports: []string{"8082"}})
+		if err != nil {
+			t.Fatalf("Port range is not fully usable again: %s", err.Error())
+		}
+		published[info.Ports[0].HostPort] = true
+	}
+	if !published["47040"] {
+		t.Errorf("Port 47040 is not handed out again, got %v", published)
+	}
+}
@@ -0,0 +1,237 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Pull policies selectable per container spec and deployment.
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// defaultRegistry is the registry of the images without a registry host.
+const defaultRegistry = "docker.io"
+
+// RegistryCredentials are the credentials of a private registry.
+type RegistryCredentials struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// PullProgress is the progress of a single layer during an image pull.
+type PullProgress struct {
+	Image   string `json:"image"`
+	Layer   string `json:"layer,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+// String describes the progress of the layer, like "a1b2c3: Downloading 512/1024".
+func (p PullProgress) String() string {
+	message := p.Status
+	if p.Layer != "" {
+		message = p.Layer + ": " + message
+	}
+	if p.Total > 0 {
+		message = fmt.Sprintf("%s %d/%d", message, p.Current, p.Total)
+	}
+	return message
+}
+
+type pullProgressKey struct{}
+
+// WithPullProgress returns a context reporting the progress of the image pulls
+// done while creating or deploying containers to progress.
+func WithPullProgress(ctx context.Context, progress func(PullProgress)) context.Context {
+	return context.WithValue(ctx, pullProgressKey{}, progress)
+}
+
+// PullProgressFrom returns the pull progress callback of ctx, nil if there is none.
+func PullProgressFrom(ctx context.Context) func(PullProgress) {
+	progress, _ := ctx.Value(pullProgressKey{}).(func(PullProgress))
+	return progress
+}
+
+// normalizeImage adds the latest tag to image references without a tag or digest.
+func normalizeImage(image string) string {
+	if strings.Contains(image, "@") {
+		return image
+	}
+	name := image
+	if i := strings.LastIndexByte(image, '/'); i >= 0 {
+		name = image[i+1:]
+	}
+	if !strings.Contains(name, ":") {
+		return image + ":latest"
+	}
+	return image
+}
+
+// registryHost returns the registry an image reference points to.
+func registryHost(image string) string {
+	i := strings.IndexByte(image, '/')
+	if i < 0 {
+		return defaultRegistry
+	}
+	host := image[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return defaultRegistry
+}
+
+// LoadRegistryCredentials reads registry credentials from a docker config.json
+// style file: {"auths": {"registry.example.com": {"auth": "base64(user:password)"}}}.
+// username and password may be given instead of auth.
+func LoadRegistryCredentials(fileName string) (map[string]RegistryCredentials, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(fileName))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read registry auth file: %s", err.Error())
+	}
+	config := struct {
+		Auths map[string]struct {
+			RegistryCredentials
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed to decode registry auth file: %s", err.Error())
+	}
+
+	credentials := make(map[string]RegistryCredentials, len(config.Auths))
+	for host, auth := range config.Auths {
+		creds := auth.RegistryCredentials
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid auth of registry %s", host)
+			}
+			userPassword := strings.SplitN(string(decoded), ":", 2)
+			if len(userPassword) != 2 {
+				return nil, fmt.Errorf("Invalid auth of registry %s", host)
+			}
+			creds.Username = userPassword[0]
+			creds.Password = userPassword[1]
+		}
+		if creds.ServerAddress == "" {
+			creds.ServerAddress = host
+		}
+		// Keys like https://index.docker.io/v1/ are accepted as well.
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		host = strings.SplitN(host, "/", 2)[0]
+		if host == "index.docker.io" || host == "registry-1.docker.io" {
+			host = defaultRegistry
+		}
+		credentials[host] = creds
+	}
+	return credentials, nil
+}
+
+// SetRegistryCredentials sets the credentials used to pull from private registries,
+// keyed by registry host.
+func (m *Manager) SetRegistryCredentials(credentials map[string]RegistryCredentials) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.credentials = credentials
+}
+
+func (m *Manager) credentialsFor(image string) *RegistryCredentials {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	creds, ok := m.credentials[registryHost(image)]
+	if !ok {
+		return nil
+	}
+	return &creds
+}
+
+// PullImage pulls image and reports the progress of each layer to progress, which may be nil.
+func (m *Manager) PullImage(ctx context.Context, image string, progress func(PullProgress)) error {
+	image = normalizeImage(image)
+	stream, err := m.rt.Pull(ctx, image, m.credentialsFor(image))
+	if err != nil {
+		err = fmt.Errorf("Failed to pull image %s: %s", image, err.Error())
+		return err
+	}
+	defer stream.Close()
+
+	decoder := json.NewDecoder(stream)
+	for {
+		msg := jsonMessage{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read pull output: %s", err.Error())
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return fmt.Errorf("Failed to pull image %s: %s", image, msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("Failed to pull image %s: %s", image, msg.Error)
+		}
+		if progress != nil {
+			report := PullProgress{
+				Image:  image,
+				Layer:  msg.ID,
+				Status: msg.Status,
+			}
+			if msg.ProgressDetail != nil {
+				report.Current = msg.ProgressDetail.Current
+				report.Total = msg.ProgressDetail.Total
+			}
+			progress(report)
+		}
+	}
+	log.Printf("Image %s is pulled", image)
+	return nil
+}
+
+// ensureImage makes sure image is available locally according to the pull policy.
+// The pull progress goes to the callback of ctx, if any.
+func (m *Manager) ensureImage(ctx context.Context, image string, policy string) error {
+	progress := PullProgressFrom(ctx)
+	switch policy {
+	case PullAlways:
+		return m.PullImage(ctx, image, progress)
+	case PullNever:
+		exists, err := m.rt.ImageExists(ctx, normalizeImage(image))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("Image %s is not present and the pull policy is never", image)
+		}
+		return nil
+	default:
+		exists, err := m.rt.ImageExists(ctx, normalizeImage(image))
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		return m.PullImage(ctx, image, progress)
+	}
+}
+
+func validatePullPolicy(policy string) error {
+	switch policy {
+	case "", PullAlways, PullIfNotPresent, PullNever:
+		return nil
+	}
+	return errors.New("Invalid pull policy " + policy)
+}
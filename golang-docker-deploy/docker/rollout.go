@@ -0,0 +1,367 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRolloutInProgress is returned when a rolling update is started while another one runs.
+var ErrRolloutInProgress = errors.New("A rolling update is already in progress")
+
+const (
+	// defaultRolloutHealthTimeout is how long a new worker may take to become healthy.
+	defaultRolloutHealthTimeout = time.Minute
+	// rolloutPollInterval is the time between two probes of a new worker.
+	rolloutPollInterval = time.Second
+)
+
+// Rolling update progress actions.
+const (
+	RolloutPulling    = "pulling"
+	RolloutStarted    = "started"
+	RolloutHealthy    = "healthy"
+	RolloutUnhealthy  = "unhealthy"
+	RolloutStopped    = "stopped"
+	RolloutRemoved    = "removed"
+	RolloutRestored   = "restored"
+	RolloutRolledBack = "rolled_back"
+	RolloutDone       = "done"
+)
+
+// RolloutOptions describes a rolling update.
+type RolloutOptions struct {
+	// Image is the new image of the workers.
+	Image string `json:"image"`
+	// Deployment limits the update to the named deployment and changes the image in its
+	// spec. Without it the workers outside of deployments running another tag of the
+	// image repository are updated.
+	Deployment string `json:"deployment,omitempty"`
+	// BatchSize is the number of workers replaced at once, 1 if not set.
+	BatchSize  int    `json:"batchSize,omitempty"`
+	PullPolicy string `json:"pullPolicy,omitempty"`
+	// HealthTimeout is how long a new worker may take to pass the health check.
+	HealthTimeout time.Duration `json:"-"`
+}
+
+// RolloutEvent reports the progress of a rolling update.
+type RolloutEvent struct {
+	Batch       int    `json:"batch"`
+	Action      string `json:"action"`
+	ContainerID string `json:"containerId,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// RolloutResult is the outcome of a rolling update.
+type RolloutResult struct {
+	Image string `json:"image"`
+	// Replaced maps the old containers to their replacements.
+	Replaced   map[string]string `json:"replaced"`
+	RolledBack bool              `json:"rolledBack,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// imageRepository returns the image reference without tag or digest.
+func imageRepository(image string) string {
+	if i := strings.IndexByte(image, '@'); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndexByte(image, ':'); i > strings.LastIndexByte(image, '/') {
+		image = image[:i]
+	}
+	return image
+}
+
+// rollout is the state of a running rolling update.
+type rollout struct {
+	options  RolloutOptions
+	progress func(RolloutEvent)
+	result   RolloutResult
+	// created are the new containers, stopped the old containers stopped so far
+	// and running the old containers which were running before the update.
+	created []string
+	stopped []string
+	running map[string]bool
+}
+
+func (r *rollout) report(batch int, action string, id string, message string) {
+	log.Printf("Rolling update to %s, batch %d: %s %s %s", r.options.Image, batch, action, id, message)
+	if r.progress != nil {
+		r.progress(RolloutEvent{Batch: batch, Action: action, ContainerID: id, Message: message})
+	}
+}
+
+// RollingUpdate replaces the workers by workers running options.Image, options.BatchSize
+// at a time. The old workers of a batch are only stopped when all the new ones pass the
+// health check, they are removed once the whole update succeeded. If a new worker fails,
+// every new worker is removed and the old ones are started again. progress is optional
+// and called with every step.
+func (s *Supervisor) RollingUpdate(ctx context.Context, options RolloutOptions, progress func(RolloutEvent)) (RolloutResult, error) {
+	if options.Image == "" {
+		return RolloutResult{}, fmt.Errorf("%w: missing image", ErrInvalidSpec)
+	}
+	if options.BatchSize < 0 {
+		return RolloutResult{}, fmt.Errorf("%w: negative batch size", ErrInvalidSpec)
+	}
+	if options.BatchSize == 0 {
+		options.BatchSize = 1
+	}
+	if options.HealthTimeout <= 0 {
+		options.HealthTimeout = defaultRolloutHealthTimeout
+	}
+	if err := validatePullPolicy(options.PullPolicy); err != nil {
+		return RolloutResult{}, fmt.Errorf("%w: %s", ErrInvalidSpec, err.Error())
+	}
+
+	s.mutex.Lock()
+	if s.rollingOut != nil {
+		s.mutex.Unlock()
+		return RolloutResult{}, ErrRolloutInProgress
+	}
+	s.rollingOut = make(map[string]bool)
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.rollingOut = nil
+		s.mutex.Unlock()
+	}()
+
+	m := s.manager
+	r := &rollout{
+		options:  options,
+		progress: progress,
+		result:   RolloutResult{Image: options.Image, Replaced: make(map[string]string)},
+		running:  make(map[string]bool),
+	}
+
+	var deployment Deployment
+	if options.Deployment != "" {
+		// The reconciler would replace the new workers, they do not match the stored spec yet.
+		m.reconcileMutex.Lock()
+		defer m.reconcileMutex.Unlock()
+		var err error
+		if deployment, err = m.Deployment(ctx, options.Deployment); err != nil {
+			return r.result, err
+		}
+		deployment.Image = options.Image
+		if err := deployment.Validate(); err != nil {
+			return r.result, fmt.Errorf("%w: %s", ErrInvalidSpec, err.Error())
+		}
+		if err := m.ensureNetwork(ctx, deployment); err != nil {
+			return r.result, err
+		}
+	}
+	pullCtx := ctx
+	if progress != nil {
+		// The layers are reported as they come, without the log line of every step.
+		pullCtx = WithPullProgress(ctx, func(pull PullProgress) {
+			progress(RolloutEvent{Action: RolloutPulling, Message: pull.String()})
+		})
+	}
+	if err := m.ensureImage(pullCtx, options.Image, options.PullPolicy); err != nil {
+		return r.result, err
+	}
+
+	targets, err := s.rolloutTargets(ctx, options)
+	if err != nil {
+		return r.result, err
+	}
+	s.mutex.Lock()
+	for _, info := range targets {
+		s.rollingOut[info.ID] = true
+		r.running[info.ID] = info.State == "running"
+	}
+	s.mutex.Unlock()
+
+	for start := 0; start < len(targets); start += options.BatchSize {
+		end := start + options.BatchSize
+		if end > len(targets) {
+			end = len(targets)
+		}
+		batch := start/options.BatchSize + 1
+		if err := s.rolloutBatch(ctx, r, batch, targets[start:end], deployment); err != nil {
+			s.rollback(r, batch)
+			r.result.RolledBack = true
+			r.result.Replaced = make(map[string]string)
+			r.result.Error = err.Error()
+			return r.result, fmt.Errorf("Rolling update to %s failed in batch %d: %s", options.Image, batch, err.Error())
+		}
+	}
+
+	for _, id := range r.stopped {
+		if _, err := m.Remove(ctx, id); err != nil {
+			log.Printf("Failed to remove replaced container %s: %s", id, err.Error())
+			continue
+		}
+		r.report(0, RolloutRemoved, id, "")
+	}
+	if options.Deployment != "" {
+		m.mutex.Lock()
+		m.deployments[deployment.Name] = deployment
+		m.mutex.Unlock()
+		m.persist()
+	}
+	r.report(0, RolloutDone, "", fmt.Sprintf("%d workers updated", len(r.result.Replaced)))
+	return r.result, nil
+}
+
+// rolloutTargets returns the workers to update.
+func (s *Supervisor) rolloutTargets(ctx context.Context, options RolloutOptions) ([]ContainerInfo, error) {
+	list, err := s.manager.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]ContainerInfo, 0, len(list))
+	for _, info := range list {
+		if info.Stack != "" {
+			continue
+		}
+		if options.Deployment != "" {
+			if info.Deployment == options.Deployment && normalizeImage(info.Image) != normalizeImage(options.Image) {
+				targets = append(targets, info)
+			}
+			continue
+		}
+		if info.Deployment == "" && imageRepository(info.Image) == imageRepository(options.Image) &&
+			normalizeImage(info.Image) != normalizeImage(options.Image) {
+			targets = append(targets, info)
+		}
+	}
+	return targets, nil
+}
+
+// rolloutBatch starts the replacements of the old workers, waits for them to become
+// healthy and stops the old ones.
+func (s *Supervisor) rolloutBatch(ctx context.Context, r *rollout, batch int, old []ContainerInfo, deployment Deployment) error {
+	m := s.manager
+	// A replacement takes over the quota of its old worker, the other old workers of
+	// the batch still run and count, so a batch needs headroom for all but one of them.
+	created := make([]string, 0, len(old))
+	for _, info := range old {
+		managed, ok := m.managed(info.ID)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNotManaged, info.ID)
+		}
+		managed.config.Image = r.options.Image
+		if deployment.Name != "" {
+			managed.config = deployment.containerConfig()
+			managed.specHash = deployment.specHash()
+		}
+		replacement, err := m.startContainer(ctx, &managed, info.ID)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.rollingOut[replacement.ID] = true
+		s.mutex.Unlock()
+		r.created = append(r.created, replacement.ID)
+		created = append(created, replacement.ID)
+		r.result.Replaced[info.ID] = replacement.ID
+		r.report(batch, RolloutStarted, replacement.ID, "replaces "+info.ID)
+	}
+
+	errs := make([]error, len(created))
+	var wg sync.WaitGroup
+	for i, id := range created {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = s.waitHealthy(ctx, id, r.options.HealthTimeout)
+		}(i, id)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			r.report(batch, RolloutUnhealthy, created[i], err.Error())
+			return fmt.Errorf("Worker %s is unhealthy: %s", created[i], err.Error())
+		}
+		r.report(batch, RolloutHealthy, created[i], "")
+	}
+
+	for _, info := range old {
+		r.stopped = append(r.stopped, info.ID)
+		if r.running[info.ID] {
+			if err := m.rt.Stop(ctx, info.ID, StopTimeout); err != nil {
+				return fmt.Errorf("Failed to stop %s: %s", info.ID, err.Error())
+			}
+			r.report(batch, RolloutStopped, info.ID, "")
+		}
+		// Stopped until it is removed at the end, its replacement has its quota.
+		m.setRetired(info.ID, true)
+	}
+
+	// The new workers are supervised from now on.
+	s.mutex.Lock()
+	for _, id := range created {
+		delete(s.rollingOut, id)
+	}
+	s.mutex.Unlock()
+	return nil
+}
+
+// rollback removes the new workers and starts the stopped old ones again.
+func (s *Supervisor) rollback(r *rollout, batch int) {
+	// The rollback runs to the end, even if the update was cancelled.
+	ctx := context.Background()
+	m := s.manager
+	for _, id := range r.created {
+		if _, err := m.Remove(ctx, id); err != nil && !IsNotFound(err) {
+			log.Printf("Failed to remove container %s during rollback: %s", id, err.Error())
+			continue
+		}
+		r.report(batch, RolloutRemoved, id, "")
+	}
+	for id := range r.running {
+		m.setRetired(id, false)
+	}
+	for _, id := range r.stopped {
+		if !r.running[id] {
+			continue
+		}
+		if err := m.rt.Start(ctx, id); err != nil {
+			log.Printf("Failed to start container %s during rollback: %s", id, err.Error())
+			continue
+		}
+		r.report(batch, RolloutRestored, id, "")
+	}
+	r.report(batch, RolloutRolledBack, "", "")
+}
+
+// waitHealthy probes the worker until it passes the health check or timeout expires.
+func (s *Supervisor) waitHealthy(ctx context.Context, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := s.manager.rt.Inspect(ctx, id)
+		if err != nil {
+			return err
+		}
+		if info.State != "running" {
+			return fmt.Errorf("Container is %s", info.State)
+		}
+		err = s.check(ctx, info)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Not healthy after %s: %s", timeout, err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(rolloutPollInterval):
+		}
+	}
+}
+
+// setRetired marks the managed container as stopped and replaced by a rolling update.
+func (m *Manager) setRetired(id string, retired bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if managed, ok := m.containers[id]; ok {
+		managed.retired = retired
+	}
+}
@@ -0,0 +1,144 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRollingUpdate(t *testing.T) {
+	ctx := context.Background()
+	m, rt := newTestManager(t, "47150-47159")
+	rt.AddImage("worker:2")
+	s := NewSupervisor(m, SupervisorConfig{})
+	deployment := Deployment{Name: "workers", Replicas: 3, ContainerSpec: ContainerSpec{Image: "worker:1", Ports: []string{"8082"}}}
+	if _, err := m.Apply(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := make(map[string]int)
+	result, err := s.RollingUpdate(ctx, RolloutOptions{Image: "worker:2", Deployment: "workers", BatchSize: 2}, func(event RolloutEvent) {
+		actions[event.Action]++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Replaced) != 3 || actions[RolloutStarted] != 3 || actions[RolloutRemoved] != 3 || actions[RolloutDone] != 1 {
+		t.Errorf("Rolling update replaced %v with the steps %v", result.Replaced, actions)
+	}
+	status, err := m.DeploymentStatus(ctx, "workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Image != "worker:2" || len(status.Containers) != 3 {
+		t.Fatalf("Deployment runs %s in %d containers, want worker:2 in 3", status.Image, len(status.Containers))
+	}
+	for _, info := range status.Containers {
+		if info.Image != "worker:2" || info.State != "running" {
+			t.Errorf("Container %s runs %s and is %s", info.ID, info.Image, info.State)
+		}
+	}
+	if allocations := m.Ports().Allocations(); len(allocations) != 3 {
+		t.Errorf("Allocations are %v, want the ports of the 3 new workers", allocations)
+	}
+}
+
+func TestRollingUpdateRollback(t *testing.T) {
+	ctx := context.Background()
+	m, rt := newTestManager(t, "47160-47169")
+	rt.AddImage("worker:2")
+	s := NewSupervisor(m, SupervisorConfig{Timeout: 100 * time.Millisecond})
+	// Nothing answers the probe of the new workers.
+	spec := ContainerSpec{Image: "worker:1", Ports: []string{"8082"}, Probe: &Probe{}}
+	old, err := m.CreateNewContainer(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.RollingUpdate(ctx, RolloutOptions{Image: "worker:2", HealthTimeout: time.Millisecond}, nil)
+	if err == nil || !result.RolledBack || len(result.Replaced) != 0 {
+		t.Fatalf("Rolling update returned %+v, %v, want a rollback", result, err)
+	}
+	list, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != old.ID || list[0].State != "running" {
+		t.Errorf("Containers after the rollback are %v, want only the old one running", list)
+	}
+	if allocations := m.Ports().Allocations(); len(allocations) != 1 {
+		t.Errorf("Allocations are %v, want the port of the old worker", allocations)
+	}
+}
+
+func TestRollingUpdateErrors(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, "47170-47179")
+	s := NewSupervisor(m, SupervisorConfig{})
+	tests := []struct {
+		name    string
+		options RolloutOptions
+		err     error
+	}{
+		{"no image", RolloutOptions{}, ErrInvalidSpec},
+		{"negative batch size", RolloutOptions{Image: "worker:2", BatchSize: -1}, ErrInvalidSpec},
+		{"invalid pull policy", RolloutOptions{Image: "worker:2", PullPolicy: "sometimes"}, ErrInvalidSpec},
+		{"unknown deployment", RolloutOptions{Image: "worker:2", Deployment: "workers"}, ErrDeploymentNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := s.RollingUpdate(ctx, test.options, nil); !errors.Is(err, test.err) {
+				t.Fatalf("Rolling update returned %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRollingUpdateQuota(t *testing.T) {
+	tests := []struct {
+		name       string
+		quota      int
+		batchSize  int
+		rolledBack bool
+	}{
+		{"one at a time at the quota", 2, 1, false},
+		{"batch with headroom", 3, 2, false},
+		{"batch without headroom", 2, 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := WithTenant(context.Background(), "team")
+			m, rt := newTestManager(t, "47240-47249")
+			rt.AddImage("worker:2")
+			m.SetQuotas(map[string]Quota{"team": {Containers: test.quota}})
+			s := NewSupervisor(m, SupervisorConfig{})
+			deployment := Deployment{Name: "workers", Replicas: 2, ContainerSpec: ContainerSpec{Image: "worker:1"}}
+			if _, err := m.Apply(ctx, deployment); err != nil {
+				t.Fatal(err)
+			}
+
+			// The old workers still running count, nothing else fits in the meantime.
+			sneaked := 0
+			options := RolloutOptions{Image: "worker:2", Deployment: "workers", BatchSize: test.batchSize}
+			result, err := s.RollingUpdate(ctx, options, func(event RolloutEvent) {
+				if event.Action != RolloutStarted {
+					return
+				}
+				if _, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1"}); err == nil {
+					sneaked++
+				}
+			})
+			if result.RolledBack != test.rolledBack || (err != nil) != test.rolledBack {
+				t.Fatalf("Rolling update returned %+v, %v", result, err)
+			}
+			usage := m.Usage("team")
+			if usage.Containers > test.quota {
+				t.Errorf("Tenant runs %d containers after the update, quota is %d", usage.Containers, test.quota)
+			}
+			if sneaked != 0 {
+				t.Errorf("%d containers were created during the update beyond the quota", sneaked)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNotFound is returned by a Runtime when the requested container does not exist.
+var ErrNotFound = errors.New("No such container")
+
+// ErrNetworkNotFound is returned by a Runtime when the requested network does not exist.
+var ErrNetworkNotFound = errors.New("No such network")
+
+// ErrPathNotFound is returned by a Runtime when the requested path does not exist in the container.
+var ErrPathNotFound = errors.New("No such path in container")
+
+// ErrImageInUse is returned by a Runtime when an image to remove is used by a container.
+var ErrImageInUse = errors.New("Image is in use")
+
+// PathStat describes a file or directory of a container.
+type PathStat struct {
+	Name  string      `json:"name"`
+	Size  int64       `json:"size"`
+	Mode  os.FileMode `json:"mode"`
+	Mtime time.Time   `json:"mtime"`
+	// LinkTarget is the absolute path a symlink points to.
+	LinkTarget string `json:"linkTarget,omitempty"`
+}
+
+// ContainerConfig describes the container to be created by a Runtime.
+type ContainerConfig struct {
+	Name           string            `json:"name,omitempty"`
+	Image          string            `json:"image"`
+	Cmd            []string          `json:"cmd,omitempty"`
+	Env            []string          `json:"env,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Ports          []PortMapping     `json:"ports,omitempty"`
+	Mounts         []Mount           `json:"mounts,omitempty"`
+	NanoCPUs       int64             `json:"nanoCpus,omitempty"`
+	Memory         int64             `json:"memory,omitempty"`
+	RestartPolicy  string            `json:"restartPolicy,omitempty"`
+	RestartRetries int               `json:"restartRetries,omitempty"`
+	// Network is the user-defined network the container is attached to instead
+	// of the default bridge, NetworkAliases are its DNS names on that network.
+	Network        string   `json:"network,omitempty"`
+	NetworkAliases []string `json:"networkAliases,omitempty"`
+	// ExtraNetworks are further networks the container is connected to, with
+	// the DNS names of the container on each.
+	ExtraNetworks map[string][]string `json:"extraNetworks,omitempty"`
+	// Probe is the health check of the Supervisor, it is not passed to docker.
+	Probe *Probe `json:"probe,omitempty"`
+}
+
+// NetworkConfig describes the bridge network to be created by a Runtime.
+type NetworkConfig struct {
+	Name string
+	// Internal networks have no outside connectivity.
+	Internal bool
+	Labels   map[string]string
+}
+
+// NetworkInfo is the state of a network.
+type NetworkInfo struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Internal bool              `json:"internal"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// LogOptions controls which part of the container log is returned.
+type LogOptions struct {
+	Follow     bool
+	Since      string
+	Tail       string
+	Timestamps bool
+}
+
+// BuildOptions are the parameters of an image build.
+type BuildOptions struct {
+	Tags       []string          `json:"tags"`
+	BuildArgs  map[string]string `json:"buildArgs"`
+	Dockerfile string            `json:"dockerfile"`
+	NoCache    bool              `json:"noCache"`
+}
+
+// ImageInfo is the state of a local image.
+type ImageInfo struct {
+	ID      string
+	Tags    []string
+	Labels  map[string]string
+	Author  string
+	Comment string
+	Created time.Time
+	Size    int64
+}
+
+// CommitConfig describes the image committed from a container by a Runtime.
+type CommitConfig struct {
+	// Reference is the repository and tag of the image.
+	Reference string
+	Author    string
+	Comment   string
+	// Changes are Dockerfile instructions applied to the image configuration.
+	Changes []string
+}
+
+// ExecConfig describes a command run inside a running container.
+type ExecConfig struct {
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+	// Tty allocates a terminal, the output is not multiplexed then.
+	Tty   bool
+	Stdin bool
+}
+
+// ExecConn is the attached connection of an exec process. Reading returns the
+// output in the docker multiplexed stream format, or the raw terminal output
+// with a tty. Writing feeds the standard input.
+type ExecConn interface {
+	io.ReadWriteCloser
+	// CloseWrite closes the standard input of the process.
+	CloseWrite() error
+}
+
+// RuntimeEvent is a raw container event reported by a Runtime.
+type RuntimeEvent struct {
+	Action      string
+	ContainerID string
+	Attributes  map[string]string
+	Time        time.Time
+}
+
+// Runtime is the container backend used by the Manager.
+// The docker implementation talks to the docker daemon, the fake one
+// keeps everything in memory and is meant for testing the deployment logic.
+type Runtime interface {
+	// Create creates the container and returns its ID. The container is not started.
+	Create(ctx context.Context, config ContainerConfig) (string, error)
+	// Start starts a created or stopped container.
+	Start(ctx context.Context, id string) error
+	// Stop stops a running container, killing it after timeout.
+	Stop(ctx context.Context, id string, timeout time.Duration) error
+	// Remove removes the container, stopping it first if needed.
+	Remove(ctx context.Context, id string) error
+	// Inspect returns the current state of the container. id may also be
+	// an ID prefix or the container name.
+	Inspect(ctx context.Context, id string) (ContainerInfo, error)
+	// List returns every container, running or not, having all the given labels.
+	List(ctx context.Context, labels map[string]string) ([]ContainerInfo, error)
+	// Logs returns the container output in the docker multiplexed stream format.
+	Logs(ctx context.Context, id string, options LogOptions) (io.ReadCloser, error)
+	// Build builds an image from the tar archive buildContext and returns the
+	// build output as a stream of docker JSON messages.
+	Build(ctx context.Context, buildContext io.Reader, options BuildOptions) (io.ReadCloser, error)
+	// Events streams the container events starting at since, limited to the
+	// containers having all the given labels. The error channel reports the
+	// end of the stream.
+	Events(ctx context.Context, since time.Time, labels map[string]string) (<-chan RuntimeEvent, <-chan error)
+	// ImageExists tells whether the image is present locally.
+	ImageExists(ctx context.Context, image string) (bool, error)
+	// Pull pulls the image, using credentials if not nil, and returns the pull
+	// progress as a stream of docker JSON messages.
+	Pull(ctx context.Context, image string, credentials *RegistryCredentials) (io.ReadCloser, error)
+	// ExecStart starts a command in the running container and returns the ID of
+	// the exec process and its attached connection.
+	ExecStart(ctx context.Context, id string, config ExecConfig) (string, ExecConn, error)
+	// ExecInspect tells whether the exec process is still running and its exit code.
+	ExecInspect(ctx context.Context, execID string) (bool, int, error)
+	// CreateNetwork creates the bridge network and returns its ID.
+	CreateNetwork(ctx context.Context, config NetworkConfig) (string, error)
+	// ListNetworks returns the networks having all the given labels.
+	ListNetworks(ctx context.Context, labels map[string]string) ([]NetworkInfo, error)
+	// RemoveNetwork removes the network, it fails while containers are running on it.
+	RemoveNetwork(ctx context.Context, id string) error
+	// RemoveVolume removes the named volume, a missing volume is not an error.
+	RemoveVolume(ctx context.Context, name string) error
+	// Stats samples the resource usage of the running container.
+	Stats(ctx context.Context, id string) (ContainerStats, error)
+	// CopyTo extracts the tar archive content into the existing directory dstPath
+	// of the container. A directory is never replaced by a file or the other way round.
+	CopyTo(ctx context.Context, id string, dstPath string, content io.Reader) error
+	// CopyFrom returns srcPath of the container as a tar archive, the entries
+	// are named after the base name of srcPath, along with the stat of srcPath.
+	// A symlink is not followed.
+	CopyFrom(ctx context.Context, id string, srcPath string) (io.ReadCloser, PathStat, error)
+	// Commit creates an image from the container, which is paused meanwhile,
+	// and returns the image ID. The image keeps the labels of the container.
+	Commit(ctx context.Context, id string, config CommitConfig) (string, error)
+	// Export returns the filesystem of the container as a tar archive.
+	Export(ctx context.Context, id string) (io.ReadCloser, error)
+	// ListImages returns the images having all the given labels, an empty value
+	// matches any value of the label.
+	ListImages(ctx context.Context, labels map[string]string) ([]ImageInfo, error)
+	// RemoveImage removes the image with all its tags.
+	RemoveImage(ctx context.Context, id string) error
+}
+
+// IsNotFound tells whether err means that the container does not exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
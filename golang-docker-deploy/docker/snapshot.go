@@ -0,0 +1,248 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LabelSnapshot is put on the snapshot images, it holds the ID of the container
+// the snapshot was committed from.
+const LabelSnapshot = "golang-docker-deploy.snapshot"
+
+// SnapshotRepository is the repository the snapshot references must be in, so a
+// snapshot never replaces the image of a deployment.
+var SnapshotRepository = "snapshots"
+
+// ErrSnapshotNotFound is returned when the requested snapshot does not exist.
+var ErrSnapshotNotFound = errors.New("No such snapshot")
+
+// imageReferencePattern matches name[:tag], the name being made of lowercase
+// path components.
+var imageReferencePattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*(:[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?$`)
+
+// commitInstructions are the Dockerfile instructions allowed in the commit changes.
+var commitInstructions = map[string]bool{
+	"CMD":        true,
+	"ENTRYPOINT": true,
+	"ENV":        true,
+	"EXPOSE":     true,
+	"LABEL":      true,
+	"ONBUILD":    true,
+	"USER":       true,
+	"VOLUME":     true,
+	"WORKDIR":    true,
+}
+
+// CommitOptions describes the snapshot of a container.
+type CommitOptions struct {
+	// Reference is the repository and tag of the snapshot, like snapshots/worker:bug-42.
+	Reference string `json:"reference"`
+	Author    string `json:"author,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// Changes are Dockerfile instructions applied to the image configuration,
+	// like "ENV DEBUG=1" or "CMD [\"sleep\", \"infinity\"]".
+	Changes []string `json:"changes,omitempty"`
+}
+
+// Snapshot is an image committed from a managed container.
+type Snapshot struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags"`
+	// Container is the ID of the container the snapshot was committed from.
+	Container string    `json:"container"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Created   time.Time `json:"created"`
+	Size      int64     `json:"size"`
+}
+
+// validate checks the commit options.
+func (o CommitOptions) validate() error {
+	if !imageReferencePattern.MatchString(o.Reference) {
+		return fmt.Errorf("%w: invalid reference %q", ErrInvalidSpec, o.Reference)
+	}
+	if !strings.HasPrefix(o.Reference, SnapshotRepository+"/") {
+		return fmt.Errorf("%w: reference %q is not in the %s repository", ErrInvalidSpec, o.Reference, SnapshotRepository)
+	}
+	for _, change := range o.Changes {
+		fields := strings.Fields(change)
+		if len(fields) < 2 || !commitInstructions[strings.ToUpper(fields[0])] {
+			return fmt.Errorf("%w: invalid change %q", ErrInvalidSpec, change)
+		}
+	}
+	return nil
+}
+
+func newSnapshot(image ImageInfo) Snapshot {
+	return Snapshot{
+		ID:        image.ID,
+		Tags:      image.Tags,
+		Container: image.Labels[LabelSnapshot],
+		Tenant:    image.Labels[LabelTenant],
+		Author:    image.Author,
+		Message:   image.Comment,
+		Created:   image.Created,
+		Size:      image.Size,
+	}
+}
+
+// CommitContainer snapshots the filesystem of the managed container id into a new
+// image tagged options.Reference, the container is paused meanwhile. The snapshot
+// belongs to the tenant of the container. The labels of the deploy service are
+// cleared, so the containers started from the snapshot are not taken for managed ones.
+func (m *Manager) CommitContainer(ctx context.Context, id string, options CommitOptions) (*Snapshot, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// The tag may only move from a snapshot of the same tenant.
+	if exists, err := m.rt.ImageExists(ctx, options.Reference); err != nil {
+		return nil, err
+	} else if exists {
+		if existing, err := m.Snapshot(WithTenant(ctx, info.Tenant), options.Reference); err != nil || existing.Tenant != info.Tenant {
+			return nil, fmt.Errorf("%w: %s", ErrNameTaken, options.Reference)
+		}
+	}
+
+	labels := []string{LabelManaged, LabelDeployment, LabelSpecHash, LabelConfig, LabelStack, LabelWorker}
+	cleared := make([]string, 0, len(labels))
+	for _, label := range labels {
+		cleared = append(cleared, label+`=""`)
+	}
+	changes := append([]string(nil), options.Changes...)
+	changes = append(changes,
+		"LABEL "+strings.Join(cleared, " "),
+		fmt.Sprintf("LABEL %s=%s %s=%s", LabelSnapshot, strconv.Quote(info.ID), LabelTenant, strconv.Quote(info.Tenant)))
+	imageID, err := m.rt.Commit(ctx, info.ID, CommitConfig{
+		Reference: options.Reference,
+		Author:    options.Author,
+		Comment:   options.Message,
+		Changes:   changes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to commit container %s: %s", info.ID, err.Error())
+	}
+	log.Printf("Container %s is committed to %s", info.ID, options.Reference)
+	return m.Snapshot(ctx, imageID)
+}
+
+// ExportContainer returns the filesystem of the managed container id as a tar archive.
+func (m *Manager) ExportContainer(ctx context.Context, id string) (io.ReadCloser, error) {
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := m.rt.Export(ctx, info.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to export container %s: %s", info.ID, err.Error())
+	}
+	return archive, nil
+}
+
+// Snapshots returns the snapshots of the tenant of ctx, the newest first.
+func (m *Manager) Snapshots(ctx context.Context) ([]Snapshot, error) {
+	images, err := m.rt.ListImages(ctx, map[string]string{LabelSnapshot: ""})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list images: %s", err.Error())
+	}
+	list := make([]Snapshot, 0, len(images))
+	for _, image := range images {
+		if snapshot := newSnapshot(image); visible(ctx, snapshot.Tenant) {
+			list = append(list, snapshot)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.After(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// Snapshot returns the snapshot of the tenant of ctx identified by ref: its ID,
+// an ID prefix or one of its tags.
+func (m *Manager) Snapshot(ctx context.Context, ref string) (*Snapshot, error) {
+	list, err := m.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimPrefix(ref, "sha256:")
+	var found *Snapshot
+	for i, snapshot := range list {
+		matches := id != "" && strings.HasPrefix(strings.TrimPrefix(snapshot.ID, "sha256:"), id)
+		for _, tag := range snapshot.Tags {
+			matches = matches || tag == normalizeImage(ref)
+		}
+		if !matches {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%w: %s matches several snapshots", ErrInvalidSpec, ref)
+		}
+		found = &list[i]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, ref)
+	}
+	return found, nil
+}
+
+// hexPattern matches image IDs and ID prefixes, docker accepts both in place of a reference.
+var hexPattern = regexp.MustCompile(`^(sha256:)?[0-9a-f]+$`)
+
+// checkImageTenant makes sure tenant may start a container from image: the images
+// labeled with another tenant, like its snapshots, are not found for it.
+func (m *Manager) checkImageTenant(ctx context.Context, tenant string, image string) error {
+	if tenant == "" {
+		return nil
+	}
+	images, err := m.rt.ListImages(ctx, map[string]string{LabelTenant: ""})
+	if err != nil {
+		return fmt.Errorf("Failed to list images: %s", err.Error())
+	}
+	id := strings.TrimPrefix(image, "sha256:")
+	for _, info := range images {
+		owner := info.Labels[LabelTenant]
+		if owner == "" || owner == tenant {
+			continue
+		}
+		matches := hexPattern.MatchString(image) && strings.HasPrefix(strings.TrimPrefix(info.ID, "sha256:"), id)
+		for _, tag := range info.Tags {
+			matches = matches || tag == normalizeImage(image)
+		}
+		if matches {
+			return fmt.Errorf("%w: no such image %s", ErrInvalidSpec, image)
+		}
+	}
+	return nil
+}
+
+// RemoveSnapshot removes the snapshot identified by ref with all its tags. It
+// fails with ErrImageInUse while a container is created from it.
+func (m *Manager) RemoveSnapshot(ctx context.Context, ref string) (*Snapshot, error) {
+	snapshot, err := m.Snapshot(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rt.RemoveImage(ctx, snapshot.ID); err != nil {
+		if errors.Is(err, ErrImageInUse) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Failed to remove snapshot %s: %s", snapshot.ID, err.Error())
+	}
+	log.Printf("Snapshot %s is removed", snapshot.ID)
+	return snapshot, nil
+}
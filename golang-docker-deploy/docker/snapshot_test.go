@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCommitContainer(t *testing.T) {
+	team := WithTenant(context.Background(), "team")
+	other := WithTenant(context.Background(), "other")
+	m, _ := newTestManager(t, "47180-47189")
+	info, err := m.CreateNewContainer(team, ContainerSpec{Image: "worker:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options CommitOptions
+		err     error
+	}{
+		{"snapshot", CommitOptions{Reference: "snapshots/team:1", Message: "first", Changes: []string{"ENV MODE=test"}}, nil},
+		{"outside of the repository", CommitOptions{Reference: "worker:1"}, ErrInvalidSpec},
+		{"invalid reference", CommitOptions{Reference: "snapshots/Team:1"}, ErrInvalidSpec},
+		{"unsupported change", CommitOptions{Reference: "snapshots/team:2", Changes: []string{"RUN rm -rf /"}}, ErrInvalidSpec},
+		{"existing reference", CommitOptions{Reference: "snapshots/team:1"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshot, err := m.CommitContainer(team, info.ID, test.options)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Commit returned %v, want %v", err, test.err)
+			}
+			if err == nil && (snapshot.Tenant != "team" || snapshot.Container != info.ID) {
+				t.Errorf("Snapshot is %+v", snapshot)
+			}
+		})
+	}
+
+	if _, err := m.CommitContainer(other, info.ID, CommitOptions{Reference: "snapshots/other:1"}); !errors.Is(err, ErrNotManaged) {
+		t.Errorf("Commit by another tenant returned %v, want %v", err, ErrNotManaged)
+	}
+	if snapshots, _ := m.Snapshots(other); len(snapshots) != 0 {
+		t.Errorf("Another tenant lists snapshots %v", snapshots)
+	}
+	if _, err := m.Snapshot(other, "snapshots/team:1"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Snapshot of another tenant returned %v, want %v", err, ErrSnapshotNotFound)
+	}
+
+	// Only the owner and the admin start containers from the snapshot.
+	spec := ContainerSpec{Image: "snapshots/team:1", PullPolicy: PullNever}
+	if _, err := m.CreateNewContainer(other, spec); !errors.Is(err, ErrInvalidSpec) {
+		t.Errorf("Create from the snapshot of another tenant returned %v, want %v", err, ErrInvalidSpec)
+	}
+	for _, ctx := range []context.Context{team, context.Background()} {
+		if _, err := m.CreateNewContainer(ctx, spec); err != nil {
+			t.Errorf("Create from the snapshot returned %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package docker
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// ErrInvalidSpec is returned when a container spec fails validation.
+var ErrInvalidSpec = errors.New("Invalid container spec")
+
+// ErrMountNotAllowed is returned when a tenant bind mounts a host path outside of BindRoots.
+var ErrMountNotAllowed = errors.New("Bind mount is not allowed")
+
+// BindRoots are the host directories the tenants may bind mount, with their
+// content. Any host path hands over the host, so without BindRoots only the
+// admin may use bind mounts.
+var BindRoots []string
+
+// Mount types supported by ContainerSpec.
+const (
+	MountBind   = "bind"
+	MountVolume = "volume"
+)
+
+// minMemory is the smallest memory limit docker accepts.
+const minMemory = 6 * 1024 * 1024
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// Mount is a bind mount or a named volume attached to the container. The named
+// volumes of a tenant are its own, another tenant naming them gets other volumes.
+type Mount struct {
+	Type     string `json:"type" yaml:"type"`
+	Source   string `json:"source" yaml:"source"`
+	Target   string `json:"target" yaml:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty" yaml:"readOnly,omitempty"`
+}
+
+// Probe is the HTTP health check of a container. The container is probed on the
+// host port publishing Port, a failing container is restarted or replaced by the
+// Supervisor.
+type Probe struct {
+	// Port is one of the tcp ports of the spec, the first one by default.
+	Port string `json:"port,omitempty" yaml:"port,omitempty"`
+	// Path is the HTTP path requested, the default of the Supervisor if empty.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+// ContainerSpec describes the container to be started.
+type ContainerSpec struct {
+	Image string `json:"image" yaml:"image"`
+	// Address is the host IP the ports are published on, 0.0.0.0 by default.
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+	// Ports are the container ports, like "8082" or "8082/tcp", each published on an allocated host port.
+	Ports  []string          `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Env    map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	Cmd    []string          `json:"cmd,omitempty" yaml:"cmd,omitempty"`
+	Mounts []Mount           `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	// CPUs is the number of CPUs the container may use, like 0.5.
+	CPUs float64 `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	// Memory is the memory limit, like "256m" or "1g".
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+	// RestartPolicy is one of no, always, unless-stopped, on-failure or on-failure:<max retries>.
+	RestartPolicy string            `json:"restartPolicy,omitempty" yaml:"restartPolicy,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// PullPolicy is one of always, if-not-present (default) or never.
+	PullPolicy string `json:"pullPolicy,omitempty" yaml:"pullPolicy,omitempty"`
+	// TTL is how long the container may live, like "30m". IdleTimeout removes it
+	// earlier when it sees no activity for that long. Both can be left empty.
+	TTL         string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	IdleTimeout string `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+	// Probe enables the HTTP health check, without it the container only has to be running.
+	Probe *Probe `json:"probe,omitempty" yaml:"probe,omitempty"`
+	// Worker marks a container running the worker server, only workers are
+	// offered jobs.
+	Worker bool `json:"worker,omitempty" yaml:"worker,omitempty"`
+}
+
+func parseContainerPort(port string) (string, string, error) {
+	number := port
+	protocol := "tcp"
+	if i := strings.IndexByte(port, '/'); i >= 0 {
+		number = port[:i]
+		protocol = port[i+1:]
+	}
+	value, err := strconv.Atoi(number)
+	if err != nil || value < 1 || value > 65535 {
+		return "", "", fmt.Errorf("Invalid port %q", port)
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return "", "", fmt.Errorf("Invalid protocol in port %q", port)
+	}
+	return number, protocol, nil
+}
+
+func parseRestartPolicy(policy string) (string, int, error) {
+	switch policy {
+	case "", "no", "always", "unless-stopped":
+		return policy, 0, nil
+	case "on-failure":
+		return policy, 0, nil
+	}
+	if strings.HasPrefix(policy, "on-failure:") {
+		retries, err := strconv.Atoi(strings.TrimPrefix(policy, "on-failure:"))
+		if err != nil || retries < 0 {
+			return "", 0, fmt.Errorf("Invalid restart policy %q", policy)
+		}
+		return "on-failure", retries, nil
+	}
+	return "", 0, fmt.Errorf("Invalid restart policy %q", policy)
+}
+
+// Validate checks the spec, so nothing invalid is sent to docker.
+func (s ContainerSpec) Validate() error {
+	if s.Image == "" {
+		return fmt.Errorf("No image specified")
+	}
+	// Docker only publishes ports on an IP address, not on a host name.
+	if s.Address != "" && net.ParseIP(s.Address) == nil {
+		return fmt.Errorf("Invalid address %q", s.Address)
+	}
+	for _, port := range s.Ports {
+		if _, _, err := parseContainerPort(port); err != nil {
+			return err
+		}
+	}
+	for key := range s.Env {
+		if key == "" || strings.ContainsAny(key, "= ") {
+			return fmt.Errorf("Invalid environment variable %q", key)
+		}
+	}
+	for key := range s.Labels {
+		if key == "" {
+			return fmt.Errorf("Empty label key")
+		}
+		if strings.HasPrefix(key, "golang-docker-deploy.") {
+			return fmt.Errorf("Label %s is reserved", key)
+		}
+	}
+	targets := make(map[string]bool, len(s.Mounts))
+	for _, mount := range s.Mounts {
+		if !path.IsAbs(mount.Target) {
+			return fmt.Errorf("Mount target %q is not an absolute path", mount.Target)
+		}
+		if targets[path.Clean(mount.Target)] {
+			return fmt.Errorf("Duplicate mount target %s", mount.Target)
+		}
+		targets[path.Clean(mount.Target)] = true
+		switch mount.Type {
+		case MountBind:
+			if !path.IsAbs(mount.Source) {
+				return fmt.Errorf("Bind mount source %q is not an absolute path", mount.Source)
+			}
+		case MountVolume:
+			if mount.Source != "" && !volumeNamePattern.MatchString(mount.Source) {
+				return fmt.Errorf("Invalid volume name %q", mount.Source)
+			}
+		default:
+			return fmt.Errorf("Invalid mount type %q", mount.Type)
+		}
+	}
+	if s.CPUs < 0 {
+		return fmt.Errorf("Invalid CPU limit %v", s.CPUs)
+	}
+	if s.Memory != "" {
+		memory, err := units.RAMInBytes(s.Memory)
+		if err != nil {
+			return fmt.Errorf("Invalid memory limit %q", s.Memory)
+		}
+		if memory < minMemory {
+			return fmt.Errorf("Memory limit %s is below the minimum of 6m", s.Memory)
+		}
+	}
+	if _, _, err := parseRestartPolicy(s.RestartPolicy); err != nil {
+		return err
+	}
+	if s.Probe != nil {
+		if _, err := s.probe(); err != nil {
+			return err
+		}
+	}
+	for _, duration := range []string{s.TTL, s.IdleTimeout} {
+		if duration == "" {
+			continue
+		}
+		if value, err := time.ParseDuration(duration); err != nil || value <= 0 {
+			return fmt.Errorf("Invalid duration %q", duration)
+		}
+	}
+	return validatePullPolicy(s.PullPolicy)
+}
+
+// checkBindMounts makes sure the tenant of ctx may bind mount the sources of mounts.
+func checkBindMounts(ctx context.Context, mounts []Mount) error {
+	if TenantFrom(ctx) == "" {
+		return nil
+	}
+	for _, mount := range mounts {
+		if mount.Type != MountBind {
+			continue
+		}
+		source := path.Clean(mount.Source)
+		allowed := underBindRoot(source)
+		// A symlink below a root may point anywhere on the host.
+		if resolved, err := filepath.EvalSymlinks(source); err == nil {
+			allowed = allowed && underBindRoot(filepath.ToSlash(resolved))
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s", ErrMountNotAllowed, mount.Source)
+		}
+	}
+	return nil
+}
+
+// tenantVolumePrefix starts the names of the volumes of the tenants, the stack
+// volumes start with networkPrefix instead.
+const tenantVolumePrefix = "golang-docker-deploy-tenant_"
+
+// scopeVolumes maps the named volumes of tenant to volumes of its own, so a tenant
+// can not mount the volumes of another tenant or of a stack. The admin mounts the
+// volumes as named.
+func scopeVolumes(tenant string, mounts []Mount) []Mount {
+	if tenant == "" || len(mounts) == 0 {
+		return mounts
+	}
+	// Tenant names may contain anything, hex keeps the volume name valid and unique.
+	prefix := tenantVolumePrefix + hex.EncodeToString([]byte(tenant)) + "_"
+	scoped := make([]Mount, len(mounts))
+	for i, mount := range mounts {
+		if mount.Type == MountVolume && mount.Source != "" {
+			mount.Source = prefix + mount.Source
+		}
+		scoped[i] = mount
+	}
+	return scoped
+}
+
+func underBindRoot(source string) bool {
+	for _, root := range BindRoots {
+		root = path.Clean(strings.TrimSpace(root))
+		if root == "/" || !path.IsAbs(root) {
+			continue
+		}
+		if source == root || strings.HasPrefix(source, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// TTLDuration returns the time to live, 0 if there is none.
+func (s ContainerSpec) TTLDuration() time.Duration {
+	ttl, _ := time.ParseDuration(s.TTL)
+	return ttl
+}
+
+// IdleTimeoutDuration returns the idle timeout, 0 if there is none.
+func (s ContainerSpec) IdleTimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(s.IdleTimeout)
+	return timeout
+}
+
+// MemoryBytes returns the memory limit in bytes, 0 if there is none.
+func (s ContainerSpec) MemoryBytes() int64 {
+	if s.Memory == "" {
+		return 0
+	}
+	memory, _ := units.RAMInBytes(s.Memory)
+	return memory
+}
+
+// probe returns the probe with the default port filled in.
+func (s ContainerSpec) probe() (*Probe, error) {
+	probe := *s.Probe
+	if probe.Path != "" && !strings.HasPrefix(probe.Path, "/") {
+		return nil, fmt.Errorf("Probe path %q is not absolute", probe.Path)
+	}
+	for _, port := range s.Ports {
+		number, protocol, _ := parseContainerPort(port)
+		if protocol == "tcp" && (probe.Port == "" || probe.Port == number) {
+			probe.Port = number
+			return &probe, nil
+		}
+	}
+	if probe.Port == "" {
+		return nil, fmt.Errorf("Probe needs a tcp port")
+	}
+	return nil, fmt.Errorf("Probe port %s is not a tcp port of the spec", probe.Port)
+}
+
+// containerConfig turns a validated spec into a runtime configuration.
+func (s ContainerSpec) containerConfig() ContainerConfig {
+	config := ContainerConfig{
+		Image:    s.Image,
+		Cmd:      s.Cmd,
+		Labels:   make(map[string]string, len(s.Labels)),
+		Env:      make([]string, 0, len(s.Env)),
+		Ports:    make([]PortMapping, 0, len(s.Ports)),
+		Mounts:   s.Mounts,
+		NanoCPUs: int64(s.CPUs * 1e9),
+		Memory:   s.MemoryBytes(),
+	}
+	config.RestartPolicy, config.RestartRetries, _ = parseRestartPolicy(s.RestartPolicy)
+	for key, value := range s.Labels {
+		config.Labels[key] = value
+	}
+	if s.Worker {
+		config.Labels[LabelWorker] = "true"
+	}
+	for key, value := range s.Env {
+		config.Env = append(config.Env, key+"="+value)
+	}
+	sort.Strings(config.Env)
+	if s.Probe != nil {
+		config.Probe, _ = s.probe()
+	}
+	address := s.Address
+	if address == "" {
+		address = "0.0.0.0"
+	}
+	for _, port := range s.Ports {
+		number, protocol, _ := parseContainerPort(port)
+		config.Ports = append(config.Ports, PortMapping{
+			ContainerPort: number,
+			Protocol:      protocol,
+			HostIP:        address,
+		})
+	}
+	return config
+}
@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		spec ContainerSpec
+		err  string
+	}{
+		{"minimal", ContainerSpec{Image: "worker:1"}, ""},
+		{"complete", ContainerSpec{
+			Image:         "worker:1",
+			Address:       "127.0.0.1",
+			Ports:         []string{"8082", "9000/udp"},
+			Env:           map[string]string{"MODE": "test"},
+			Labels:        map[string]string{"team": "a"},
+			Mounts:        []Mount{{Type: MountVolume, Source: "data", Target: "/data"}, {Type: MountBind, Source: "/srv", Target: "/srv"}},
+			CPUs:          0.5,
+			Memory:        "64m",
+			RestartPolicy: "on-failure:3",
+			PullPolicy:    "never",
+			TTL:           "30m",
+			IdleTimeout:   "5m",
+			Probe:         &Probe{Path: "/health"},
+		}, ""},
+		{"no image", ContainerSpec{}, "No image specified"},
+		{"host name address", ContainerSpec{Image: "worker:1", Address: "localhost"}, "Invalid address"},
+		{"ipv6 address", ContainerSpec{Image: "worker:1", Address: "::1"}, ""},
+		{"invalid port", ContainerSpec{Image: "worker:1", Ports: []string{"http"}}, "Invalid port"},
+		{"port out of range", ContainerSpec{Image: "worker:1", Ports: []string{"70000"}}, "Invalid port"},
+		{"invalid protocol", ContainerSpec{Image: "worker:1", Ports: []string{"8082/icmp"}}, "Invalid protocol"},
+		{"invalid env", ContainerSpec{Image: "worker:1", Env: map[string]string{"A=B": "c"}}, "Invalid environment variable"},
+		{"empty env", ContainerSpec{Image: "worker:1", Env: map[string]string{"": "c"}}, "Invalid environment variable"},
+		{"empty label", ContainerSpec{Image: "worker:1", Labels: map[string]string{"": "a"}}, "Empty label key"},
+		{"reserved label", ContainerSpec{Image: "worker:1", Labels: map[string]string{LabelTenant: "other"}}, "is reserved"},
+		{"relative target", ContainerSpec{Image: "worker:1", Mounts: []Mount{{Type: MountVolume, Source: "data", Target: "data"}}}, "is not an absolute path"},
+		{"duplicate target", ContainerSpec{Image: "worker:1", Mounts: []Mount{
+			{Type: MountVolume, Source: "data", Target: "/data"},
+			{Type: MountVolume, Source: "logs", Target: "/data/"},
+		}}, "Duplicate mount target"},
+		{"relative bind source", ContainerSpec{Image: "worker:1", Mounts: []Mount{{Type: MountBind, Source: "srv", Target: "/srv"}}}, "is not an absolute path"},
+		{"invalid volume name", ContainerSpec{Image: "worker:1", Mounts: []Mount{{Type: MountVolume, Source: "../data", Target: "/data"}}}, "Invalid volume name"},
+		{"invalid mount type", ContainerSpec{Image: "worker:1", Mounts: []Mount{{Type: "tmpfs", Target: "/tmp"}}}, "Invalid mount type"},
+		{"negative CPUs", ContainerSpec{Image: "worker:1", CPUs: -1}, "Invalid CPU limit"},
+		{"invalid memory", ContainerSpec{Image: "worker:1", Memory: "lots"}, "Invalid memory limit"},
+		{"memory below minimum", ContainerSpec{Image: "worker:1", Memory: "1m"}, "below the minimum"},
+		{"invalid restart policy", ContainerSpec{Image: "worker:1", RestartPolicy: "sometimes"}, "Invalid restart policy"},
+		{"invalid retries", ContainerSpec{Image: "worker:1", RestartPolicy: "on-failure:x"}, "Invalid restart policy"},
+		{"invalid pull policy", ContainerSpec{Image: "worker:1", PullPolicy: "sometimes"}, "pull policy"},
+		{"invalid ttl", ContainerSpec{Image: "worker:1", TTL: "soon"}, "Invalid duration"},
+		{"negative idle timeout", ContainerSpec{Image: "worker:1", IdleTimeout: "-5m"}, "Invalid duration"},
+		{"probe without port", ContainerSpec{Image: "worker:1", Ports: []string{"9000/udp"}, Probe: &Probe{}}, "Probe needs a tcp port"},
+		{"probe of unknown port", ContainerSpec{Image: "worker:1", Ports: []string{"8082"}, Probe: &Probe{Port: "9000"}}, "is not a tcp port"},
+		{"relative probe path", ContainerSpec{Image: "worker:1", Ports: []string{"8082"}, Probe: &Probe{Path: "health"}}, "is not absolute"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.spec.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Validate returned %s", err.Error())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Validate returned %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCreateInvalidSpec(t *testing.T) {
+	m, rt := newTestManager(t, "47060-47069")
+	_, err := m.CreateNewContainer(context.Background(), ContainerSpec{Image: "worker:1", Ports: []string{"http"}})
+	if !errors.Is(err, ErrInvalidSpec) {
+		t.Fatalf("Create returned %v, want %v", err, ErrInvalidSpec)
+	}
+	if list, _ := rt.List(context.Background(), nil); len(list) != 0 {
+		t.Errorf("Invalid spec created containers %v", list)
+	}
+}
+
+func TestBindMounts(t *testing.T) {
+	defer func(roots []string) { BindRoots = roots }(BindRoots)
+	BindRoots = []string{"/srv/shared", "/"}
+
+	tests := []struct {
+		name   string
+		tenant string
+		source string
+		err    error
+	}{
+		{"admin", "", "/etc", nil},
+		{"below a root", "team", "/srv/shared/team", nil},
+		{"root itself", "team", "/srv/shared", nil},
+		{"outside of the roots", "team", "/etc", ErrMountNotAllowed},
+		{"sibling of a root", "team", "/srv/shared-other", ErrMountNotAllowed},
+		{"escaping a root", "team", "/srv/shared/../../etc", ErrMountNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := WithTenant(context.Background(), test.tenant)
+			err := checkBindMounts(ctx, []Mount{{Type: MountBind, Source: test.source, Target: "/data"}})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("checkBindMounts returned %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestScopeVolumes(t *testing.T) {
+	mounts := []Mount{
+		{Type: MountVolume, Source: "data", Target: "/data"},
+		{Type: MountVolume, Target: "/cache"},
+		{Type: MountBind, Source: "/srv", Target: "/srv"},
+	}
+	if scoped := scopeVolumes("", mounts); scoped[0].Source != "data" {
+		t.Errorf("Volume of the admin is renamed to %s", scoped[0].Source)
+	}
+	a := scopeVolumes("a", mounts)
+	b := scopeVolumes("b", mounts)
+	if a[0].Source == "data" || a[0].Source == b[0].Source {
+		t.Errorf("Volumes of the tenants are %s and %s, want volumes of their own", a[0].Source, b[0].Source)
+	}
+	if !volumeNamePattern.MatchString(scopeVolumes("a b/c", mounts)[0].Source) {
+		t.Errorf("Scoped volume name is not valid")
+	}
+	if a[1].Source != "" || a[2].Source != "/srv" {
+		t.Errorf("Anonymous volume or bind mount is renamed: %v", a)
+	}
+	if mounts[0].Source != "data" {
+		t.Errorf("Mounts of the spec are changed")
+	}
+}
@@ -0,0 +1,395 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// ErrStackNotFound is returned when the requested stack does not exist.
+var ErrStackNotFound = errors.New("No such stack")
+
+// ErrStackExists is returned when a stack is deployed under a name already in use.
+var ErrStackExists = errors.New("Stack already exists")
+
+// ErrPortInUse is returned when a fixed host port is owned by another container.
+var ErrPortInUse = errors.New("Host port is in use")
+
+// defaultStackNetwork is the network of the services which do not list any.
+const defaultStackNetwork = "default"
+
+// Stack is a compose file deployed under a name. Its containers are named
+// <stack>_<service>, its networks and volumes are prefixed like the deployment networks.
+type Stack struct {
+	Name string `json:"name"`
+	ComposeFile
+	// Tenant owns the stack, it is set by DeployStack from the request context.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// StackStatus is a stack together with its current containers.
+type StackStatus struct {
+	Stack
+	Containers []ContainerInfo `json:"containers"`
+}
+
+func (s Stack) containerName(service string) string {
+	return s.Name + "_" + service
+}
+
+func (s Stack) networkName(network string) string {
+	return networkPrefix + s.Name + "_" + network
+}
+
+func (s Stack) volumeName(volume string) string {
+	return networkPrefix + s.Name + "_" + volume
+}
+
+// serviceNetworks returns the networks of the service, the default one if it lists none.
+func (s Stack) serviceNetworks(service ComposeService) []string {
+	names := make([]string, 0, len(service.Networks))
+	for name := range service.Networks {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = append(names, defaultStackNetwork)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// usedNetworks returns the networks of the compose file at least one service is on.
+func (s Stack) usedNetworks() []string {
+	used := make(map[string]bool)
+	for _, service := range s.Services {
+		for _, name := range s.serviceNetworks(service) {
+			used[name] = true
+		}
+	}
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// containerConfig turns the service into a runtime configuration. The service is
+// reachable by its name on each of its networks, the named volumes are the ones
+// of the stack.
+func (s Stack) containerConfig(name string) (ContainerConfig, error) {
+	service := s.Services[name]
+	spec := ContainerSpec{
+		Image:         service.Image,
+		Env:           service.Environment,
+		Cmd:           service.Command,
+		Mounts:        make([]Mount, 0, len(service.Mounts)),
+		RestartPolicy: service.Restart,
+	}
+	for _, mount := range service.Mounts {
+		if mount.Type == MountVolume {
+			mount.Source = s.volumeName(mount.Source)
+		}
+		spec.Mounts = append(spec.Mounts, mount)
+	}
+	if err := spec.Validate(); err != nil {
+		return ContainerConfig{}, fmt.Errorf("%w: service %s: %s", ErrInvalidSpec, name, err.Error())
+	}
+
+	config := spec.containerConfig()
+	config.Name = s.containerName(name)
+	for _, port := range service.Ports {
+		if port.HostIP == "" {
+			port.HostIP = "0.0.0.0"
+		}
+		config.Ports = append(config.Ports, port)
+	}
+	for i, network := range s.serviceNetworks(service) {
+		aliases := append([]string{name}, service.Networks[network]...)
+		if i == 0 {
+			config.Network = s.networkName(network)
+			config.NetworkAliases = aliases
+			continue
+		}
+		if config.ExtraNetworks == nil {
+			config.ExtraNetworks = make(map[string][]string)
+		}
+		config.ExtraNetworks[s.networkName(network)] = aliases
+	}
+	return config, nil
+}
+
+// stackLabels are the labels of the networks of the named stack.
+func stackLabels(name string) map[string]string {
+	return map[string]string{
+		LabelManaged: "true",
+		LabelStack:   name,
+	}
+}
+
+// reserveHostPorts makes sure the fixed host ports of the configurations are not
+// used twice and reserves them, so the port allocator does not hand them out to
+// other containers. Tenants may only publish ports of the allocator range.
+func (m *Manager) reserveHostPorts(ctx context.Context, configs map[string]ContainerConfig) ([]int, error) {
+	used := make(map[string]string)
+	reserved := make([]int, 0)
+	for name, config := range configs {
+		for _, port := range config.Ports {
+			if port.HostPort == "" {
+				continue
+			}
+			key := port.HostPort + "/" + port.Protocol
+			if other, ok := used[key]; ok {
+				m.releasePorts(reserved)
+				return nil, fmt.Errorf("%w: services %s and %s both publish host port %s", ErrInvalidSpec, other, name, key)
+			}
+			used[key] = name
+			hostPort, _ := strconv.Atoi(port.HostPort)
+			if containsPort(reserved, hostPort) {
+				// Same port number with another protocol.
+				continue
+			}
+			if TenantFrom(ctx) != "" && !m.ports.Contains(hostPort) {
+				m.releasePorts(reserved)
+				return nil, fmt.Errorf("%w: host port %d of service %s is outside of the host port range", ErrInvalidSpec, hostPort, name)
+			}
+			if !m.ports.Reserve(hostPort) {
+				m.releasePorts(reserved)
+				if owner, ok := m.ports.Owner(hostPort); ok && owner != "" {
+					return nil, fmt.Errorf("%w: %d of service %s is owned by container %s", ErrPortInUse, hostPort, name, owner)
+				}
+				return nil, fmt.Errorf("%w: %d of service %s", ErrPortInUse, hostPort, name)
+			}
+			reserved = append(reserved, hostPort)
+		}
+	}
+	return reserved, nil
+}
+
+func containsPort(list []int, port int) bool {
+	for _, item := range list {
+		if item == port {
+			return true
+		}
+	}
+	return false
+}
+
+// releasePorts frees the reserved ports no container has claimed.
+func (m *Manager) releasePorts(reserved []int) {
+	for _, port := range reserved {
+		if owner, ok := m.ports.Owner(port); ok && owner == "" {
+			m.ports.Release(port)
+		}
+	}
+}
+
+// DeployStack brings up the services of the compose file under the stack name,
+// in dependency order. The stack belongs to the tenant of ctx. If a service fails
+// to start, everything created so far is torn down again.
+func (m *Manager) DeployStack(ctx context.Context, name string, file ComposeFile) (*StackStatus, error) {
+	if !deploymentNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid stack name %q", ErrInvalidSpec, name)
+	}
+	order, err := file.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+	for serviceName, service := range file.Services {
+		if err := checkBindMounts(ctx, service.Mounts); err != nil {
+			return nil, fmt.Errorf("Service %s: %w", serviceName, err)
+		}
+	}
+	stack := Stack{Name: name, ComposeFile: file, Tenant: TenantFrom(ctx)}
+	configs := make(map[string]ContainerConfig, len(order))
+	for _, service := range order {
+		if configs[service], err = stack.containerConfig(service); err != nil {
+			return nil, err
+		}
+	}
+
+	m.reconcileMutex.Lock()
+	defer m.reconcileMutex.Unlock()
+	m.mutex.RLock()
+	existing, exists := m.stacks[name]
+	m.mutex.RUnlock()
+	if exists && !visible(ctx, existing.Tenant) {
+		return nil, fmt.Errorf("%w: %s", ErrNameTaken, name)
+	}
+	if exists {
+		return nil, fmt.Errorf("%w: %s", ErrStackExists, name)
+	}
+	reserved, err := m.reserveHostPorts(ctx, configs)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	m.stacks[name] = stack
+	m.mutex.Unlock()
+	m.persist()
+
+	if err := m.startStack(ctx, stack, order, configs); err != nil {
+		log.Printf("Stack %s failed, tearing it down: %s", name, err.Error())
+		if _, teardownErr := m.teardownStack(context.Background(), stack); teardownErr != nil {
+			log.Printf("Failed to tear down stack %s: %s", name, teardownErr.Error())
+		}
+		m.releasePorts(reserved)
+		return nil, err
+	}
+	log.Printf("Stack %s is up with %d services", name, len(order))
+	return m.StackStatus(ctx, name)
+}
+
+// startStack creates the networks of the stack and starts its services in order.
+func (m *Manager) startStack(ctx context.Context, stack Stack, order []string, configs map[string]ContainerConfig) error {
+	for _, service := range order {
+		if err := m.ensureImage(ctx, configs[service].Image, ""); err != nil {
+			return fmt.Errorf("Service %s: %w", service, err)
+		}
+	}
+	for _, network := range stack.usedNetworks() {
+		labels := stackLabels(stack.Name)
+		labels[LabelTenant] = stack.Tenant
+		config := NetworkConfig{
+			Name:     stack.networkName(network),
+			Internal: stack.Networks[network].Internal,
+			Labels:   labels,
+		}
+		if _, err := m.rt.CreateNetwork(ctx, config); err != nil {
+			return fmt.Errorf("Failed to create network %s: %s", config.Name, err.Error())
+		}
+	}
+	for _, service := range order {
+		info, err := m.startContainer(ctx, &managedContainer{
+			config: configs[service],
+			stack:  stack.Name,
+			tenant: stack.Tenant,
+		}, "")
+		if err != nil {
+			return fmt.Errorf("Service %s: %w", service, err)
+		}
+		// The fixed host ports are reserved, they belong to the container now.
+		m.claimPorts(*info)
+	}
+	return nil
+}
+
+// Stacks returns the stacks of the tenant of ctx sorted by name.
+func (m *Manager) Stacks(ctx context.Context) []Stack {
+	list := make([]Stack, 0)
+	for _, stack := range m.allStacks() {
+		if visible(ctx, stack.Tenant) {
+			list = append(list, stack)
+		}
+	}
+	return list
+}
+
+// allStacks returns every stack sorted by name.
+func (m *Manager) allStacks() []Stack {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	list := make([]Stack, 0, len(m.stacks))
+	for _, stack := range m.stacks {
+		list = append(list, stack)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Stack returns the named stack of the tenant of ctx.
+func (m *Manager) Stack(ctx context.Context, name string) (Stack, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	stack, ok := m.stacks[name]
+	if !ok || !visible(ctx, stack.Tenant) {
+		return stack, fmt.Errorf("%w: %s", ErrStackNotFound, name)
+	}
+	return stack, nil
+}
+
+// StackStatus returns the named stack and its containers.
+func (m *Manager) StackStatus(ctx context.Context, name string) (*StackStatus, error) {
+	stack, err := m.Stack(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := m.stackContainers(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &StackStatus{Stack: stack, Containers: containers}, nil
+}
+
+func (m *Manager) stackContainers(ctx context.Context, name string) ([]ContainerInfo, error) {
+	list, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]ContainerInfo, 0)
+	for _, info := range list {
+		if info.Stack == name {
+			containers = append(containers, info)
+		}
+	}
+	return containers, nil
+}
+
+// RemoveStack tears the named stack down: its containers, networks and volumes
+// are removed. It returns the IDs of the removed containers.
+func (m *Manager) RemoveStack(ctx context.Context, name string) ([]string, error) {
+	m.reconcileMutex.Lock()
+	defer m.reconcileMutex.Unlock()
+	stack, err := m.Stack(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return m.teardownStack(ctx, stack)
+}
+
+// teardownStack removes everything created for the stack and forgets it.
+// The stack is kept if something can not be removed, so it can be retried.
+func (m *Manager) teardownStack(ctx context.Context, stack Stack) ([]string, error) {
+	containers, err := m.stackContainers(ctx, stack.Name)
+	if err != nil {
+		return nil, err
+	}
+	// Dependents first.
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created.After(containers[j].Created)
+	})
+	removed := make([]string, 0, len(containers))
+	for _, info := range containers {
+		if _, err := m.Remove(ctx, info.ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, info.ID)
+	}
+
+	networks, err := m.rt.ListNetworks(ctx, stackLabels(stack.Name))
+	if err != nil {
+		return removed, fmt.Errorf("Failed to list networks: %s", err.Error())
+	}
+	for _, n := range networks {
+		if err := m.rt.RemoveNetwork(ctx, n.ID); err != nil && !errors.Is(err, ErrNetworkNotFound) {
+			return removed, fmt.Errorf("Failed to remove network %s: %s", n.Name, err.Error())
+		}
+	}
+	for _, volume := range stack.Volumes {
+		if err := m.rt.RemoveVolume(ctx, stack.volumeName(volume)); err != nil {
+			return removed, fmt.Errorf("Failed to remove volume %s: %s", stack.volumeName(volume), err.Error())
+		}
+	}
+
+	m.mutex.Lock()
+	delete(m.stacks, stack.Name)
+	m.mutex.Unlock()
+	m.persist()
+	log.Printf("Stack %s is removed with %d containers", stack.Name, len(removed))
+	return removed, nil
+}
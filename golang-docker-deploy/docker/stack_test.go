@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStackHostPorts(t *testing.T) {
+	compose := func(ports ...string) ComposeFile {
+		data := "services:\n  web:\n    image: worker:1\n    ports:\n"
+		for _, port := range ports {
+			data += "      - \"" + port + "\"\n"
+		}
+		file, err := ParseCompose([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	tests := []struct {
+		name   string
+		tenant string
+		ports  []string
+		err    error
+	}{
+		{"port of the range", "team", []string{"47051:80"}, nil},
+		{"tcp and udp", "team", []string{"47051:80", "47051:80/udp"}, nil},
+		{"tenant outside of the range", "team", []string{"47099:80"}, ErrInvalidSpec},
+		{"admin outside of the range", "", []string{"47099:80"}, nil},
+		{"allocated port", "team", []string{"47050:80"}, ErrPortInUse},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := WithTenant(context.Background(), test.tenant)
+			m, _ := newTestManager(t, "47050-47053")
+			// Takes 47050, the next handed out port is 47051.
+			other, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1", Ports: []string{"8082"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, err := m.DeployStack(ctx, "web", compose(test.ports...))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("DeployStack returned %v, want %v", err, test.err)
+			}
+			if err != nil {
+				if allocations := m.Ports().Allocations(); len(allocations) != 1 {
+					t.Errorf("Allocations are %v after the failure, want only the port of %s", allocations, other.ID)
+				}
+				return
+			}
+
+			// The fixed port is not handed out while the stack holds it.
+			id := status.Containers[0].ID
+			hostPort := test.ports[0][:5]
+			for i := 0; i < 3; i++ {
+				info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1", Ports: []string{"8082"}})
+				if err != nil {
+					break
+				}
+				if info.Ports[0].HostPort == hostPort {
+					t.Errorf("Host port %s of the stack is handed out again", hostPort)
+				}
+			}
+
+			if _, err := m.RemoveStack(ctx, "web"); err != nil {
+				t.Fatal(err)
+			}
+			for port, owner := range m.Ports().Allocations() {
+				if owner == id {
+					t.Errorf("Host port %d of the removed stack is not released", port)
+				}
+			}
+		})
+	}
+}
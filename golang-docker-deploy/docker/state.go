@@ -0,0 +1,199 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// containerState is the persisted bookkeeping of a managed container.
+type containerState struct {
+	Config     ContainerConfig `json:"config"`
+	Deployment string          `json:"deployment,omitempty"`
+	Stack      string          `json:"stack,omitempty"`
+	SpecHash   string          `json:"specHash,omitempty"`
+	Tenant     string          `json:"tenant,omitempty"`
+	Lease      *lease          `json:"lease,omitempty"`
+}
+
+// state is the content of the state file.
+type state struct {
+	Deployments []Deployment              `json:"deployments"`
+	Stacks      []Stack                   `json:"stacks,omitempty"`
+	Containers  map[string]containerState `json:"containers"`
+}
+
+// persist writes the Manager state to the state file, if there is one.
+func (m *Manager) persist() {
+	if m.stateFile == "" {
+		return
+	}
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
+
+	current := state{
+		Deployments: m.allDeployments(),
+		Stacks:      m.allStacks(),
+		Containers:  make(map[string]containerState),
+	}
+	m.mutex.RLock()
+	for id, managed := range m.containers {
+		saved := containerState{
+			Config:     managed.config,
+			Deployment: managed.deployment,
+			Stack:      managed.stack,
+			SpecHash:   managed.specHash,
+			Tenant:     managed.tenant,
+		}
+		if !managed.lease.expires().IsZero() {
+			l := managed.lease
+			saved.Lease = &l
+		}
+		current.Containers[id] = saved
+	}
+	m.mutex.RUnlock()
+
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode state: %s", err.Error())
+		return
+	}
+	// Write and rename, so a crash never leaves a truncated state file behind.
+	tmpName := m.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0600); err != nil {
+		log.Printf("Failed to write state file: %s", err.Error())
+		return
+	}
+	if err := os.Rename(tmpName, m.stateFile); err != nil {
+		log.Printf("Failed to write state file: %s", err.Error())
+	}
+}
+
+func loadState(stateFile string) (state, error) {
+	loaded := state{
+		Deployments: make([]Deployment, 0),
+		Containers:  make(map[string]containerState),
+	}
+	data, err := ioutil.ReadFile(filepath.Clean(stateFile))
+	if os.IsNotExist(err) {
+		return loaded, nil
+	}
+	if err != nil {
+		return loaded, fmt.Errorf("Failed to read state file: %s", err.Error())
+	}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return loaded, fmt.Errorf("Failed to decode state file: %s", err.Error())
+	}
+	return loaded, nil
+}
+
+// claimPorts marks the published host ports of info as owned by the container.
+func (m *Manager) claimPorts(info ContainerInfo) {
+	for _, port := range info.Ports {
+		if hostPort, err := strconv.Atoi(port.HostPort); err == nil {
+			m.ports.Assign(hostPort, info.ID)
+		}
+	}
+}
+
+// Restore rebuilds the Manager state from stateFile and from the labels of the
+// containers found in the runtime. Later changes are saved to stateFile.
+// Labeled containers missing from the state file are orphans: they are adopted
+// if adopt is set, otherwise they are only reported and can be adopted later.
+func (m *Manager) Restore(ctx context.Context, stateFile string, adopt bool) ([]ContainerInfo, error) {
+	loaded, err := loadState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	labeled, err := m.rt.List(ctx, map[string]string{LabelManaged: "true"})
+	if err != nil {
+		err = fmt.Errorf("Failed to list containers: %s", err.Error())
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	for _, deployment := range loaded.Deployments {
+		m.deployments[deployment.Name] = deployment
+	}
+	for _, stack := range loaded.Stacks {
+		m.stacks[stack.Name] = stack
+	}
+	m.mutex.Unlock()
+
+	orphans := make([]ContainerInfo, 0)
+	for _, info := range labeled {
+		saved, ok := loaded.Containers[info.ID]
+		if !ok {
+			if !adopt {
+				log.Printf("Found orphan container %s (%s)", info.ID, info.Image)
+				orphans = append(orphans, info)
+				continue
+			}
+			log.Printf("Adopting orphan container %s (%s)", info.ID, info.Image)
+			m.track(info.ID, managedFromLabels(info))
+		} else {
+			managed := &managedContainer{
+				config:     saved.Config,
+				deployment: saved.Deployment,
+				stack:      saved.Stack,
+				specHash:   saved.SpecHash,
+				tenant:     saved.Tenant,
+			}
+			if saved.Lease != nil {
+				managed.lease = *saved.Lease
+			}
+			m.track(info.ID, managed)
+		}
+		m.claimPorts(info)
+	}
+	for id := range loaded.Containers {
+		if !m.isTracked(id) {
+			log.Printf("Container %s is gone since the last run", id)
+		}
+	}
+
+	m.mutex.Lock()
+	m.orphans = orphans
+	m.stateFile = stateFile
+	m.mutex.Unlock()
+	m.persist()
+	return orphans, nil
+}
+
+// Orphans returns the labeled containers which are not adopted yet.
+func (m *Manager) Orphans() []ContainerInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return append([]ContainerInfo(nil), m.orphans...)
+}
+
+// Adopt takes over the orphan container id, identified by its full ID or a prefix of it.
+func (m *Manager) Adopt(ctx context.Context, id string) (*ContainerInfo, error) {
+	info, err := m.rt.Inspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if info.Labels[LabelManaged] != "true" {
+		return nil, fmt.Errorf("Container %s was not created by the deploy service", info.ID)
+	}
+
+	m.mutex.Lock()
+	for i, orphan := range m.orphans {
+		if orphan.ID == info.ID {
+			m.orphans = append(m.orphans[:i], m.orphans[i+1:]...)
+			break
+		}
+	}
+	m.mutex.Unlock()
+
+	if !m.isTracked(info.ID) {
+		m.track(info.ID, managedFromLabels(info))
+		m.claimPorts(info)
+	}
+	return m.Inspect(ctx, info.ID)
+}
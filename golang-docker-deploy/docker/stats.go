@@ -0,0 +1,138 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Metric names of ContainerStats, see Metric.
+const (
+	MetricCPUPercent    = "cpu_percent"
+	MetricMemoryUsage   = "memory_usage"
+	MetricMemoryLimit   = "memory_limit"
+	MetricMemoryPercent = "memory_percent"
+	MetricNetworkRx     = "network_rx"
+	MetricNetworkTx     = "network_tx"
+	MetricBlockRead     = "block_read"
+	MetricBlockWrite    = "block_write"
+)
+
+// ContainerStats is a resource usage sample of a container. The network and
+// block I/O counters are the bytes transferred since the container started.
+type ContainerStats struct {
+	ContainerID string    `json:"containerId"`
+	Name        string    `json:"name"`
+	Deployment  string    `json:"deployment,omitempty"`
+	Read        time.Time `json:"read"`
+	// CPUPercent is the CPU usage, 100 per fully used CPU.
+	CPUPercent float64 `json:"cpuPercent"`
+	// MemoryUsage excludes the page cache, like docker stats does.
+	MemoryUsage   uint64  `json:"memoryUsage"`
+	MemoryLimit   uint64  `json:"memoryLimit"`
+	MemoryPercent float64 `json:"memoryPercent"`
+	NetworkRx     uint64  `json:"networkRx"`
+	NetworkTx     uint64  `json:"networkTx"`
+	BlockRead     uint64  `json:"blockRead"`
+	BlockWrite    uint64  `json:"blockWrite"`
+}
+
+// Metric returns the value of the named metric, false if the name is unknown.
+func (s ContainerStats) Metric(name string) (float64, bool) {
+	switch name {
+	case MetricCPUPercent:
+		return s.CPUPercent, true
+	case MetricMemoryUsage:
+		return float64(s.MemoryUsage), true
+	case MetricMemoryLimit:
+		return float64(s.MemoryLimit), true
+	case MetricMemoryPercent:
+		return s.MemoryPercent, true
+	case MetricNetworkRx:
+		return float64(s.NetworkRx), true
+	case MetricNetworkTx:
+		return float64(s.NetworkTx), true
+	case MetricBlockRead:
+		return float64(s.BlockRead), true
+	case MetricBlockWrite:
+		return float64(s.BlockWrite), true
+	}
+	return 0, false
+}
+
+// SumStats adds up the samples, the memory percentage is recomputed from the totals.
+func SumStats(samples []ContainerStats) ContainerStats {
+	total := ContainerStats{Read: time.Now().UTC()}
+	for _, s := range samples {
+		total.CPUPercent += s.CPUPercent
+		total.MemoryUsage += s.MemoryUsage
+		total.MemoryLimit += s.MemoryLimit
+		total.NetworkRx += s.NetworkRx
+		total.NetworkTx += s.NetworkTx
+		total.BlockRead += s.BlockRead
+		total.BlockWrite += s.BlockWrite
+	}
+	if total.MemoryLimit > 0 {
+		total.MemoryPercent = float64(total.MemoryUsage) / float64(total.MemoryLimit) * 100
+	}
+	return total
+}
+
+// Stats samples the resource usage of the managed container id.
+func (m *Manager) Stats(ctx context.Context, id string) (*ContainerStats, error) {
+	info, err := m.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if info.State != "running" {
+		return nil, fmt.Errorf("%w: %s", ErrNotRunning, info.ID)
+	}
+	stats, err := m.rt.Stats(ctx, info.ID)
+	if err != nil {
+		err = fmt.Errorf("Failed to read stats of %s: %s", info.ID, err.Error())
+		return nil, err
+	}
+	stats.ContainerID = info.ID
+	stats.Name = info.Name
+	stats.Deployment = info.Deployment
+	return &stats, nil
+}
+
+// AllStats samples the resource usage of every running managed container of
+// the tenant of ctx. The containers are sampled in parallel, the ones which
+// stop meanwhile are left out.
+func (m *Manager) AllStats(ctx context.Context) ([]ContainerStats, error) {
+	list, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]*ContainerStats, len(list))
+	var wg sync.WaitGroup
+	for i, info := range list {
+		if info.State != "running" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, info ContainerInfo) {
+			defer wg.Done()
+			stats, err := m.rt.Stats(ctx, info.ID)
+			if err != nil {
+				return
+			}
+			stats.ContainerID = info.ID
+			stats.Name = info.Name
+			stats.Deployment = info.Deployment
+			samples[i] = &stats
+		}(i, info)
+	}
+	wg.Wait()
+
+	result := make([]ContainerStats, 0, len(samples))
+	for _, stats := range samples {
+		if stats != nil {
+			result = append(result, *stats)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,318 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health states reported by the Supervisor.
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Recovery actions taken by the Supervisor on unhealthy workers.
+const (
+	RecoverRestart = "restart"
+	RecoverReplace = "replace"
+)
+
+// maxTransitions is the number of health transitions kept per container.
+const maxTransitions = 20
+
+// SupervisorConfig controls how workers are probed and recovered.
+type SupervisorConfig struct {
+	// Interval between two probes of the same worker.
+	Interval time.Duration
+	// Timeout of a single HTTP probe.
+	Timeout time.Duration
+	// StartPeriod after a start or restart during which failed probes are not counted.
+	StartPeriod time.Duration
+	// FailureThreshold is the number of consecutive failed probes that triggers recovery.
+	FailureThreshold int
+	// Action is either RecoverRestart or RecoverReplace.
+	Action string
+	// ProbeHost is the host the published worker ports are reachable on.
+	ProbeHost string
+	// ProbePath is the HTTP path requested from the workers whose probe has none.
+	ProbePath string
+}
+
+// HealthTransition records a change of the health state.
+type HealthTransition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// HealthStatus is the health of a single supervised worker.
+type HealthStatus struct {
+	ContainerID         string             `json:"containerId"`
+	Status              string             `json:"status"`
+	ConsecutiveFailures int                `json:"consecutiveFailures"`
+	LastProbe           time.Time          `json:"lastProbe"`
+	LastError           string             `json:"lastError,omitempty"`
+	Restarts            int                `json:"restarts"`
+	ReplacedBy          string             `json:"replacedBy,omitempty"`
+	Transitions         []HealthTransition `json:"transitions"`
+	startedAt           time.Time
+}
+
+// Supervisor periodically checks every managed worker and restarts or replaces
+// the ones failing too many checks in a row. The workers with a Probe in their
+// spec are probed over HTTP, the others are only expected to be running.
+type Supervisor struct {
+	manager *Manager
+	config  SupervisorConfig
+	client  *http.Client
+	mutex   sync.RWMutex
+	status  map[string]*HealthStatus
+	// rollingOut holds the containers of the running rolling update, they are
+	// not probed, nil if there is no rolling update.
+	rollingOut map[string]bool
+}
+
+// NewSupervisor creates a Supervisor for the containers of manager.
+func NewSupervisor(manager *Manager, config SupervisorConfig) *Supervisor {
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 2 * time.Second
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+	if config.Action == "" {
+		config.Action = RecoverRestart
+	}
+	if config.ProbeHost == "" {
+		config.ProbeHost = "localhost"
+	}
+	if config.ProbePath == "" {
+		config.ProbePath = "/"
+	}
+	return &Supervisor{
+		manager: manager,
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout},
+		status:  make(map[string]*HealthStatus),
+	}
+}
+
+// Run probes the workers until ctx is cancelled.
+func (s *Supervisor) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		s.ProbeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProbeAll probes every managed worker once and recovers the failing ones.
+func (s *Supervisor) ProbeAll(ctx context.Context) {
+	list, err := s.manager.List(ctx)
+	if err != nil {
+		log.Printf("Supervisor failed to list containers: %s", err.Error())
+		return
+	}
+
+	alive := make(map[string]bool, len(list))
+	var wg sync.WaitGroup
+	for _, info := range list {
+		alive[info.ID] = true
+		if info.Stack != "" {
+			// Stack services are not HTTP workers, docker restarts them by their restart policy.
+			continue
+		}
+		s.mutex.RLock()
+		skip := s.rollingOut[info.ID]
+		s.mutex.RUnlock()
+		if skip {
+			continue
+		}
+		wg.Add(1)
+		go func(info ContainerInfo) {
+			defer wg.Done()
+			s.probe(ctx, info)
+		}(info)
+	}
+	wg.Wait()
+
+	// Forget the workers removed in the meantime.
+	s.mutex.Lock()
+	for id := range s.status {
+		if !alive[id] {
+			delete(s.status, id)
+		}
+	}
+	s.mutex.Unlock()
+}
+
+func (s *Supervisor) probe(ctx context.Context, info ContainerInfo) {
+	err := s.check(ctx, info)
+	now := time.Now().UTC()
+
+	s.mutex.Lock()
+	status, ok := s.status[info.ID]
+	if !ok {
+		status = &HealthStatus{
+			ContainerID: info.ID,
+			Status:      HealthUnknown,
+			Transitions: make([]HealthTransition, 0),
+			startedAt:   info.Created,
+		}
+		s.status[info.ID] = status
+	}
+	status.LastProbe = now
+	if err == nil {
+		status.ConsecutiveFailures = 0
+		status.LastError = ""
+		s.transition(status, HealthHealthy, now)
+		s.mutex.Unlock()
+		return
+	}
+
+	status.LastError = err.Error()
+	if status.Status != HealthHealthy && now.Sub(status.startedAt) < s.config.StartPeriod {
+		// Still starting up.
+		s.mutex.Unlock()
+		return
+	}
+	status.ConsecutiveFailures++
+	if status.ConsecutiveFailures >= s.config.FailureThreshold {
+		s.transition(status, HealthUnhealthy, now)
+	}
+	unhealthy := status.ConsecutiveFailures >= s.config.FailureThreshold
+	s.mutex.Unlock()
+
+	if unhealthy {
+		s.recover(ctx, info)
+	}
+}
+
+// transition changes the health state. Must be called with the mutex held.
+func (s *Supervisor) transition(status *HealthStatus, to string, at time.Time) {
+	if status.Status == to {
+		return
+	}
+	log.Printf("Worker %s is %s", status.ContainerID, to)
+	status.Transitions = append(status.Transitions, HealthTransition{From: status.Status, To: to, At: at})
+	if len(status.Transitions) > maxTransitions {
+		status.Transitions = status.Transitions[len(status.Transitions)-maxTransitions:]
+	}
+	status.Status = to
+}
+
+func (s *Supervisor) check(ctx context.Context, info ContainerInfo) error {
+	if info.State != "running" {
+		return fmt.Errorf("Container is %s", info.State)
+	}
+	managed, ok := s.manager.managed(info.ID)
+	if !ok || managed.config.Probe == nil {
+		// Redis, postgres and the like do not speak HTTP: running is healthy.
+		return nil
+	}
+	probe := managed.config.Probe
+	hostPort := ""
+	for _, port := range info.Ports {
+		if port.ContainerPort == probe.Port && port.Protocol == "tcp" {
+			hostPort = port.HostPort
+		}
+	}
+	if hostPort == "" {
+		return fmt.Errorf("Probe port %s is not published", probe.Port)
+	}
+	path := probe.Path
+	if path == "" {
+		path = s.config.ProbePath
+	}
+
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(s.config.ProbeHost, hostPort), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("Probe returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Supervisor) recover(ctx context.Context, info ContainerInfo) {
+	if s.config.Action == RecoverReplace {
+		replacement, err := s.manager.Replace(ctx, info.ID)
+		if err != nil {
+			log.Printf("Failed to replace worker %s: %s", info.ID, err.Error())
+			return
+		}
+		s.mutex.Lock()
+		if status, ok := s.status[info.ID]; ok {
+			status.ReplacedBy = replacement.ID
+		}
+		s.mutex.Unlock()
+		log.Printf("Worker %s is replaced by %s", info.ID, replacement.ID)
+		return
+	}
+
+	if _, err := s.manager.Restart(ctx, info.ID); err != nil {
+		log.Printf("Failed to restart worker %s: %s", info.ID, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	if status, ok := s.status[info.ID]; ok {
+		status.Restarts++
+		status.ConsecutiveFailures = 0
+		status.startedAt = time.Now().UTC()
+	}
+	s.mutex.Unlock()
+	log.Printf("Worker %s is restarted", info.ID)
+}
+
+func copyStatus(status *HealthStatus) HealthStatus {
+	c := *status
+	c.Transitions = append([]HealthTransition(nil), status.Transitions...)
+	return c
+}
+
+// Status returns the health of every supervised worker.
+func (s *Supervisor) Status() []HealthStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	list := make([]HealthStatus, 0, len(s.status))
+	for _, status := range s.status {
+		list = append(list, copyStatus(status))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ContainerID < list[j].ContainerID
+	})
+	return list
+}
+
+// StatusOf returns the health of the worker identified by its full container ID.
+func (s *Supervisor) StatusOf(id string) (HealthStatus, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	status, ok := s.status[id]
+	if !ok {
+		return HealthStatus{}, false
+	}
+	return copyStatus(status), true
+}
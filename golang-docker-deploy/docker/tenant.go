@@ -0,0 +1,154 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	units "github.com/docker/go-units"
+)
+
+// ErrQuotaExceeded is returned when a container would exceed the quota of its tenant.
+var ErrQuotaExceeded = errors.New("Tenant quota exceeded")
+
+// ErrNameTaken is returned when a tenant uses a name owned by another tenant.
+var ErrNameTaken = errors.New("Name is used by another tenant")
+
+type tenantKey struct{}
+
+// WithTenant returns a context acting on behalf of tenant. The Manager only
+// shows and manages the containers and deployments of that tenant, a context
+// without tenant has access to everything.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns the tenant of ctx, empty if there is none.
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// visible tells whether a resource owned by owner can be seen from ctx.
+func visible(ctx context.Context, owner string) bool {
+	tenant := TenantFrom(ctx)
+	return tenant == "" || tenant == owner
+}
+
+// Quota limits the resources of a tenant. Zero values mean no limit.
+type Quota struct {
+	Containers int     `json:"containers,omitempty"`
+	Memory     string  `json:"memory,omitempty"`
+	CPUs       float64 `json:"cpus,omitempty"`
+}
+
+// Usage is the resource usage of a tenant.
+type Usage struct {
+	Containers int     `json:"containers"`
+	Memory     int64   `json:"memory"`
+	CPUs       float64 `json:"cpus"`
+}
+
+// Tenant is a user of the deploy service, identified by its API token.
+type Tenant struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Quota Quota  `json:"quota"`
+}
+
+// LoadTenants reads the tenants from a JSON file: {"tenants": [{"name": ..., "token": ..., "quota": {...}}]}.
+func LoadTenants(fileName string) ([]Tenant, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(fileName))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read tenants file: %s", err.Error())
+	}
+	config := struct {
+		Tenants []Tenant `json:"tenants"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed to decode tenants file: %s", err.Error())
+	}
+	names := make(map[string]bool, len(config.Tenants))
+	tokens := make(map[string]bool, len(config.Tenants))
+	for _, tenant := range config.Tenants {
+		if tenant.Name == "" || tenant.Token == "" {
+			return nil, fmt.Errorf("Tenant without name or token")
+		}
+		if names[tenant.Name] || tokens[tenant.Token] {
+			return nil, fmt.Errorf("Duplicate tenant %s", tenant.Name)
+		}
+		if tenant.Quota.Memory != "" {
+			if _, err := units.RAMInBytes(tenant.Quota.Memory); err != nil {
+				return nil, fmt.Errorf("Invalid memory quota of tenant %s", tenant.Name)
+			}
+		}
+		names[tenant.Name] = true
+		tokens[tenant.Token] = true
+	}
+	return config.Tenants, nil
+}
+
+// SetQuotas sets the quotas of the tenants, keyed by tenant name.
+func (m *Manager) SetQuotas(quotas map[string]Quota) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.quotas = quotas
+}
+
+// Usage returns the resources used by the containers of tenant.
+func (m *Manager) Usage(tenant string) Usage {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.usage(tenant, "")
+}
+
+// usage sums the resources of the containers of tenant, leaving out exclude.
+// Must be called with the mutex held.
+func (m *Manager) usage(tenant string, exclude string) Usage {
+	usage := Usage{}
+	for id, managed := range m.containers {
+		if managed.tenant != tenant || id == exclude || managed.retired {
+			continue
+		}
+		usage.Containers++
+		usage.Memory += managed.config.Memory
+		usage.CPUs += float64(managed.config.NanoCPUs) / 1e9
+	}
+	return usage
+}
+
+// checkQuota makes sure one more container with config fits into the quota of tenant.
+// The container exclude is about to be replaced, so it is not counted.
+func (m *Manager) checkQuota(tenant string, config ContainerConfig, exclude string) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	quota, ok := m.quotas[tenant]
+	if tenant == "" || !ok {
+		return nil
+	}
+	usage := m.usage(tenant, exclude)
+	if quota.Containers > 0 && usage.Containers+1 > quota.Containers {
+		return fmt.Errorf("%w: %s may run at most %d containers", ErrQuotaExceeded, tenant, quota.Containers)
+	}
+	if quota.Memory != "" {
+		limit, _ := units.RAMInBytes(quota.Memory)
+		if config.Memory == 0 {
+			return fmt.Errorf("%w: %s must set a memory limit", ErrQuotaExceeded, tenant)
+		}
+		if usage.Memory+config.Memory > limit {
+			return fmt.Errorf("%w: %s may use at most %s memory", ErrQuotaExceeded, tenant, quota.Memory)
+		}
+	}
+	if quota.CPUs > 0 {
+		if config.NanoCPUs == 0 {
+			return fmt.Errorf("%w: %s must set a CPU limit", ErrQuotaExceeded, tenant)
+		}
+		if usage.CPUs+float64(config.NanoCPUs)/1e9 > quota.CPUs {
+			return fmt.Errorf("%w: %s may use at most %v CPUs", ErrQuotaExceeded, tenant, quota.CPUs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota Quota
+		specs []ContainerSpec
+		err   error
+	}{
+		{"within every limit", Quota{Containers: 2, Memory: "128m", CPUs: 1}, []ContainerSpec{
+			{Image: "worker:1", Memory: "64m", CPUs: 0.5},
+			{Image: "worker:1", Memory: "64m", CPUs: 0.5},
+		}, nil},
+		{"too many containers", Quota{Containers: 1}, []ContainerSpec{
+			{Image: "worker:1"},
+			{Image: "worker:1"},
+		}, ErrQuotaExceeded},
+		{"too much memory", Quota{Memory: "100m"}, []ContainerSpec{
+			{Image: "worker:1", Memory: "64m"},
+			{Image: "worker:1", Memory: "64m"},
+		}, ErrQuotaExceeded},
+		{"no memory limit", Quota{Memory: "100m"}, []ContainerSpec{{Image: "worker:1"}}, ErrQuotaExceeded},
+		{"too many CPUs", Quota{CPUs: 1}, []ContainerSpec{
+			{Image: "worker:1", CPUs: 0.75},
+			{Image: "worker:1", CPUs: 0.5},
+		}, ErrQuotaExceeded},
+		{"no CPU limit", Quota{CPUs: 1}, []ContainerSpec{{Image: "worker:1"}}, ErrQuotaExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := WithTenant(context.Background(), "team")
+			m, rt := newTestManager(t, "47070-47079")
+			m.SetQuotas(map[string]Quota{"team": test.quota})
+			var err error
+			created := 0
+			for _, spec := range test.specs {
+				if _, err = m.CreateNewContainer(ctx, spec); err != nil {
+					break
+				}
+				created++
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Create returned %v, want %v", err, test.err)
+			}
+			if list, _ := rt.List(ctx, nil); len(list) != created {
+				t.Errorf("Runtime has %d containers, want the %d created ones", len(list), created)
+			}
+			if usage := m.Usage("team"); usage.Containers != created {
+				t.Errorf("Usage counts %d containers, want %d", usage.Containers, created)
+			}
+
+			// The admin and the other tenants are not limited by the quota.
+			for _, tenant := range []string{"", "other"} {
+				if _, err := m.CreateNewContainer(WithTenant(context.Background(), tenant), test.specs[0]); err != nil {
+					t.Errorf("Create of tenant %q returned %s", tenant, err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaReplace(t *testing.T) {
+	ctx := WithTenant(context.Background(), "team")
+	m, _ := newTestManager(t, "47080-47089")
+	m.SetQuotas(map[string]Quota{"team": {Containers: 1}})
+	info, err := m.CreateNewContainer(ctx, ContainerSpec{Image: "worker:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The replaced container does not count against the quota.
+	if _, err := m.Replace(ctx, info.ID); err != nil {
+		t.Fatalf("Replace at the quota returned %s", err.Error())
+	}
+	if usage := m.Usage("team"); usage.Containers != 1 {
+		t.Errorf("Usage counts %d containers after the replace, want 1", usage.Containers)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	team := WithTenant(context.Background(), "team")
+	other := WithTenant(context.Background(), "other")
+	admin := context.Background()
+	m, _ := newTestManager(t, "47090-47099")
+	info, err := m.CreateNewContainer(team, ContainerSpec{Image: "worker:1", Ports: []string{"8082"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Apply(team, Deployment{Name: "web", Replicas: 1, ContainerSpec: ContainerSpec{Image: "worker:1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := []struct {
+		name   string
+		action func(ctx context.Context) error
+	}{
+		{"inspect", func(ctx context.Context) error { _, err := m.Inspect(ctx, info.ID); return err }},
+		{"stop", func(ctx context.Context) error { _, err := m.Stop(ctx, info.ID); return err }},
+		{"restart", func(ctx context.Context) error { _, err := m.Restart(ctx, info.ID); return err }},
+		{"replace", func(ctx context.Context) error {
+			replacement, err := m.Replace(ctx, info.ID)
+			if err == nil {
+				info = replacement
+			}
+			return err
+		}},
+	}
+	for _, action := range actions {
+		if err := action.action(other); !errors.Is(err, ErrNotManaged) {
+			t.Errorf("%s by another tenant returned %v, want %v", action.name, err, ErrNotManaged)
+		}
+		if err := action.action(team); err != nil {
+			t.Errorf("%s by the owner returned %s", action.name, err.Error())
+		}
+		if err := action.action(admin); err != nil {
+			t.Errorf("%s by the admin returned %s", action.name, err.Error())
+		}
+	}
+
+	if list, _ := m.List(other); len(list) != 0 {
+		t.Errorf("Another tenant lists %d containers", len(list))
+	}
+	if _, err := m.DeploymentStatus(other, "web"); !errors.Is(err, ErrDeploymentNotFound) {
+		t.Errorf("Deployment status for another tenant returned %v, want %v", err, ErrDeploymentNotFound)
+	}
+	if _, err := m.Apply(other, Deployment{Name: "web", Replicas: 1, ContainerSpec: ContainerSpec{Image: "worker:1"}}); !errors.Is(err, ErrNameTaken) {
+		t.Errorf("Apply of a deployment of another tenant returned %v, want %v", err, ErrNameTaken)
+	}
+	if _, err := m.Remove(other, info.ID); !errors.Is(err, ErrNotManaged) {
+		t.Errorf("Remove by another tenant returned %v, want %v", err, ErrNotManaged)
+	}
+	if _, err := m.Remove(team, info.ID); err != nil {
+		t.Errorf("Remove by the owner returned %s", err.Error())
+	}
+	if ports := m.Ports().PortsOf(info.ID); len(ports) != 0 {
+		t.Errorf("Removed container still owns ports %v", ports)
+	}
+}
@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"encoding/json"
+)
+
+// The worker protocol:
+//
+// The main server offers a job to an idle worker with POST /jobs carrying a
+// Dispatch. The worker answers 202 Accepted if it takes the job or 503 Service
+// Unavailable if it is busy. While working it may POST a ProgressReport to
+// CallbackURL + "/progress", and it must finish with a ResultReport posted to
+// CallbackURL + "/result". The callback URL is only valid for the current
+// attempt, reports of an attempt which timed out are rejected with 409 Conflict.
+
+// Dispatch is the job offered to a worker.
+type Dispatch struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Attempt     int             `json:"attempt"`
+	Timeout     string          `json:"timeout"`
+	CallbackURL string          `json:"callbackUrl"`
+}
+
+// ProgressReport is sent by the worker while working on a job.
+type ProgressReport struct {
+	// Progress is the completion in percent.
+	Progress int    `json:"progress"`
+	Message  string `json:"message,omitempty"`
+}
+
+// ResultReport is sent by the worker when the job is done. A non empty Error
+// means the job failed.
+type ResultReport struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
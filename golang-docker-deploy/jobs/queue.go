@@ -0,0 +1,607 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang-docker-deploy/docker"
+)
+
+// Job statuses.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+const (
+	defaultTimeout     = 5 * time.Minute
+	defaultMaxAttempts = 3
+	// maxFinishedJobs is how many finished jobs are kept for querying.
+	maxFinishedJobs = 1000
+	// dispatchInterval is how often the queue looks for idle workers and timed out jobs.
+	dispatchInterval = time.Second
+)
+
+// ErrJobNotFound is returned when the requested job does not exist.
+var ErrJobNotFound = errors.New("No such job")
+
+// ErrInvalidJob is returned when a submitted job is not valid.
+var ErrInvalidJob = errors.New("Invalid job")
+
+// ErrStaleAttempt is returned for the reports of an attempt which is not the current one.
+var ErrStaleAttempt = errors.New("Job attempt is no longer current")
+
+// Request is a job submitted to the queue.
+type Request struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Deployment limits the job to the workers of a deployment.
+	Deployment string `json:"deployment,omitempty"`
+	// Timeout of one attempt, like "30s".
+	Timeout     string `json:"timeout,omitempty"`
+	MaxAttempts int    `json:"maxAttempts,omitempty"`
+}
+
+// Job is a queued, running or finished job.
+type Job struct {
+	ID string `json:"id"`
+	Request
+	// Tenant submitted the job, only its own workers run it. The jobs of the
+	// admin go to the workers of the admin.
+	Tenant   string `json:"tenant,omitempty"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// Worker is the container running the current or last attempt.
+	Worker string `json:"worker,omitempty"`
+	// Workers lists the containers of all attempts.
+	Workers  []string        `json:"workers,omitempty"`
+	Progress int             `json:"progress"`
+	Message  string          `json:"message,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	token    string
+	deadline time.Time
+}
+
+func (j *Job) finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+func (j *Job) tried(worker string) bool {
+	for _, id := range j.Workers {
+		if id == worker {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue keeps the submitted jobs and dispatches them to idle worker containers.
+// The jobs are persisted, so they survive a restart of the main server.
+type Queue struct {
+	manager     *docker.Manager
+	supervisor  *docker.Supervisor
+	workerHost  string
+	callbackURL string
+	client      *http.Client
+	mutex       sync.Mutex
+	jobs        map[string]*Job
+	queued      []string
+	// busy maps the worker containers to the job they are running.
+	busy         map[string]string
+	stateFile    string
+	persistMutex sync.Mutex
+	wake         chan struct{}
+}
+
+// NewQueue creates a Queue. workerHost is the host the published worker ports are
+// reachable on, callbackURL is the base URL of the main server as seen from the
+// workers. supervisor is optional, if set the unhealthy workers get no jobs.
+func NewQueue(manager *docker.Manager, supervisor *docker.Supervisor, workerHost string, callbackURL string) *Queue {
+	if workerHost == "" {
+		workerHost = "localhost"
+	}
+	return &Queue{
+		manager:     manager,
+		supervisor:  supervisor,
+		workerHost:  workerHost,
+		callbackURL: callbackURL,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		jobs:        make(map[string]*Job),
+		queued:      make([]string, 0),
+		busy:        make(map[string]string),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func visible(ctx context.Context, job *Job) bool {
+	tenant := docker.TenantFrom(ctx)
+	return tenant == "" || tenant == job.Tenant
+}
+
+// Load reads the jobs persisted in stateFile. Later changes are saved to stateFile.
+// Jobs which were running are queued again, their workers can not report back anymore.
+func (q *Queue) Load(stateFile string) error {
+	data, err := ioutil.ReadFile(filepath.Clean(stateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read jobs file: %s", err.Error())
+	}
+	loaded := make([]*Job, 0)
+	if err == nil {
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return fmt.Errorf("Failed to decode jobs file: %s", err.Error())
+		}
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].Created.Before(loaded[j].Created)
+	})
+
+	q.mutex.Lock()
+	for _, job := range loaded {
+		if job.Status == StatusRunning {
+			job.Status = StatusQueued
+			job.Message = "Requeued after restart"
+		}
+		if job.Status == StatusQueued {
+			q.queued = append(q.queued, job.ID)
+		}
+		q.jobs[job.ID] = job
+	}
+	q.stateFile = stateFile
+	q.mutex.Unlock()
+	q.persist()
+	return nil
+}
+
+// persist writes the jobs to the state file, if there is one.
+func (q *Queue) persist() {
+	q.persistMutex.Lock()
+	defer q.persistMutex.Unlock()
+	q.mutex.Lock()
+	if q.stateFile == "" {
+		q.mutex.Unlock()
+		return
+	}
+	list := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		list = append(list, job)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	stateFile := q.stateFile
+	q.mutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to encode jobs: %s", err.Error())
+		return
+	}
+	// Write and rename, so a crash never leaves a truncated file behind.
+	tmpName := stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0600); err != nil {
+		log.Printf("Failed to write jobs file: %s", err.Error())
+		return
+	}
+	if err := os.Rename(tmpName, stateFile); err != nil {
+		log.Printf("Failed to write jobs file: %s", err.Error())
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Submit validates the job request and queues it. The job belongs to the tenant of ctx
+// and only runs on the workers of that tenant.
+func (q *Queue) Submit(ctx context.Context, req Request) (*Job, error) {
+	if req.Type == "" {
+		return nil, fmt.Errorf("%w: missing job type", ErrInvalidJob)
+	}
+	timeout := defaultTimeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%w: invalid timeout %q", ErrInvalidJob, req.Timeout)
+		}
+	}
+	req.Timeout = timeout.String()
+	if req.MaxAttempts < 0 {
+		return nil, fmt.Errorf("%w: negative attempt count", ErrInvalidJob)
+	}
+	if req.MaxAttempts == 0 {
+		req.MaxAttempts = defaultMaxAttempts
+	}
+	if req.Deployment != "" {
+		if _, err := q.manager.Deployment(ctx, req.Deployment); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidJob, err.Error())
+		}
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		ID:      id,
+		Request: req,
+		Tenant:  docker.TenantFrom(ctx),
+		Status:  StatusQueued,
+		Created: time.Now().UTC(),
+	}
+	q.mutex.Lock()
+	q.jobs[id] = job
+	q.queued = append(q.queued, id)
+	copied := *job
+	q.mutex.Unlock()
+	q.persist()
+	q.notify()
+	return &copied, nil
+}
+
+// Job returns the job with the given ID, if it belongs to the tenant of ctx.
+func (q *Queue) Job(ctx context.Context, id string) (Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, ok := q.jobs[id]
+	if !ok || !visible(ctx, job) {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return *job, nil
+}
+
+// Jobs returns the jobs of the tenant of ctx with the given status, or all of
+// them if status is empty, oldest first.
+func (q *Queue) Jobs(ctx context.Context, status string) []Job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	list := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		if visible(ctx, job) && (status == "" || job.Status == status) {
+			list = append(list, *job)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// current returns the running job if token belongs to its current attempt.
+// Must be called with the mutex held.
+func (q *Queue) current(id string, token string) (*Job, error) {
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if job.Status != StatusRunning || job.token == "" || job.token != token {
+		return nil, fmt.Errorf("%w: %s", ErrStaleAttempt, id)
+	}
+	return job, nil
+}
+
+// Progress records the progress reported by the worker running the attempt identified by token.
+func (q *Queue) Progress(id string, token string, report ProgressReport) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	job, err := q.current(id, token)
+	if err != nil {
+		return err
+	}
+	if report.Progress < 0 {
+		report.Progress = 0
+	}
+	if report.Progress > 100 {
+		report.Progress = 100
+	}
+	job.Progress = report.Progress
+	job.Message = report.Message
+	// A worker busy with a job is not idle.
+	q.manager.Touch(job.Worker)
+	return nil
+}
+
+// Complete records the result reported by the worker running the attempt identified by token.
+func (q *Queue) Complete(id string, token string, report ResultReport) error {
+	q.mutex.Lock()
+	job, err := q.current(id, token)
+	if err != nil {
+		q.mutex.Unlock()
+		return err
+	}
+	now := time.Now().UTC()
+	job.Finished = &now
+	job.Result = report.Result
+	job.token = ""
+	if report.Error != "" {
+		job.Status = StatusFailed
+		job.Error = report.Error
+	} else {
+		job.Status = StatusSucceeded
+		job.Progress = 100
+	}
+	delete(q.busy, job.Worker)
+	q.manager.Touch(job.Worker)
+	q.prune()
+	q.mutex.Unlock()
+
+	log.Printf("Job %s %s on worker %s", id, job.Status, job.Worker)
+	q.persist()
+	q.notify()
+	return nil
+}
+
+// prune drops the oldest finished jobs above maxFinishedJobs. Must be called with the mutex held.
+func (q *Queue) prune() {
+	finished := make([]*Job, 0)
+	for _, job := range q.jobs {
+		if job.finished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].Finished.Before(*finished[j].Finished)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(q.jobs, job.ID)
+	}
+}
+
+// Run dispatches the queued jobs and retries the timed out ones until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context) {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+	for {
+		q.expire(time.Now())
+		q.dispatch(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// expire ends the attempts running past their deadline. The job is queued again
+// for another worker, or fails when it is out of attempts.
+func (q *Queue) expire(now time.Time) {
+	q.mutex.Lock()
+	changed := false
+	for _, job := range q.jobs {
+		if job.Status != StatusRunning || now.Before(job.deadline) {
+			continue
+		}
+		changed = true
+		delete(q.busy, job.Worker)
+		job.token = ""
+		if job.Attempts >= job.MaxAttempts {
+			finished := now.UTC()
+			job.Status = StatusFailed
+			job.Finished = &finished
+			job.Error = fmt.Sprintf("Timed out after %d attempts", job.Attempts)
+			log.Printf("Job %s failed: %s", job.ID, job.Error)
+			continue
+		}
+		job.Status = StatusQueued
+		job.Message = fmt.Sprintf("Attempt %d timed out on worker %s", job.Attempts, job.Worker)
+		log.Printf("Job %s: %s, retrying", job.ID, job.Message)
+		// Retries go first, the job has waited long enough.
+		q.queued = append([]string{job.ID}, q.queued...)
+	}
+	if changed {
+		q.prune()
+	}
+	q.mutex.Unlock()
+	if changed {
+		q.persist()
+	}
+}
+
+// worker is a container able to take a job.
+type worker struct {
+	info docker.ContainerInfo
+	url  string
+}
+
+// idleWorkers returns the running, healthy workers without a job.
+func (q *Queue) idleWorkers(ctx context.Context) ([]worker, error) {
+	list, err := q.manager.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	workers := make([]worker, 0, len(list))
+	for _, info := range list {
+		// Only the containers of a worker spec speak the job protocol, redis or
+		// a stack service would burn the attempts of the job.
+		if info.State != "running" || len(info.Ports) == 0 || info.Labels[docker.LabelWorker] != "true" || q.busy[info.ID] != "" {
+			continue
+		}
+		if q.supervisor != nil {
+			if status, ok := q.supervisor.StatusOf(info.ID); ok && status.Status == docker.HealthUnhealthy {
+				continue
+			}
+		}
+		workers = append(workers, worker{
+			info: info,
+			url:  "http://" + net.JoinHostPort(q.workerHost, info.Ports[0].HostPort) + "/jobs",
+		})
+	}
+	return workers, nil
+}
+
+// candidates returns the workers suitable for job, the ones which did not try it yet first.
+func candidates(job *Job, workers []worker) []worker {
+	fresh := make([]worker, 0, len(workers))
+	tried := make([]worker, 0)
+	for _, w := range workers {
+		// The payload and the result stay with the tenant.
+		if w.info.Tenant != job.Tenant {
+			continue
+		}
+		if job.Deployment != "" && w.info.Deployment != job.Deployment {
+			continue
+		}
+		if job.tried(w.info.ID) {
+			tried = append(tried, w)
+		} else {
+			fresh = append(fresh, w)
+		}
+	}
+	// A retry goes to a worker which has not tried the job, if there is one.
+	return append(fresh, tried...)
+}
+
+// dispatch offers the queued jobs to the idle workers in submission order.
+func (q *Queue) dispatch(ctx context.Context) {
+	q.mutex.Lock()
+	pending := len(q.queued)
+	q.mutex.Unlock()
+	if pending == 0 {
+		return
+	}
+	workers, err := q.idleWorkers(ctx)
+	if err != nil {
+		log.Printf("Failed to list workers: %s", err.Error())
+		return
+	}
+	// Workers refusing or failing an offer are left alone until the next round.
+	skipped := make(map[string]bool)
+
+	q.mutex.Lock()
+	queued := append([]string(nil), q.queued...)
+	q.mutex.Unlock()
+	for _, id := range queued {
+		q.mutex.Lock()
+		job, ok := q.jobs[id]
+		if !ok || job.Status != StatusQueued {
+			q.mutex.Unlock()
+			continue
+		}
+		available := make([]worker, 0, len(workers))
+		for _, w := range candidates(job, workers) {
+			if !skipped[w.info.ID] && q.busy[w.info.ID] == "" {
+				available = append(available, w)
+			}
+		}
+		q.mutex.Unlock()
+
+		for _, w := range available {
+			if q.offer(ctx, id, w) {
+				break
+			}
+			skipped[w.info.ID] = true
+		}
+	}
+}
+
+// offer starts a new attempt of the job on the worker. It tells whether the worker took it.
+func (q *Queue) offer(ctx context.Context, id string, w worker) bool {
+	token, err := newID()
+	if err != nil {
+		return false
+	}
+	q.mutex.Lock()
+	job := q.jobs[id]
+	timeout, _ := time.ParseDuration(job.Timeout)
+	started := time.Now().UTC()
+	// The attempt is set up before the offer, the worker may report back right away.
+	previous := *job
+	job.Status = StatusRunning
+	job.token = token
+	job.Attempts++
+	job.Worker = w.info.ID
+	job.Started = &started
+	job.deadline = started.Add(timeout)
+	job.Progress = 0
+	q.busy[w.info.ID] = id
+	dispatch := Dispatch{
+		ID:          job.ID,
+		Type:        job.Type,
+		Payload:     job.Payload,
+		Attempt:     job.Attempts,
+		Timeout:     job.Timeout,
+		CallbackURL: fmt.Sprintf("%s/jobs/%s/attempts/%s", q.callbackURL, job.ID, token),
+	}
+	q.mutex.Unlock()
+
+	err = q.send(ctx, w.url, dispatch)
+
+	q.mutex.Lock()
+	if err != nil && job.token == token {
+		// Not taken, unless the worker reported back already.
+		previous.Workers = job.Workers
+		*job = previous
+		delete(q.busy, w.info.ID)
+		q.mutex.Unlock()
+		log.Printf("Worker %s did not take job %s: %s", w.info.ID, id, err.Error())
+		return false
+	}
+	for i, queuedID := range q.queued {
+		if queuedID == id {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			break
+		}
+	}
+	if !job.tried(w.info.ID) {
+		job.Workers = append(job.Workers, w.info.ID)
+	}
+	q.mutex.Unlock()
+	q.manager.Touch(w.info.ID)
+
+	log.Printf("Job %s (attempt %d) dispatched to worker %s", id, dispatch.Attempt, w.info.ID)
+	q.persist()
+	return true
+}
+
+func (q *Queue) send(ctx context.Context, url string, dispatch Dispatch) error {
+	body, err := json.Marshal(dispatch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("worker answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"golang-docker-deploy/docker"
+)
+
+func newTestQueue(t *testing.T) *Queue {
+	t.Helper()
+	rt := docker.NewFakeRuntime()
+	rt.AddImage("worker:1")
+	ports, err := docker.ParsePortRange("47110-47119")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := docker.NewManager(rt, ports)
+	deployment := docker.Deployment{Name: "workers", ContainerSpec: docker.ContainerSpec{Image: "worker:1"}}
+	if _, err := manager.Apply(docker.WithTenant(context.Background(), "team"), deployment); err != nil {
+		t.Fatal(err)
+	}
+	return NewQueue(manager, nil, "", "http://deploy:8080")
+}
+
+func TestSubmit(t *testing.T) {
+	tests := []struct {
+		name   string
+		tenant string
+		req    Request
+		err    error
+	}{
+		{"defaults", "team", Request{Type: "resize"}, nil},
+		{"own deployment", "team", Request{Type: "resize", Deployment: "workers", Timeout: "1m", MaxAttempts: 1}, nil},
+		{"admin on any deployment", "", Request{Type: "resize", Deployment: "workers"}, nil},
+		{"no type", "team", Request{}, ErrInvalidJob},
+		{"invalid timeout", "team", Request{Type: "resize", Timeout: "soon"}, ErrInvalidJob},
+		{"negative timeout", "team", Request{Type: "resize", Timeout: "-1s"}, ErrInvalidJob},
+		{"negative attempts", "team", Request{Type: "resize", MaxAttempts: -1}, ErrInvalidJob},
+		{"unknown deployment", "team", Request{Type: "resize", Deployment: "other"}, ErrInvalidJob},
+		{"deployment of another tenant", "other", Request{Type: "resize", Deployment: "workers"}, ErrInvalidJob},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestQueue(t)
+			job, err := q.Submit(docker.WithTenant(context.Background(), test.tenant), test.req)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Submit returned %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if job.Status != StatusQueued || job.Tenant != test.tenant || job.MaxAttempts < 1 || job.Timeout == "" {
+				t.Errorf("Submitted job is %+v", job)
+			}
+		})
+	}
+}
+
+func TestJobVisibility(t *testing.T) {
+	q := newTestQueue(t)
+	team := docker.WithTenant(context.Background(), "team")
+	job, err := q.Submit(team, Request{Type: "resize"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Job(team, job.ID); err != nil {
+		t.Errorf("Job of the owner returned %s", err.Error())
+	}
+	if _, err := q.Job(context.Background(), job.ID); err != nil {
+		t.Errorf("Job of the admin returned %s", err.Error())
+	}
+	if _, err := q.Job(docker.WithTenant(context.Background(), "other"), job.ID); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Job of another tenant returned %v, want %v", err, ErrJobNotFound)
+	}
+	if jobs := q.Jobs(docker.WithTenant(context.Background(), "other"), ""); len(jobs) != 0 {
+		t.Errorf("Another tenant lists jobs %v", jobs)
+	}
+	if jobs := q.Jobs(team, StatusRunning); len(jobs) != 0 {
+		t.Errorf("Jobs filtered by status are %v", jobs)
+	}
+}
+
+func TestReports(t *testing.T) {
+	q := newTestQueue(t)
+	job, err := q.Submit(context.Background(), Request{Type: "resize"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Progress(job.ID, "", ProgressReport{Progress: 10}); !errors.Is(err, ErrStaleAttempt) {
+		t.Errorf("Progress of a queued job returned %v, want %v", err, ErrStaleAttempt)
+	}
+	if err := q.Progress("unknown", "", ProgressReport{}); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Progress of an unknown job returned %v, want %v", err, ErrJobNotFound)
+	}
+
+	// Running as if dispatched to a worker.
+	q.mutex.Lock()
+	q.jobs[job.ID].Status = StatusRunning
+	q.jobs[job.ID].token = "attempt"
+	q.mutex.Unlock()
+
+	if err := q.Progress(job.ID, "previous", ProgressReport{Progress: 10}); !errors.Is(err, ErrStaleAttempt) {
+		t.Errorf("Progress of another attempt returned %v, want %v", err, ErrStaleAttempt)
+	}
+	if err := q.Progress(job.ID, "attempt", ProgressReport{Progress: 150, Message: "almost"}); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := q.Job(context.Background(), job.ID); current.Progress != 100 || current.Message != "almost" {
+		t.Errorf("Progress is %d %q, want 100 \"almost\"", current.Progress, current.Message)
+	}
+	if err := q.Complete(job.ID, "attempt", ResultReport{Result: json.RawMessage(`{"ok":true}`)}); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := q.Job(context.Background(), job.ID)
+	if current.Status != StatusSucceeded || string(current.Result) != `{"ok":true}` || current.Finished == nil {
+		t.Errorf("Completed job is %+v", current)
+	}
+	if err := q.Complete(job.ID, "attempt", ResultReport{Error: "again"}); !errors.Is(err, ErrStaleAttempt) {
+		t.Errorf("Second completion returned %v, want %v", err, ErrStaleAttempt)
+	}
+}
@@ -2,29 +2,250 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"golang-docker-deploy/docker"
+	"golang-docker-deploy/jobs"
+	"golang-docker-deploy/proxy"
+	"golang-docker-deploy/registry"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
+// defaultPortRange is the host port range of the workers unless PORT_RANGE is set.
+const defaultPortRange = "8082-8181"
+
+// defaultStateFile is where the deployment state is kept unless STATE_FILE is set.
+const defaultStateFile = "./state.json"
+
+// defaultJobsFile is where the job queue is kept unless JOBS_FILE is set.
+const defaultJobsFile = "./jobs.json"
+
+// minStatsInterval and maxStatsInterval bound the sampling interval of /stats.
+const (
+	minStatsInterval = time.Second
+	maxStatsInterval = time.Minute
+)
+
+// defaultCallbackURL is the main server as seen from the workers unless CALLBACK_URL
+// is set: the host port 8081 behind the gateway of the default docker bridge network.
+const defaultCallbackURL = "http://172.17.0.1:8081"
+
+var manager *docker.Manager
+var supervisor *docker.Supervisor
+var eventWatcher *docker.EventWatcher
+var jobQueue *jobs.Queue
+var workerRegistry *registry.Registry
+
+// callbackURL is the base URL of the main server as seen from the workers.
+var callbackURL string
+
+// registrationToken must be sent by the workers registering themselves from
+// outside, from REGISTRATION_TOKEN. The workers started by HelloServer get a
+// credential of their own instead. Without it any worker may register.
+var registrationToken string
+
+// tenants maps the API tokens to the tenants. Without tenants and ADMIN_TOKEN
+// the API is open and everything belongs to a single anonymous tenant.
+var tenants map[string]docker.Tenant
+var adminToken string
+
+// workerTTL and workerIdleTimeout are the default lease of the workers started by
+// HelloServer, from WORKER_TTL and WORKER_IDLE_TIMEOUT. Empty means no limit.
+var workerTTL string
+var workerIdleTimeout string
+
+// statsAllowedOrigin is the origin allowed to read /stats from a browser, like the
+// Grafana URL, from STATS_ALLOWED_ORIGIN. Without it no cross origin access is allowed.
+var statsAllowedOrigin string
+
 func main() {
+	rt, err := docker.NewDockerRuntime()
+	if err != nil {
+		log.Fatal(err)
+	}
+	portRange := os.Getenv("PORT_RANGE")
+	if portRange == "" {
+		portRange = defaultPortRange
+	}
+	ports, err := docker.ParsePortRange(portRange)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manager = docker.NewManager(rt, ports)
+	docker.MaxCopySize = int64(envInt("MAX_COPY_SIZE", int(docker.MaxCopySize)))
+	if roots := os.Getenv("BIND_MOUNT_ROOTS"); roots != "" {
+		docker.BindRoots = strings.Split(roots, ",")
+	}
+	if authFile := os.Getenv("REGISTRY_AUTH_FILE"); authFile != "" {
+		credentials, err := docker.LoadRegistryCredentials(authFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		manager.SetRegistryCredentials(credentials)
+	}
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	tenants = make(map[string]docker.Tenant)
+	if tenantsFile := os.Getenv("TENANTS_FILE"); tenantsFile != "" {
+		list, err := docker.LoadTenants(tenantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		quotas := make(map[string]docker.Quota, len(list))
+		for _, tenant := range list {
+			tenants[tenant.Token] = tenant
+			quotas[tenant.Name] = tenant.Quota
+		}
+		manager.SetQuotas(quotas)
+	}
+	stateFile := os.Getenv("STATE_FILE")
+	if stateFile == "" {
+		stateFile = defaultStateFile
+	}
+	adopt, _ := strconv.ParseBool(os.Getenv("ADOPT_ORPHANS"))
+	orphans, err := manager.Restore(context.Background(), stateFile, adopt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(orphans) > 0 {
+		log.Printf("%d orphan containers found, see /orphans", len(orphans))
+	}
+
+	supervisor = docker.NewSupervisor(manager, docker.SupervisorConfig{
+		Interval:         envDuration("HEALTH_INTERVAL", 10*time.Second),
+		Timeout:          envDuration("HEALTH_TIMEOUT", 2*time.Second),
+		StartPeriod:      envDuration("HEALTH_START_PERIOD", 5*time.Second),
+		FailureThreshold: envInt("HEALTH_FAILURES", 3),
+		Action:           os.Getenv("HEALTH_ACTION"),
+		ProbeHost:        os.Getenv("WORKER_HOST"),
+	})
+	go supervisor.Run(context.Background())
+	go manager.RunReconciler(context.Background(), envDuration("RECONCILE_INTERVAL", 30*time.Second))
+
+	eventWatcher = docker.NewEventWatcher(manager)
+	for _, webhookURL := range strings.Split(os.Getenv("WEBHOOKS"), ",") {
+		if webhookURL = strings.TrimSpace(webhookURL); webhookURL == "" {
+			continue
+		}
+		if _, err := eventWatcher.AddWebhook(context.Background(), webhookURL, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go eventWatcher.Run(context.Background())
+
+	workerTTL = os.Getenv("WORKER_TTL")
+	workerIdleTimeout = os.Getenv("WORKER_IDLE_TIMEOUT")
+	reaper := docker.NewReaper(manager, eventWatcher, docker.ReaperConfig{
+		Interval: envDuration("LEASE_INTERVAL", 10*time.Second),
+		Warning:  envDuration("LEASE_WARNING", time.Minute),
+	})
+	go reaper.Run(context.Background())
+
+	statsAllowedOrigin = strings.TrimRight(os.Getenv("STATS_ALLOWED_ORIGIN"), "/")
+
+	workerProxy := proxy.NewProxy(manager, supervisor, os.Getenv("WORKER_HOST"))
+
+	callbackURL = os.Getenv("CALLBACK_URL")
+	if callbackURL == "" {
+		callbackURL = defaultCallbackURL
+	}
+	callbackURL = strings.TrimRight(callbackURL, "/")
+	jobQueue = jobs.NewQueue(manager, supervisor, os.Getenv("WORKER_HOST"), callbackURL)
+	jobsFile := os.Getenv("JOBS_FILE")
+	if jobsFile == "" {
+		jobsFile = defaultJobsFile
+	}
+	if err := jobQueue.Load(jobsFile); err != nil {
+		log.Fatal(err)
+	}
+	go jobQueue.Run(context.Background())
+
+	registrationToken = os.Getenv("REGISTRATION_TOKEN")
+	workerRegistry = registry.NewRegistry(manager, callbackURL, registry.Config{
+		HeartbeatInterval: envDuration("HEARTBEAT_INTERVAL", 10*time.Second),
+		MissedHeartbeats:  envInt("HEARTBEAT_MISSES", 3),
+		Token:             registrationToken,
+	})
+	go workerRegistry.Run(context.Background())
 
 	r := mux.NewRouter()
-	r.HandleFunc("/", HelloServer)
+	// The workers authenticate their job reports with the attempt token in the URL.
+	r.HandleFunc("/jobs/{id}/attempts/{token}/progress", reportJobProgress).Methods(http.MethodPost)
+	r.HandleFunc("/jobs/{id}/attempts/{token}/result", reportJobResult).Methods(http.MethodPost)
+	// The workers register with the registration token or their own credential,
+	// then use the session token in the URL.
+	r.HandleFunc("/registry", registerWorker).Methods(http.MethodPost)
+	r.HandleFunc("/registry/{id}/sessions/{token}", workerHeartbeat).Methods(http.MethodPost)
+	r.HandleFunc("/registry/{id}/sessions/{token}", deregisterWorker).Methods(http.MethodDelete)
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(authenticate)
+	api.HandleFunc("/", HelloServer)
+	api.HandleFunc("/containers", listContainers).Methods(http.MethodGet)
+	api.HandleFunc("/containers", createContainer).Methods(http.MethodPost)
+	api.HandleFunc("/containers/{id}", inspectContainer).Methods(http.MethodGet)
+	api.HandleFunc("/containers/{id}", removeContainer).Methods(http.MethodDelete)
+	api.HandleFunc("/containers/{id}/stop", stopContainer).Methods(http.MethodPost)
+	api.HandleFunc("/containers/{id}/restart", restartContainer).Methods(http.MethodPost)
+	api.HandleFunc("/containers/{id}/lease", extendLease).Methods(http.MethodPost)
+	api.HandleFunc("/containers/{id}/health", containerHealth).Methods(http.MethodGet)
+	api.HandleFunc("/containers/{id}/stats", containerStats).Methods(http.MethodGet)
+	api.HandleFunc("/containers/{id}/logs", containerLogs).Methods(http.MethodGet)
+	api.HandleFunc("/containers/{id}/exec", execContainer).Methods(http.MethodPost)
+	api.HandleFunc("/containers/{id}/exec/ws", execInteractive).Methods(http.MethodGet)
+	api.HandleFunc("/containers/{id}/files", downloadFiles).Methods(http.MethodGet)
+	api.HandleFunc("/containers/{id}/files", uploadFiles).Methods(http.MethodPut)
+	api.HandleFunc("/containers/{id}/files", adminOnly(copyLocalFiles)).Methods(http.MethodPost)
+	api.HandleFunc("/containers/{id}/commit", commitContainer).Methods(http.MethodPost)
+	api.HandleFunc("/containers/{id}/export", exportContainer).Methods(http.MethodGet)
+	api.HandleFunc("/health", listHealth).Methods(http.MethodGet)
+	api.HandleFunc("/stats", streamStats).Methods(http.MethodGet)
+	api.HandleFunc("/deployments", applyDeployment).Methods(http.MethodPost, http.MethodPut)
+	api.HandleFunc("/deployments", listDeployments).Methods(http.MethodGet)
+	api.HandleFunc("/deployments/{name}", getDeployment).Methods(http.MethodGet)
+	api.HandleFunc("/deployments/{name}", deleteDeployment).Methods(http.MethodDelete)
+	api.HandleFunc("/stacks", listStacks).Methods(http.MethodGet)
+	api.HandleFunc("/stacks/{name}", deployStack).Methods(http.MethodPost)
+	api.HandleFunc("/stacks/{name}", getStack).Methods(http.MethodGet)
+	api.HandleFunc("/stacks/{name}", removeStack).Methods(http.MethodDelete)
+	api.HandleFunc("/snapshots", listSnapshots).Methods(http.MethodGet)
+	api.HandleFunc("/snapshots/{ref:.+}", getSnapshot).Methods(http.MethodGet)
+	api.HandleFunc("/snapshots/{ref:.+}", removeSnapshot).Methods(http.MethodDelete)
+	api.HandleFunc("/orphans", adminOnly(listOrphans)).Methods(http.MethodGet)
+	api.HandleFunc("/orphans/{id}/adopt", adminOnly(adoptOrphan)).Methods(http.MethodPost)
+	api.HandleFunc("/events", streamEvents).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks", listWebhooks).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks", addWebhook).Methods(http.MethodPost)
+	api.HandleFunc("/webhooks/{id}", removeWebhook).Methods(http.MethodDelete)
+	api.HandleFunc("/ports", adminOnly(listPorts)).Methods(http.MethodGet)
+	api.HandleFunc("/tenant", getTenant).Methods(http.MethodGet)
+	api.HandleFunc("/registry", listWorkers).Methods(http.MethodGet)
+	api.HandleFunc("/jobs", submitJob).Methods(http.MethodPost)
+	api.HandleFunc("/jobs", listJobs).Methods(http.MethodGet)
+	api.HandleFunc("/jobs/{id}", getJob).Methods(http.MethodGet)
+	api.HandleFunc("/images/build", adminOnly(buildImage)).Methods(http.MethodPost)
+	api.HandleFunc("/images/pull", pullImage).Methods(http.MethodPost)
+	api.HandleFunc("/rollouts", rollingUpdate).Methods(http.MethodPost)
+	api.PathPrefix("/workers/{id}/").HandlerFunc(workerProxy.ServeWorker)
+	api.PathPrefix("/pool/").HandlerFunc(workerProxy.ServePool)
 	// Create Server and Route Handlers
+	// There is no write timeout, the build log is streamed for as long as the build runs.
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         ":8081",
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Handler:     r,
+		Addr:        ":8081",
+		ReadTimeout: 10 * time.Second,
 	}
 
 	// Start Server
@@ -55,12 +276,1097 @@ func waitForShutdown(srv *http.Server) {
 	os.Exit(0)
 }
 
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %s", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, docker.ErrNotManaged), docker.IsNotFound(err), errors.Is(err, docker.ErrDeploymentNotFound),
+		errors.Is(err, docker.ErrStackNotFound), errors.Is(err, jobs.ErrJobNotFound), errors.Is(err, registry.ErrWorkerNotFound),
+		errors.Is(err, docker.ErrPathNotFound), errors.Is(err, docker.ErrSnapshotNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, docker.ErrInvalidSpec), errors.Is(err, jobs.ErrInvalidJob), errors.Is(err, registry.ErrInvalidRegistration):
+		status = http.StatusBadRequest
+	case errors.Is(err, registry.ErrInvalidCredential):
+		status = http.StatusUnauthorized
+	case errors.Is(err, docker.ErrQuotaExceeded), errors.Is(err, docker.ErrMountNotAllowed):
+		status = http.StatusForbidden
+	case errors.Is(err, docker.ErrTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, docker.ErrNameTaken), errors.Is(err, docker.ErrNotRunning), errors.Is(err, jobs.ErrStaleAttempt),
+		errors.Is(err, docker.ErrRolloutInProgress), errors.Is(err, docker.ErrStackExists), errors.Is(err, docker.ErrPortInUse),
+		errors.Is(err, docker.ErrImageInUse):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// progressResponse streams the pull progress of a create or deploy request as newline
+// delimited JSON when the client accepts application/x-ndjson, the stream ends with
+// the result or {"error": ...}. Other clients get the plain JSON response.
+type progressResponse struct {
+	w         http.ResponseWriter
+	encoder   *json.Encoder
+	streaming bool
+}
+
+// withPullProgress returns the request context, reporting the pull progress to the
+// response if the client asked for it.
+func withPullProgress(w http.ResponseWriter, r *http.Request) (context.Context, *progressResponse) {
+	response := &progressResponse{w: w, encoder: json.NewEncoder(w)}
+	if !strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		return r.Context(), response
+	}
+	flusher, _ := w.(http.Flusher)
+	return docker.WithPullProgress(r.Context(), func(progress docker.PullProgress) {
+		if !response.streaming {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			response.streaming = true
+		}
+		if err := response.encoder.Encode(progress); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}), response
+}
+
+// result writes v with status, or err, after the progress if any was streamed.
+func (p *progressResponse) result(status int, v interface{}, err error) {
+	if !p.streaming {
+		if err != nil {
+			writeError(p.w, err)
+			return
+		}
+		writeJSON(p.w, status, v)
+		return
+	}
+	if err != nil {
+		v = map[string]string{"error": err.Error()}
+	}
+	if err := p.encoder.Encode(v); err != nil {
+		log.Printf("Failed to write response: %s", err.Error())
+	}
+}
+
+// authenticate resolves the bearer token of the request to a tenant and acts on
+// its behalf. The admin token acts without tenant and sees everything.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(tenants) == 0 && adminToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken != "" && token == adminToken {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenant, ok := tenants[token]
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Missing or invalid API token"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(docker.WithTenant(r.Context(), tenant.Name)))
+	})
+}
+
+// adminOnly rejects the requests made on behalf of a tenant.
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if docker.TenantFrom(r.Context()) != "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "Admin access required"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// getTenant shows the quota and the resource usage of the calling tenant.
+func getTenant(w http.ResponseWriter, r *http.Request) {
+	name := docker.TenantFrom(r.Context())
+	quota := docker.Quota{}
+	for _, tenant := range tenants {
+		if tenant.Name == name {
+			quota = tenant.Quota
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":  name,
+		"quota": quota,
+		"usage": manager.Usage(name),
+	})
+}
+
 func HelloServer(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Hello, Server!")
-	id, err := docker.CreateNewContainer("artofimagination/worker-server", "0.0.0.0", "8082")
+	spec := docker.ContainerSpec{
+		Image:       "artofimagination/worker-server",
+		Address:     "0.0.0.0",
+		Ports:       []string{"8082"},
+		Probe:       &docker.Probe{Port: "8082"},
+		Worker:      true,
+		Env:         map[string]string{"DEPLOY_SERVER": callbackURL},
+		TTL:         workerTTL,
+		IdleTimeout: workerIdleTimeout,
+	}
+	if registrationToken != "" {
+		// The tenant can read the environment of its workers, the registration
+		// token must not be in there.
+		nonce, credential, err := workerRegistry.Credential()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		spec.Labels = map[string]string{registry.LabelCredential: nonce}
+		spec.Env["REGISTRATION_TOKEN"] = credential
+	}
+	// The lease can be chosen per worker: /?ttl=30m&idleTimeout=5m
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		spec.TTL = ttl
+	}
+	if idleTimeout := r.URL.Query().Get("idleTimeout"); idleTimeout != "" {
+		spec.IdleTimeout = idleTimeout
+	}
+	ctx, response := withPullProgress(w, r)
+	info, err := manager.CreateNewContainer(ctx, spec)
+	response.result(http.StatusCreated, info, err)
+	if err == nil {
+		log.Println("Hello, Server...")
+	}
+}
+
+func createContainer(w http.ResponseWriter, r *http.Request) {
+	spec := docker.ContainerSpec{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ctx, response := withPullProgress(w, r)
+	info, err := manager.CreateNewContainer(ctx, spec)
+	response.result(http.StatusCreated, info, err)
+}
+
+func listContainers(w http.ResponseWriter, r *http.Request) {
+	list, err := manager.List(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func inspectContainer(w http.ResponseWriter, r *http.Request) {
+	info, err := manager.Inspect(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func stopContainer(w http.ResponseWriter, r *http.Request) {
+	info, err := manager.Stop(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func restartContainer(w http.ResponseWriter, r *http.Request) {
+	info, err := manager.Restart(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// extendLease moves the end of the time to live of a container: {"ttl": "30m"}.
+func extendLease(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		TTL string `json:"ttl"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ttl, err := time.ParseDuration(request.TTL)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid ttl %q", request.TTL)})
+		return
+	}
+	info, err := manager.ExtendLease(r.Context(), mux.Vars(r)["id"], ttl)
 	if err != nil {
-		fmt.Fprintln(w, err.Error())
+		writeError(w, err)
+		return
 	}
-	fmt.Fprintln(w, id)
-	log.Println("Hello, Server...")
+	writeJSON(w, http.StatusOK, info)
+}
+
+// downloadFiles returns ?path= of a container. A file is returned as is, a
+// directory as a tar archive, format=tar returns a file as archive too.
+func downloadFiles(w http.ResponseWriter, r *http.Request) {
+	id, srcPath := mux.Vars(r)["id"], r.URL.Query().Get("path")
+	archive, stat, err := manager.CopyFromContainer(r.Context(), id, srcPath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if r.URL.Query().Get("format") != "tar" && !stat.Mode.IsDir() {
+		archive.Close()
+		content, stat, err := manager.CopyFileFromContainer(r.Context(), id, srcPath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer content.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(stat.Size, 10))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", stat.Name))
+		w.Header().Set("Last-Modified", stat.Mtime.UTC().Format(http.TimeFormat))
+		if _, err := io.Copy(w, content); err != nil {
+			log.Printf("Download of %s:%s failed: %s", id, srcPath, err.Error())
+		}
+		return
+	}
+
+	defer archive.Close()
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", stat.Name+".tar"))
+	if _, err := io.Copy(w, archive); err != nil {
+		// The status line is gone already, the client gets a truncated archive.
+		log.Printf("Download of %s:%s failed: %s", id, srcPath, err.Error())
+	}
+}
+
+// uploadFiles copies the request body into a container. With Content-Type
+// application/x-tar the archive is extracted into the directory ?path=, any
+// other body is written to the file ?path=.
+func uploadFiles(w http.ResponseWriter, r *http.Request) {
+	id, dstPath := mux.Vars(r)["id"], r.URL.Query().Get("path")
+	var err error
+	if r.Header.Get("Content-Type") == "application/x-tar" {
+		err = manager.CopyToContainer(r.Context(), id, dstPath, r.Body)
+	} else {
+		err = manager.CopyFileToContainer(r.Context(), id, dstPath, r.Body)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// copyLocalFiles copies a file or directory of the server into a container, admin only:
+// {"source": "/srv/config", "path": "/etc/app"}.
+func copyLocalFiles(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Source string `json:"source"`
+		Path   string `json:"path"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if request.Source == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing source"})
+		return
+	}
+	if err := manager.CopyLocalToContainer(r.Context(), mux.Vars(r)["id"], request.Source, request.Path); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commitContainer snapshots a container into an image:
+// {"reference": "snapshots/worker:bug-42", "author": "...", "message": "...", "changes": ["ENV DEBUG=1"]}.
+func commitContainer(w http.ResponseWriter, r *http.Request) {
+	options := docker.CommitOptions{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&options); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	snapshot, err := manager.CommitContainer(r.Context(), mux.Vars(r)["id"], options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, snapshot)
+}
+
+// exportContainer streams the filesystem of a container as a tar archive.
+func exportContainer(w http.ResponseWriter, r *http.Request) {
+	info, err := manager.Inspect(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	archive, err := manager.ExportContainer(r.Context(), info.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer archive.Close()
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name+".tar"))
+	if _, err := io.Copy(w, archive); err != nil {
+		log.Printf("Export of %s failed: %s", info.ID, err.Error())
+	}
+}
+
+func removeContainer(w http.ResponseWriter, r *http.Request) {
+	info, err := manager.Remove(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// containerLogs streams the log of a container as plain text or, with format=sse
+// or an Accept: text/event-stream header, as server-sent events.
+// Query parameters: follow, since (timestamp or duration like 10m), tail (line count or all).
+func containerLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	follow, _ := strconv.ParseBool(query.Get("follow"))
+	options := docker.LogOptions{
+		Follow:     follow,
+		Since:      query.Get("since"),
+		Tail:       query.Get("tail"),
+		Timestamps: query.Get("timestamps") == "true",
+	}
+	sse := query.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	info, err := manager.Inspect(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	err = manager.StreamLogs(r.Context(), info.ID, options, func(stream string, line string) error {
+		var err error
+		if sse {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", stream, line)
+		} else {
+			_, err = fmt.Fprintln(w, line)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Log streaming of %s failed: %s", info.ID, err.Error())
+		if sse {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+		}
+	}
+}
+
+// execContainer runs a command in a container and returns its exit code and output.
+// The body is an ExecOptions with an optional timeout like "30s".
+func execContainer(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		docker.ExecOptions
+		Timeout string `json:"timeout"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid timeout " + req.Timeout})
+			return
+		}
+		req.ExecOptions.Timeout = timeout
+	}
+	result, err := manager.Exec(r.Context(), mux.Vars(r)["id"], req.ExecOptions)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+var upgrader = websocket.Upgrader{}
+
+// execMessage is sent to the websocket client for every output chunk and,
+// with the exit code, when the command finished.
+type execMessage struct {
+	Stream   string `json:"stream,omitempty"`
+	Data     string `json:"data,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// execInteractive runs a command in a container over a websocket. The command is
+// given by the cmd query parameters, tty and workingDir are optional. Messages
+// from the client are fed to the standard input, an empty message closes it.
+// The output is sent back as JSON execMessages.
+func execInteractive(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	tty, _ := strconv.ParseBool(query.Get("tty"))
+	session, err := manager.ExecInteractive(r.Context(), mux.Vars(r)["id"], docker.ExecOptions{
+		Cmd:        query["cmd"],
+		WorkingDir: query.Get("workingDir"),
+		Tty:        tty,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer session.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade exec connection: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// The request context is not cancelled for a hijacked connection.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				// The client went away.
+				cancel()
+				session.Close()
+				return
+			}
+			if len(data) == 0 {
+				_ = session.CloseStdin()
+				continue
+			}
+			if _, err := session.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = session.Stream(func(stream string, data []byte) error {
+		return conn.WriteJSON(execMessage{Stream: stream, Data: string(data)})
+	})
+	if err != nil {
+		_ = conn.WriteJSON(execMessage{Error: err.Error()})
+		return
+	}
+	exitCode, err := session.Wait(ctx)
+	if err != nil {
+		_ = conn.WriteJSON(execMessage{Error: err.Error()})
+		return
+	}
+	_ = conn.WriteJSON(execMessage{ExitCode: &exitCode})
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func listHealth(w http.ResponseWriter, r *http.Request) {
+	if docker.TenantFrom(r.Context()) == "" {
+		writeJSON(w, http.StatusOK, supervisor.Status())
+		return
+	}
+	list, err := manager.List(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	statuses := make([]docker.HealthStatus, 0, len(list))
+	for _, info := range list {
+		if status, ok := supervisor.StatusOf(info.ID); ok {
+			statuses = append(statuses, status)
+		}
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func containerHealth(w http.ResponseWriter, r *http.Request) {
+	info, err := manager.Inspect(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status, ok := supervisor.StatusOf(info.ID)
+	if !ok {
+		status = docker.HealthStatus{
+			ContainerID: info.ID,
+			Status:      docker.HealthUnknown,
+			Transitions: make([]docker.HealthTransition, 0),
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// containerStats samples the resource usage of a single worker.
+func containerStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := manager.Stats(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// streamStats streams the resource usage of the workers as newline delimited JSON
+// for the Grafana json-data-stream plugin, in the same shape as the load tester:
+// {"panelid": 1, "refid": "A", "values": {"timestamp": <ms>, "<row>": <value>}}.
+// The data-rows are metric names like cpu_percent, summed over all workers, or
+// <deployment or container>.<metric> for the workers of a deployment or a single one.
+func streamStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	panelID, err := strconv.Atoi(query.Get("panelid"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing or invalid panelid"})
+		return
+	}
+	refID := query.Get("refid")
+	if refID == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing refid"})
+		return
+	}
+	rows := make([]statsRow, 0)
+	for _, name := range strings.Split(query.Get("data-rows"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		row, err := parseStatsRow(name)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing data-rows"})
+		return
+	}
+	interval := statsInterval(query.Get("start"), query.Get("end"), query.Get("datapoints"))
+
+	flusher, _ := w.(http.Flusher)
+	if statsAllowedOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", statsAllowedOrigin)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for {
+		started := time.Now()
+		samples, err := manager.AllStats(r.Context())
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read container stats: %s", err.Error())
+		} else {
+			values := map[string]interface{}{"timestamp": started.UnixNano() / int64(time.Millisecond)}
+			for _, row := range rows {
+				values[row.name] = row.value(samples)
+			}
+			message := map[string]interface{}{"panelid": panelID, "refid": refID, "values": values}
+			if err := encoder.Encode(message); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(interval - time.Since(started)):
+		}
+	}
+}
+
+// statsRow is a data row of the stats stream.
+type statsRow struct {
+	name   string
+	target string
+	metric string
+}
+
+func parseStatsRow(name string) (statsRow, error) {
+	row := statsRow{name: name, metric: name}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		row.target, row.metric = name[:i], name[i+1:]
+	}
+	if _, ok := (docker.ContainerStats{}).Metric(row.metric); !ok {
+		return row, fmt.Errorf("Unknown metric %q", row.metric)
+	}
+	return row, nil
+}
+
+// value sums the metric over the samples of the row target.
+func (row statsRow) value(samples []docker.ContainerStats) float64 {
+	selected := make([]docker.ContainerStats, 0, len(samples))
+	for _, sample := range samples {
+		if row.target == "" || row.target == sample.Deployment || row.target == sample.Name ||
+			strings.HasPrefix(sample.ContainerID, row.target) {
+			selected = append(selected, sample)
+		}
+	}
+	value, _ := docker.SumStats(selected).Metric(row.metric)
+	return value
+}
+
+// statsInterval spreads the requested data points over the time range, given in
+// milliseconds, sampling at most every second. The docker stats API needs about
+// a second per sample anyway.
+func statsInterval(start string, end string, datapoints string) time.Duration {
+	from, err1 := strconv.ParseInt(start, 10, 64)
+	to, err2 := strconv.ParseInt(end, 10, 64)
+	points, err3 := strconv.ParseInt(datapoints, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || points <= 0 || to <= from {
+		return minStatsInterval
+	}
+	interval := time.Duration((to-from)/points) * time.Millisecond
+	if interval < minStatsInterval {
+		return minStatsInterval
+	}
+	if interval > maxStatsInterval {
+		return maxStatsInterval
+	}
+	return interval
+}
+
+// maxSpecSize limits the size of the submitted deployment specs.
+const maxSpecSize = 1 << 20
+
+// applyDeployment accepts a YAML or JSON deployment spec and reconciles the containers to it.
+func applyDeployment(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSpecSize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	deployment, err := docker.ParseDeployment(data)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ctx, response := withPullProgress(w, r)
+	result, err := manager.Apply(ctx, deployment)
+	response.result(http.StatusOK, result, err)
+}
+
+func listDeployments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, manager.Deployments(r.Context()))
+}
+
+func getDeployment(w http.ResponseWriter, r *http.Request) {
+	status, err := manager.DeploymentStatus(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func deleteDeployment(w http.ResponseWriter, r *http.Request) {
+	removed, err := manager.DeleteDeployment(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"removed": removed})
+}
+
+// deployStack brings up the docker-compose.yml of the request body as the named stack.
+func deployStack(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSpecSize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	file, err := docker.ParseCompose(data)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, response := withPullProgress(w, r)
+	status, err := manager.DeployStack(ctx, mux.Vars(r)["name"], file)
+	response.result(http.StatusCreated, status, err)
+}
+
+func listStacks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, manager.Stacks(r.Context()))
+}
+
+func getStack(w http.ResponseWriter, r *http.Request) {
+	status, err := manager.StackStatus(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func removeStack(w http.ResponseWriter, r *http.Request) {
+	removed, err := manager.RemoveStack(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"removed": removed})
+}
+
+func listSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := manager.Snapshots(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := manager.Snapshot(r.Context(), mux.Vars(r)["ref"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func removeSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := manager.RemoveSnapshot(r.Context(), mux.Vars(r)["ref"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func listOrphans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, manager.Orphans())
+}
+
+func adoptOrphan(w http.ResponseWriter, r *http.Request) {
+	info, err := manager.Adopt(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// streamEvents streams the container events as server-sent events until the client goes away.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	events, cancel := eventWatcher.Subscribe()
+	defer cancel()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if !event.Visible(r.Context()) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, eventWatcher.Webhooks(r.Context()))
+}
+
+func addWebhook(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		URL   string   `json:"url"`
+		Types []string `json:"types"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	webhook, err := eventWatcher.AddWebhook(r.Context(), req.URL, req.Types)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, webhook)
+}
+
+func removeWebhook(w http.ResponseWriter, r *http.Request) {
+	if !eventWatcher.RemoveWebhook(r.Context(), mux.Vars(r)["id"]) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "No such webhook"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listPorts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, manager.Ports().Allocations())
+}
+
+func submitJob(w http.ResponseWriter, r *http.Request) {
+	req := jobs.Request{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	job, err := jobQueue.Submit(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jobQueue.Jobs(r.Context(), r.URL.Query().Get("status")))
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	job, err := jobQueue.Job(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func reportJobProgress(w http.ResponseWriter, r *http.Request) {
+	report := jobs.ProgressReport{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&report); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	vars := mux.Vars(r)
+	if err := jobQueue.Progress(vars["id"], vars["token"], report); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func reportJobResult(w http.ResponseWriter, r *http.Request) {
+	report := jobs.ResultReport{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&report); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	vars := mux.Vars(r)
+	if err := jobQueue.Complete(vars["id"], vars["token"], report); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type buildRequest struct {
+	docker.BuildOptions
+	Context string `json:"context"`
+}
+
+// buildImage builds an image from a directory available to the server
+// and streams the build log back line by line. Admin only, the directory
+// could be anywhere on the server.
+func buildImage(w http.ResponseWriter, r *http.Request) {
+	req := buildRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Context == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing build context"})
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	err := manager.BuildImage(r.Context(), req.Context, req.BuildOptions, func(line string) {
+		fmt.Fprintln(w, line)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		// The status line may be gone already, report the failure in the log itself.
+		fmt.Fprintf(w, "ERROR: %s\n", err.Error())
+		log.Printf("Image build failed: %s", err.Error())
+		return
+	}
+	log.Printf("Image %v is built", req.Tags)
+}
+
+// pullImage pulls an image and streams the per layer progress as newline delimited JSON.
+func pullImage(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Image string `json:"image"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Image == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing image"})
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	err := manager.PullImage(r.Context(), req.Image, func(progress docker.PullProgress) {
+		if err := encoder.Encode(progress); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		log.Printf("Image pull failed: %s", err.Error())
+		_ = encoder.Encode(map[string]string{"error": err.Error()})
+	}
+}
+
+// rollingUpdate replaces the workers by workers running a new image and streams the
+// progress as newline delimited JSON, ending with the result.
+func rollingUpdate(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		docker.RolloutOptions
+		HealthTimeout string `json:"healthTimeout"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.HealthTimeout != "" {
+		timeout, err := time.ParseDuration(req.HealthTimeout)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid health timeout " + req.HealthTimeout})
+			return
+		}
+		req.RolloutOptions.HealthTimeout = timeout
+	}
+
+	// A client going away must not leave the update half done.
+	ctx := docker.WithTenant(context.Background(), docker.TenantFrom(r.Context()))
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	streaming := false
+	result, err := supervisor.RollingUpdate(ctx, req.RolloutOptions, func(event docker.RolloutEvent) {
+		if !streaming {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			streaming = true
+		}
+		if err := encoder.Encode(event); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		log.Printf("Rolling update failed: %s", err.Error())
+		if !streaming {
+			writeError(w, err)
+			return
+		}
+	}
+	_ = encoder.Encode(result)
+}
+
+func registerWorker(w http.ResponseWriter, r *http.Request) {
+	registration := registry.Registration{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpecSize)).Decode(&registration); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	credential := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	session, err := workerRegistry.Register(r.Context(), registration, credential)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, session)
+}
+
+func workerHeartbeat(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := workerRegistry.Heartbeat(vars["id"], vars["token"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deregisterWorker(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := workerRegistry.Deregister(vars["id"], vars["token"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listWorkers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, workerRegistry.Workers(r.Context()))
 }
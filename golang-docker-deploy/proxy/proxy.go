@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"golang-docker-deploy/docker"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrNoUpstream is returned when there is no running worker to route to.
+var ErrNoUpstream = errors.New("No running worker available")
+
+// Proxy routes requests arriving at the main server to the worker containers.
+type Proxy struct {
+	manager    *docker.Manager
+	supervisor *docker.Supervisor
+	workerHost string
+	next       uint64
+}
+
+// NewProxy creates a Proxy. workerHost is the host the published worker ports
+// are reachable on. supervisor is optional, if set the unhealthy workers are
+// left out of the pool.
+func NewProxy(manager *docker.Manager, supervisor *docker.Supervisor, workerHost string) *Proxy {
+	if workerHost == "" {
+		workerHost = "localhost"
+	}
+	return &Proxy{
+		manager:    manager,
+		supervisor: supervisor,
+		workerHost: workerHost,
+	}
+}
+
+func (p *Proxy) upstream(info docker.ContainerInfo) (*url.URL, error) {
+	if info.State != "running" {
+		return nil, fmt.Errorf("Worker %s is %s", info.ID, info.State)
+	}
+	if len(info.Ports) == 0 {
+		return nil, fmt.Errorf("Worker %s has no published port", info.ID)
+	}
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(p.workerHost, info.Ports[0].HostPort),
+	}, nil
+}
+
+func (p *Proxy) healthy(id string) bool {
+	if p.supervisor == nil {
+		return true
+	}
+	status, ok := p.supervisor.StatusOf(id)
+	return !ok || status.Status != docker.HealthUnhealthy
+}
+
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, target *url.URL, prefix string) {
+	req := r.Clone(r.Context())
+	req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	req.URL.RawPath = ""
+	// The API token of the caller is meant for the deploy service, not for the worker.
+	req.Header.Del("Authorization")
+
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Proxy to %s failed: %s", target.Host, err.Error())
+		writeError(w, http.StatusBadGateway, err)
+	}
+	reverseProxy.ServeHTTP(w, req)
+}
+
+// ServeWorker routes /workers/{id}/... to the worker identified by id.
+func (p *Proxy) ServeWorker(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	info, err := p.manager.Inspect(r.Context(), id)
+	if errors.Is(err, docker.ErrNotManaged) || docker.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	target, err := p.upstream(*info)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	// Proxied requests keep the worker from running into its idle timeout.
+	p.manager.Touch(info.ID)
+	p.forward(w, r, target, "/workers/"+id)
+}
+
+// ServePool routes /pool/... to the running workers in round-robin order.
+func (p *Proxy) ServePool(w http.ResponseWriter, r *http.Request) {
+	list, err := p.manager.List(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	targets := make([]*url.URL, 0, len(list))
+	ids := make([]string, 0, len(list))
+	for _, info := range list {
+		if info.Stack != "" || !p.healthy(info.ID) {
+			continue
+		}
+		if target, err := p.upstream(info); err == nil {
+			targets = append(targets, target)
+			ids = append(ids, info.ID)
+		}
+	}
+	if len(targets) == 0 {
+		writeError(w, http.StatusServiceUnavailable, ErrNoUpstream)
+		return
+	}
+	next := atomic.AddUint64(&p.next, 1) % uint64(len(targets))
+	p.manager.Touch(ids[next])
+	p.forward(w, r, targets[next], "/pool")
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}); err != nil {
+		log.Printf("Failed to write response: %s", err.Error())
+	}
+}
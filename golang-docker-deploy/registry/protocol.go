@@ -0,0 +1,31 @@
+package registry
+
+// The registration protocol:
+//
+// A worker registers on startup with POST /registry carrying a Registration,
+// with the registration token of the main server as bearer token if one is
+// configured. The workers started by the main server get a credential of their
+// own instead, see Registry.Credential. The answer is a Session: the worker must POST to HeartbeatURL at
+// least every HeartbeatInterval, a worker missing several heartbeats in a row is
+// considered lost. A heartbeat answered with 404 Not Found means the main server
+// forgot the worker, after a restart for example, and the worker must register
+// again. On shutdown the worker sends DELETE to HeartbeatURL.
+
+// Registration is sent by a worker on startup.
+type Registration struct {
+	// ID identifies the worker. A worker running in a managed container is only
+	// matched with it by the full container ID, not by the hostname or an ID prefix.
+	ID      string `json:"id"`
+	Version string `json:"version,omitempty"`
+	// Capabilities are the job types the worker can run.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Address is where the worker can be reached, if it knows.
+	Address string `json:"address,omitempty"`
+}
+
+// Session is the answer to a registration.
+type Session struct {
+	ID                string `json:"id"`
+	HeartbeatURL      string `json:"heartbeatUrl"`
+	HeartbeatInterval string `json:"heartbeatInterval"`
+}
@@ -0,0 +1,266 @@
+package registry
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang-docker-deploy/docker"
+)
+
+// Worker statuses.
+const (
+	StatusAlive = "alive"
+	StatusLost  = "lost"
+)
+
+const (
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultMissedHeartbeats  = 3
+	// forgetAfter is how long lost workers stay listed.
+	forgetAfter = time.Hour
+)
+
+// ErrWorkerNotFound is returned for an unknown worker or session, the worker must register again.
+var ErrWorkerNotFound = errors.New("No such worker")
+
+// ErrInvalidRegistration is returned when a registration is not valid.
+var ErrInvalidRegistration = errors.New("Invalid registration")
+
+// ErrInvalidCredential is returned when a worker registers with a wrong credential.
+var ErrInvalidCredential = errors.New("Invalid registration credential")
+
+// LabelCredential is put on a worker container, it holds the nonce of the
+// registration credential of the worker.
+const LabelCredential = "golang-docker-deploy-credential"
+
+var workerIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Worker is a registered worker.
+type Worker struct {
+	Registration
+	Status string `json:"status"`
+	// ContainerID, Deployment and Tenant are set when the worker runs in a
+	// container managed by the deploy service.
+	ContainerID   string    `json:"containerId,omitempty"`
+	Deployment    string    `json:"deployment,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	Registered    time.Time `json:"registered"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	token         string
+}
+
+// Config controls the Registry. Zero values select the defaults.
+type Config struct {
+	// HeartbeatInterval is how often the workers send a heartbeat, 10s by default.
+	HeartbeatInterval time.Duration
+	// MissedHeartbeats is how many heartbeats in a row may be missed before
+	// a worker is lost, 3 by default.
+	MissedHeartbeats int
+	// Token is the registration token, the workers registering with it may run
+	// anywhere. Without it any worker may register.
+	Token string
+}
+
+// Registry keeps track of the workers which registered themselves with the main
+// server, wherever they were started. It is not persisted, the workers register
+// again when their heartbeats are rejected after a restart.
+type Registry struct {
+	manager     *docker.Manager
+	callbackURL string
+	config      Config
+	mutex       sync.Mutex
+	workers     map[string]*Worker
+}
+
+// NewRegistry creates a Registry. manager is used to match the workers with
+// the managed containers, callbackURL is the base URL of the main server as
+// seen from the workers.
+func NewRegistry(manager *docker.Manager, callbackURL string, config Config) *Registry {
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if config.MissedHeartbeats <= 0 {
+		config.MissedHeartbeats = defaultMissedHeartbeats
+	}
+	return &Registry{
+		manager:     manager,
+		callbackURL: callbackURL,
+		config:      config,
+		workers:     make(map[string]*Worker),
+	}
+}
+
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Credential returns a registration credential for a new worker container, the
+// nonce goes into the LabelCredential label of the container. The credential only
+// registers that container, as long as it exists, so the worker can not give
+// away the registration token.
+func (r *Registry) Credential() (nonce string, credential string, err error) {
+	if nonce, err = newToken(); err != nil {
+		return "", "", err
+	}
+	return nonce, r.sign(nonce), nil
+}
+
+func (r *Registry) sign(nonce string) string {
+	mac := hmac.New(sha256.New, []byte(r.config.Token))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Register adds the worker, or replaces it if it registered before. The worker
+// is matched with a managed container by its ID, which must be the full container ID.
+// credential is the registration token, or the credential of the worker container.
+func (r *Registry) Register(ctx context.Context, registration Registration, credential string) (Session, error) {
+	if !workerIDPattern.MatchString(registration.ID) {
+		return Session{}, fmt.Errorf("%w: invalid worker id %q", ErrInvalidRegistration, registration.ID)
+	}
+	token, err := newToken()
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC()
+	worker := &Worker{
+		Registration:  registration,
+		Status:        StatusAlive,
+		Registered:    now,
+		LastHeartbeat: now,
+		token:         token,
+	}
+	// The registration comes from the worker itself, so it is looked up without
+	// tenant. A prefix would let any worker claim the container, and its tenant,
+	// matching it first.
+	info, err := r.manager.Inspect(docker.WithTenant(ctx, ""), registration.ID)
+	if err == nil && info.ID == registration.ID {
+		worker.ContainerID = info.ID
+		worker.Deployment = info.Deployment
+		worker.Tenant = info.Tenant
+	}
+	if r.config.Token != "" && !hmac.Equal([]byte(credential), []byte(r.config.Token)) {
+		nonce := ""
+		if worker.ContainerID != "" {
+			nonce = info.Labels[LabelCredential]
+		}
+		if nonce == "" || !hmac.Equal([]byte(credential), []byte(r.sign(nonce))) {
+			return Session{}, fmt.Errorf("%w: worker %s", ErrInvalidCredential, registration.ID)
+		}
+	}
+
+	r.mutex.Lock()
+	r.workers[registration.ID] = worker
+	r.mutex.Unlock()
+	log.Printf("Worker %s (version %s) registered", registration.ID, registration.Version)
+	return Session{
+		ID:                registration.ID,
+		HeartbeatURL:      fmt.Sprintf("%s/registry/%s/sessions/%s", r.callbackURL, registration.ID, token),
+		HeartbeatInterval: r.config.HeartbeatInterval.String(),
+	}, nil
+}
+
+// session returns the worker if token is its current session. Must be called with the mutex held.
+func (r *Registry) session(id string, token string) (*Worker, error) {
+	worker, ok := r.workers[id]
+	if !ok || worker.token != token {
+		return nil, fmt.Errorf("%w: %s", ErrWorkerNotFound, id)
+	}
+	return worker, nil
+}
+
+// Heartbeat records a heartbeat of the worker session, a lost worker is alive again.
+// Heartbeats do not count as activity for the idle timeout of the container.
+func (r *Registry) Heartbeat(id string, token string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	worker, err := r.session(id, token)
+	if err != nil {
+		return err
+	}
+	worker.LastHeartbeat = time.Now().UTC()
+	if worker.Status == StatusLost {
+		log.Printf("Worker %s is back", id)
+	}
+	worker.Status = StatusAlive
+	return nil
+}
+
+// Deregister removes the worker of the session.
+func (r *Registry) Deregister(id string, token string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, err := r.session(id, token); err != nil {
+		return err
+	}
+	delete(r.workers, id)
+	log.Printf("Worker %s deregistered", id)
+	return nil
+}
+
+// Workers returns the workers visible from ctx sorted by ID. The workers running
+// outside of the managed containers are only visible without tenant.
+func (r *Registry) Workers(ctx context.Context) []Worker {
+	tenant := docker.TenantFrom(ctx)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	list := make([]Worker, 0, len(r.workers))
+	for _, worker := range r.workers {
+		if tenant == "" || (worker.ContainerID != "" && worker.Tenant == tenant) {
+			list = append(list, *worker)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Check marks the workers missing their heartbeats as lost and forgets the ones
+// lost for long.
+func (r *Registry) Check() {
+	now := time.Now()
+	timeout := r.config.HeartbeatInterval * time.Duration(r.config.MissedHeartbeats)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, worker := range r.workers {
+		silent := now.Sub(worker.LastHeartbeat)
+		if silent > timeout+forgetAfter {
+			delete(r.workers, id)
+			log.Printf("Lost worker %s is forgotten", id)
+			continue
+		}
+		if silent > timeout && worker.Status == StatusAlive {
+			worker.Status = StatusLost
+			log.Printf("Worker %s is lost, no heartbeat for %s", id, silent.Round(time.Second))
+		}
+	}
+}
+
+// Run checks the heartbeats every heartbeat interval until ctx is cancelled.
+func (r *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Check()
+		}
+	}
+}
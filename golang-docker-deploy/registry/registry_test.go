@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"path"
+	"testing"
+
+	"golang-docker-deploy/docker"
+)
+
+func newTestRegistry(t *testing.T, token string) (*Registry, *docker.Manager) {
+	t.Helper()
+	rt := docker.NewFakeRuntime()
+	rt.AddImage("worker:1")
+	ports, err := docker.ParsePortRange("47100-47109")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := docker.NewManager(rt, ports)
+	return NewRegistry(manager, "http://deploy:8080", Config{Token: token}), manager
+}
+
+func TestRegisterCredential(t *testing.T) {
+	registry, manager := newTestRegistry(t, "secret")
+	nonce, credential, err := registry.Credential()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := docker.WithTenant(context.Background(), "team")
+	spec := docker.ContainerSpec{Image: "worker:1", Labels: map[string]string{LabelCredential: nonce}}
+	worker, err := manager.CreateNewContainer(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := manager.CreateNewContainer(ctx, docker.ContainerSpec{Image: "worker:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		id         string
+		credential string
+		err        error
+	}{
+		{"own container", worker.ID, credential, nil},
+		{"registration token", "external", "secret", nil},
+		{"short container ID", worker.ID[:12], credential, ErrInvalidCredential},
+		{"another container", other.ID, credential, ErrInvalidCredential},
+		{"outside of a container", "external", credential, ErrInvalidCredential},
+		{"nonce", worker.ID, nonce, ErrInvalidCredential},
+		{"no credential", worker.ID, "", ErrInvalidCredential},
+		{"invalid id", "../worker", "secret", ErrInvalidRegistration},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, err := registry.Register(context.Background(), Registration{ID: test.id}, test.credential)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Register returned %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if session.ID != test.id || session.HeartbeatURL == "" {
+				t.Errorf("Session is %v", session)
+			}
+		})
+	}
+
+	workers := registry.Workers(ctx)
+	if len(workers) != 1 || workers[0].ContainerID != worker.ID || workers[0].Tenant != "team" {
+		t.Errorf("Tenant sees workers %v, want only its container %s", workers, worker.ID)
+	}
+	if workers := registry.Workers(docker.WithTenant(context.Background(), "other")); len(workers) != 0 {
+		t.Errorf("Another tenant sees workers %v", workers)
+	}
+}
+
+func TestRegisterWithoutToken(t *testing.T) {
+	registry, _ := newTestRegistry(t, "")
+	if _, err := registry.Register(context.Background(), Registration{ID: "external"}, ""); err != nil {
+		t.Fatalf("Register without a registration token returned %s", err.Error())
+	}
+}
+
+func TestSession(t *testing.T) {
+	registry, _ := newTestRegistry(t, "")
+	first, err := registry.Register(context.Background(), Registration{ID: "external"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registering again replaces the session.
+	second, err := registry.Register(context.Background(), Registration{ID: "external"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(session Session) string {
+		return path.Base(session.HeartbeatURL)
+	}
+
+	if err := registry.Heartbeat("external", token(first)); !errors.Is(err, ErrWorkerNotFound) {
+		t.Errorf("Heartbeat of the replaced session returned %v, want %v", err, ErrWorkerNotFound)
+	}
+	if err := registry.Heartbeat("external", token(second)); err != nil {
+		t.Errorf("Heartbeat returned %s", err.Error())
+	}
+	if err := registry.Deregister("external", token(first)); !errors.Is(err, ErrWorkerNotFound) {
+		t.Errorf("Deregister of the replaced session returned %v, want %v", err, ErrWorkerNotFound)
+	}
+	if err := registry.Deregister("external", token(second)); err != nil {
+		t.Errorf("Deregister returned %s", err.Error())
+	}
+	if err := registry.Heartbeat("external", token(second)); !errors.Is(err, ErrWorkerNotFound) {
+		t.Errorf("Heartbeat after the deregistration returned %v, want %v", err, ErrWorkerNotFound)
+	}
+}
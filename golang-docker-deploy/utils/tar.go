@@ -1,22 +1,256 @@
 package utils
 
 import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
 	"fmt"
-
-	"github.com/jhoonb/archivex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-func TarDirectory(folderName string) error {
-	tar := new(archivex.TarFile)
-	tarName := fmt.Sprintf("./%s.tar", folderName)
-	if err := tar.Create(tarName); err != nil {
+// TarOptions controls how a directory is archived.
+type TarOptions struct {
+	// Excludes are .dockerignore style patterns of the paths left out of the archive.
+	// A pattern starting with ! brings back paths excluded by an earlier pattern.
+	Excludes []string
+	// Gzip compresses the archive.
+	Gzip bool
+	// Reproducible clears the timestamps and owners, so identical directory
+	// content always gives a byte-identical archive.
+	Reproducible bool
+}
+
+// WriteTar streams the content of folderName as a tar archive to w. The entries are
+// relative to folderName and sorted by name, the file modes are kept and symlinks are
+// stored as links. Sockets and devices are skipped.
+func WriteTar(w io.Writer, folderName string, options TarOptions) error {
+	patterns, err := parsePatterns(options.Excludes)
+	if err != nil {
+		return err
+	}
+	hasExceptions := false
+	for _, p := range patterns {
+		hasExceptions = hasExceptions || p.exception
+	}
+
+	var gz *gzip.Writer
+	if options.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	// filepath.Walk visits the files in lexical order, which keeps the archive stable.
+	err = filepath.Walk(folderName, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(folderName, fileName)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(patterns, rel) {
+			if info.IsDir() && !hasExceptions {
+				return filepath.SkipDir
+			}
+			// The directory is walked anyway, an exception may bring back some of its content.
+			return nil
+		}
+		return addTarEntry(tw, fileName, rel, info, options.Reproducible)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to archive %s: %s", folderName, err.Error())
+	}
+	if err := tw.Close(); err != nil {
 		return err
 	}
-	if err := tar.AddAll(folderName, true); err != nil {
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// WriteTarFile streams the single file fileName as a tar archive to w, under the
+// entry name. Only the Gzip and Reproducible options apply.
+func WriteTarFile(w io.Writer, fileName string, name string, options TarOptions) error {
+	info, err := os.Lstat(fileName)
+	if err != nil {
 		return err
 	}
-	if err := tar.Close(); err != nil {
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", fileName)
+	}
+
+	var gz *gzip.Writer
+	if options.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	if err := addTarEntry(tw, fileName, name, info, options.Reproducible); err != nil {
+		return fmt.Errorf("Failed to archive %s: %s", fileName, err.Error())
+	}
+	if err := tw.Close(); err != nil {
 		return err
 	}
+	if gz != nil {
+		return gz.Close()
+	}
 	return nil
 }
+
+func addTarEntry(tw *tar.Writer, fileName string, name string, info os.FileInfo, reproducible bool) error {
+	mode := info.Mode()
+	if mode&(os.ModeSocket|os.ModeDevice|os.ModeNamedPipe|os.ModeCharDevice) != 0 {
+		return nil
+	}
+	link := ""
+	if mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fileName)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if reproducible {
+		header.ModTime = time.Unix(0, 0)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !mode.IsRegular() {
+		return nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// ReadIgnoreFile reads the .dockerignore style patterns of fileName. A missing
+// file means no patterns.
+func ReadIgnoreFile(fileName string) ([]string, error) {
+	file, err := os.Open(filepath.Clean(fileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	patterns := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+type pattern struct {
+	segments  []string
+	exception bool
+}
+
+func parsePatterns(excludes []string) ([]pattern, error) {
+	patterns := make([]pattern, 0, len(excludes))
+	for _, exclude := range excludes {
+		p := pattern{}
+		exclude = strings.TrimSpace(exclude)
+		if strings.HasPrefix(exclude, "!") {
+			p.exception = true
+			exclude = strings.TrimSpace(exclude[1:])
+		}
+		exclude = strings.Trim(path.Clean(filepath.ToSlash(exclude)), "/")
+		if exclude == "" || exclude == "." {
+			continue
+		}
+		p.segments = strings.Split(exclude, "/")
+		for _, segment := range p.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("Invalid exclude pattern %q: %s", exclude, err.Error())
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// Excluded tells whether the path name, relative to the archived directory, is
+// left out of the archive by the excludes patterns.
+func Excluded(excludes []string, name string) (bool, error) {
+	patterns, err := parsePatterns(excludes)
+	if err != nil {
+		return false, err
+	}
+	return excluded(patterns, strings.Trim(path.Clean(filepath.ToSlash(name)), "/")), nil
+}
+
+// excluded tells whether name is excluded by the patterns. The last matching
+// pattern wins, a pattern matching a parent directory matches its content too.
+func excluded(patterns []pattern, name string) bool {
+	segments := strings.Split(name, "/")
+	result := false
+	for _, p := range patterns {
+		for i := len(segments); i > 0; i-- {
+			if matchSegments(p.segments, segments[:i]) {
+				result = !p.exception
+				break
+			}
+		}
+	}
+	return result
+}
+
+// matchSegments matches the path segments against the pattern segments, ** matches
+// any number of directories.
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		name     string
+		excludes []string
+		path     string
+		excluded bool
+	}{
+		{"no patterns", nil, "Dockerfile", false},
+		{"file", []string{"Dockerfile"}, "Dockerfile", true},
+		{"other file", []string{"*.md"}, "Dockerfile", false},
+		{"wildcard", []string{"*"}, "Dockerfile", true},
+		{"parent directory", []string{"build"}, "build/Dockerfile", true},
+		{"any depth", []string{"**/*.log"}, "logs/app/today.log", true},
+		{"exception", []string{"*", "!Dockerfile"}, "Dockerfile", false},
+		{"last pattern wins", []string{"!Dockerfile", "*"}, "Dockerfile", true},
+		{"leading slash", []string{"/.dockerignore"}, ".dockerignore", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			excluded, err := Excluded(test.excludes, test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if excluded != test.excluded {
+				t.Errorf("Excluded(%v, %s) is %v", test.excludes, test.path, excluded)
+			}
+		})
+	}
+	if _, err := Excluded([]string{"[a-"}, "Dockerfile"); err == nil {
+		t.Errorf("Invalid pattern is accepted")
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"Dockerfile", "main.go", "node_modules/lib/index.js", "docs/README.md", "docs/api.md"} {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		excludes []string
+		entries  []string
+	}{
+		{"everything", nil, []string{"Dockerfile", "docs/", "docs/README.md", "docs/api.md", "main.go", "node_modules/", "node_modules/lib/", "node_modules/lib/index.js"}},
+		{"excluded directory", []string{"node_modules", "docs"}, []string{"Dockerfile", "main.go"}},
+		{"exception in an excluded directory", []string{"docs", "!docs/README.md"}, []string{"Dockerfile", "docs/README.md", "main.go", "node_modules/", "node_modules/lib/", "node_modules/lib/index.js"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := WriteTar(&buffer, dir, TarOptions{Excludes: test.excludes, Reproducible: true}); err != nil {
+				t.Fatal(err)
+			}
+			entries := make([]string, 0)
+			reader := tar.NewReader(&buffer)
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, header.Name)
+			}
+			if !reflect.DeepEqual(entries, test.entries) {
+				t.Errorf("Archive has %v, want %v", entries, test.entries)
+			}
+		})
+	}
+}
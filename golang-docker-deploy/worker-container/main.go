@@ -1,22 +1,87 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// dispatch is a job offered by the main server, see the jobs package of the main server
+// for the protocol.
+type dispatch struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Attempt     int             `json:"attempt"`
+	Timeout     string          `json:"timeout"`
+	CallbackURL string          `json:"callbackUrl"`
+}
+
+type progressReport struct {
+	Progress int    `json:"progress"`
+	Message  string `json:"message,omitempty"`
+}
+
+type resultReport struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// registration and session are the worker registry protocol, see the registry
+// package of the main server.
+type registration struct {
+	ID           string   `json:"id"`
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+type session struct {
+	HeartbeatURL      string `json:"heartbeatUrl"`
+	HeartbeatInterval string `json:"heartbeatInterval"`
+}
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// capabilities are the job types runJob knows.
+var capabilities = []string{"echo", "sleep"}
+
+// errUnknownSession is returned by a heartbeat the main server does not know.
+var errUnknownSession = errors.New("Unknown session")
+
+// busy is set while the worker runs a job, it takes one job at a time.
+var busy int32
+
+var client = &http.Client{Timeout: 5 * time.Second}
+
 func main() {
+	// The main server passes its URL to the workers it starts, the other ones
+	// register only if DEPLOY_SERVER is set.
+	registered := make(chan string, 1)
+	registryCtx, stopRegistry := context.WithCancel(context.Background())
+	if server := os.Getenv("DEPLOY_SERVER"); server != "" {
+		go stayRegistered(registryCtx, strings.TrimRight(server, "/"), registered)
+	} else {
+		close(registered)
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", HelloServer)
+	r.HandleFunc("/jobs", acceptJob).Methods(http.MethodPost)
 	// Create Server and Route Handlers
 	srv := &http.Server{
 		Handler:      r,
@@ -34,10 +99,15 @@ func main() {
 	}()
 
 	// Graceful Shutdown
-	waitForShutdown(srv)
+	waitForShutdown(srv, func() {
+		stopRegistry()
+		if heartbeatURL, ok := <-registered; ok {
+			deregister(heartbeatURL)
+		}
+	})
 }
 
-func waitForShutdown(srv *http.Server) {
+func waitForShutdown(srv *http.Server, cleanup func()) {
 	interruptChan := make(chan os.Signal, 1)
 	signal.Notify(interruptChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
@@ -48,6 +118,7 @@ func waitForShutdown(srv *http.Server) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 	srv.Shutdown(ctx)
+	cleanup()
 
 	log.Println("Shutting down")
 	os.Exit(0)
@@ -57,3 +128,233 @@ func HelloServer(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello, Worker!")
 	log.Println("Hello, Worker...")
 }
+
+// acceptJob takes the offered job if the worker is idle and runs it in the background.
+func acceptJob(w http.ResponseWriter, r *http.Request) {
+	job := dispatch{}
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&busy, 0, 1) {
+		http.Error(w, "Busy", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	log.Printf("Job %s (%s, attempt %d) accepted", job.ID, job.Type, job.Attempt)
+	go func() {
+		defer atomic.StoreInt32(&busy, 0)
+		runJob(job)
+	}()
+}
+
+func runJob(job dispatch) {
+	timeout, err := time.ParseDuration(job.Timeout)
+	if err != nil {
+		timeout = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	report := resultReport{}
+	switch job.Type {
+	case "echo":
+		report.Result = job.Payload
+	case "sleep":
+		err = sleepJob(ctx, job)
+	default:
+		err = fmt.Errorf("Unknown job type %q", job.Type)
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if err := post(job.CallbackURL+"/result", report); err != nil {
+		log.Printf("Failed to report the result of job %s: %s", job.ID, err.Error())
+		return
+	}
+	log.Printf("Job %s done", job.ID)
+}
+
+// sleepJob waits for the given number of seconds, reporting the progress every second.
+func sleepJob(ctx context.Context, job dispatch) error {
+	params := struct {
+		Seconds int `json:"seconds"`
+	}{}
+	if err := json.Unmarshal(job.Payload, &params); err != nil {
+		return fmt.Errorf("Invalid payload: %s", err.Error())
+	}
+	for i := 0; i < params.Seconds; i++ {
+		select {
+		case <-ctx.Done():
+			return errors.New("Timed out")
+		case <-time.After(time.Second):
+		}
+		progress := progressReport{
+			Progress: (i + 1) * 100 / params.Seconds,
+			Message:  fmt.Sprintf("%d of %d seconds", i+1, params.Seconds),
+		}
+		if err := post(job.CallbackURL+"/progress", progress); err != nil {
+			log.Printf("Failed to report the progress of job %s: %s", job.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+// post sends a report to the main server, retrying a few times.
+func post(url string, report interface{}) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body)) // nolint:noctx
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				if resp.StatusCode >= http.StatusBadRequest {
+					return fmt.Errorf("main server answered %s", resp.Status)
+				}
+				return nil
+			}
+			err = fmt.Errorf("main server answered %s", resp.Status)
+		}
+		if attempt == 3 {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// stayRegistered registers the worker with the main server and sends the heartbeats
+// until ctx is cancelled, registering again whenever the main server forgot the
+// worker. The current heartbeat URL is left in registered when it returns.
+func stayRegistered(ctx context.Context, server string, registered chan<- string) {
+	current := ""
+	defer func() {
+		registered <- current
+		close(registered)
+	}()
+	delay := time.Second
+	for ctx.Err() == nil {
+		s, err := register(ctx, server)
+		if err != nil {
+			log.Printf("Failed to register with %s: %s", server, err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			if delay < 30*time.Second {
+				delay *= 2
+			}
+			continue
+		}
+		delay = time.Second
+		current = s.HeartbeatURL
+		interval, err := time.ParseDuration(s.HeartbeatInterval)
+		if err != nil || interval <= 0 {
+			interval = 10 * time.Second
+		}
+		log.Printf("Registered with %s, heartbeat every %s", server, interval)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			err := heartbeat(ctx, current)
+			if errors.Is(err, errUnknownSession) {
+				break
+			}
+			if err != nil {
+				log.Printf("Heartbeat failed: %s", err.Error())
+			}
+		}
+		log.Println("The main server forgot the worker, registering again")
+		current = ""
+	}
+}
+
+// containerIDPattern finds the full container ID in the mounts docker sets up,
+// like /var/lib/docker/containers/<id>/hostname.
+var containerIDPattern = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+
+// containerID returns the full ID of the container the worker runs in, the main
+// server only matches the worker with its container by the full ID. Outside of
+// docker it is the hostname.
+func containerID() string {
+	if mounts, err := ioutil.ReadFile("/proc/self/mountinfo"); err == nil {
+		if match := containerIDPattern.FindSubmatch(mounts); match != nil {
+			return string(match[1])
+		}
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func register(ctx context.Context, server string) (session, error) {
+	s := session{}
+	id := os.Getenv("WORKER_ID")
+	if id == "" {
+		id = containerID()
+	}
+	body, err := json.Marshal(registration{ID: id, Version: version, Capabilities: capabilities})
+	if err != nil {
+		return s, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server+"/registry", bytes.NewReader(body))
+	if err != nil {
+		return s, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("REGISTRATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return s, fmt.Errorf("main server answered %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return s, err
+}
+
+func heartbeat(ctx context.Context, heartbeatURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, heartbeatURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errUnknownSession
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("main server answered %s", resp.Status)
+	}
+	return nil
+}
+
+// deregister tells the main server the worker is going away.
+func deregister(heartbeatURL string) {
+	if heartbeatURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, heartbeatURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Failed to deregister: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+}